@@ -82,13 +82,17 @@ func (t *Token) IsValid() bool {
 }
 
 func (t *Token) isValidWithEarlyExpiry(earlyExpiry time.Duration) bool {
+	return t.isValidWithEarlyExpiryAt(earlyExpiry, timeNow())
+}
+
+func (t *Token) isValidWithEarlyExpiryAt(earlyExpiry time.Duration, now time.Time) bool {
 	if t == nil || t.Value == "" {
 		return false
 	}
 	if t.Expiry.IsZero() {
 		return true
 	}
-	return !t.Expiry.Round(0).Add(-earlyExpiry).Before(timeNow())
+	return !t.Expiry.Round(0).Add(-earlyExpiry).Before(now)
 }
 
 // CachedTokenProviderOptions provided options for configuring a
@@ -110,7 +114,7 @@ func (ctpo *CachedTokenProviderOptions) autoRefresh() bool {
 }
 
 func (ctpo *CachedTokenProviderOptions) expireEarly() time.Duration {
-	if ctpo == nil {
+	if ctpo == nil || ctpo.ExpireEarly == 0 {
 		return defaultExpiryDelta
 	}
 	return ctpo.ExpireEarly
@@ -141,9 +145,16 @@ type cachedTokenProvider struct {
 }
 
 func (c *cachedTokenProvider) Token(ctx context.Context) (*Token, error) {
+	now := timeNow
+	if clock := internal.Clock(ctx); clock != nil {
+		now = clock
+	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if c.cachedToken.IsValid() || !c.autoRefresh {
+	// A token the caller found stale is refreshed even if it has not expired.
+	staleValue := internal.StaleToken(ctx)
+	stale := staleValue != "" && c.cachedToken != nil && c.cachedToken.Value == staleValue
+	if (!stale && c.cachedToken.isValidWithEarlyExpiryAt(c.expireEarly, now())) || !c.autoRefresh {
 		return c.cachedToken, nil
 	}
 	t, err := c.tp.Token(ctx)
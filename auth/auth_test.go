@@ -25,6 +25,7 @@ import (
 	"testing"
 	"time"
 
+	"cloud.google.com/go/auth/internal"
 	"cloud.google.com/go/auth/internal/jwt"
 	"github.com/google/go-cmp/cmp"
 )
@@ -131,6 +132,89 @@ func TestToken_isValidWithEarlyExpiry(t *testing.T) {
 	}
 }
 
+func TestCachedTokenProvider_Clock(t *testing.T) {
+	now := time.Now()
+	tp := &countingTP{expiry: now.Add(time.Hour)}
+	ctp := NewCachedTokenProvider(tp, nil)
+	if _, err := ctp.Token(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx := internal.WithClock(context.Background(), func() time.Time { return now.Add(2 * time.Hour) })
+	if _, err := ctp.Token(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if tp.calls != 2 {
+		t.Errorf("got %d calls, want 2", tp.calls)
+	}
+}
+
+func TestCachedTokenProvider_StaleToken(t *testing.T) {
+	tp := &countingTP{expiry: time.Now().Add(time.Hour)}
+	ctp := NewCachedTokenProvider(tp, nil)
+	if _, err := ctp.Token(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctp.Token(internal.WithStaleToken(context.Background(), "otherToken")); err != nil {
+		t.Fatal(err)
+	}
+	if tp.calls != 1 {
+		t.Errorf("got %d calls, want 1", tp.calls)
+	}
+	if _, err := ctp.Token(internal.WithStaleToken(context.Background(), "fakeToken")); err != nil {
+		t.Fatal(err)
+	}
+	if tp.calls != 2 {
+		t.Errorf("got %d calls, want 2", tp.calls)
+	}
+}
+
+func TestCachedTokenProvider_ExpireEarly(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	tests := []struct {
+		name        string
+		opts        *CachedTokenProviderOptions
+		expiresIn   time.Duration
+		wantRefresh bool
+	}{
+		{name: "default, outside window", expiresIn: 11 * time.Second, wantRefresh: false},
+		{name: "default, inside window", expiresIn: 9 * time.Second, wantRefresh: true},
+		{name: "unset ExpireEarly, inside window", opts: &CachedTokenProviderOptions{}, expiresIn: 9 * time.Second, wantRefresh: true},
+		{name: "custom, outside window", opts: &CachedTokenProviderOptions{ExpireEarly: time.Minute}, expiresIn: 61 * time.Second, wantRefresh: false},
+		{name: "custom, inside window", opts: &CachedTokenProviderOptions{ExpireEarly: time.Minute}, expiresIn: 59 * time.Second, wantRefresh: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tp := &countingTP{expiry: now.Add(tt.expiresIn)}
+			ctp := NewCachedTokenProvider(tp, tt.opts)
+			for i := 0; i < 2; i++ {
+				if _, err := ctp.Token(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want := 1
+			if tt.wantRefresh {
+				want = 2
+			}
+			if tp.calls != want {
+				t.Errorf("got %d calls, want %d", tp.calls, want)
+			}
+		})
+	}
+}
+
+type countingTP struct {
+	expiry time.Time
+	calls  int
+}
+
+func (tp *countingTP) Token(context.Context) (*Token, error) {
+	tp.calls++
+	return &Token{Value: "fakeToken", Expiry: tp.expiry}, nil
+}
+
 func TestError_Error(t *testing.T) {
 
 	tests := []struct {
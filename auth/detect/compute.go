@@ -19,7 +19,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"net/url"
+	"os"
 	"strings"
 	"time"
 
@@ -35,6 +38,51 @@ var (
 	computeTokenURI = "instance/service-accounts/default/token"
 )
 
+const (
+	// metadataIP is the documented metadata server IP address.
+	metadataIP = "169.254.169.254"
+	// metadataHostEnv is the environment variable that overrides the host of
+	// the metadata server, as is honored by
+	// [cloud.google.com/go/compute/metadata].
+	metadataHostEnv = "GCE_METADATA_HOST"
+)
+
+// probeMetadataServer reports whether the metadata server responds within
+// timeout, probing it with client if it is not nil. The error describes why it
+// is unreachable if it does not.
+func probeMetadataServer(client *http.Client, timeout time.Duration) (bool, error) {
+	host := os.Getenv(metadataHostEnv)
+	if host == "" {
+		host = metadataIP
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+host, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	if client == nil {
+		client = &http.Client{
+			Transport: &http.Transport{
+				DialContext: (&net.Dialer{Timeout: timeout}).DialContext,
+				// The transport is discarded after the probe, so its
+				// connection must not be kept open.
+				DisableKeepAlives: true,
+			},
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("metadata server unreachable within %v: %w", timeout, err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("Metadata-Flavor") != "Google" {
+		return false, fmt.Errorf("server at %s is not a metadata server", host)
+	}
+	return true, nil
+}
+
 // computeTokenProvider creates a [cloud.google.com/go/auth.TokenProvider] that
 // uses the metadata service to retrieve tokens.
 func computeTokenProvider(earlyExpiry time.Duration, scope ...string) auth.TokenProvider {
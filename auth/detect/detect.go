@@ -15,7 +15,9 @@
 package detect
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -35,6 +37,10 @@ const (
 	googleAuthURL  = "https://accounts.google.com/o/oauth2/auth"
 	googleTokenURL = "https://oauth2.googleapis.com/token"
 
+	// stsTokenURL is the default Security Token Service endpoint used for
+	// workload identity federation.
+	stsTokenURL = "https://sts.googleapis.com/v1/token"
+
 	// Help on default credentials
 	adcSetupURL = "https://cloud.google.com/docs/authentication/external/set-up-adc"
 )
@@ -50,6 +56,8 @@ type Credentials struct {
 	json           []byte
 	projectID      string
 	quotaProjectID string
+	universeDomain string
+	metadataServer bool
 
 	auth.TokenProvider
 }
@@ -59,6 +67,7 @@ func newCredentials(tokenProvider auth.TokenProvider, json []byte, projectID str
 		json:           json,
 		projectID:      internal.GetProjectID(json, projectID),
 		quotaProjectID: internal.GetQuotaProject(json, quotaProjectID),
+		universeDomain: internal.GetUniverseDomain(json),
 		TokenProvider:  tokenProvider,
 	}
 }
@@ -69,6 +78,12 @@ func (c *Credentials) JSON() []byte {
 	return c.json
 }
 
+// FromMetadataServer reports whether the credentials are those of the default
+// service account of the metadata server.
+func (c *Credentials) FromMetadataServer() bool {
+	return c.metadataServer
+}
+
 // ProjectID returns the associated project ID from the underlying file or
 // environment.
 func (c *Credentials) ProjectID() string {
@@ -81,6 +96,12 @@ func (c *Credentials) QuotaProjectID() string {
 	return c.quotaProjectID
 }
 
+// UniverseDomain returns the universe domain the credentials are valid for,
+// from the underlying file if one was used. It defaults to "googleapis.com".
+func (c *Credentials) UniverseDomain() string {
+	return c.universeDomain
+}
+
 // OnGCE reports whether this process is running in Google Cloud.
 func OnGCE() bool {
 	// TODO(codyoss): once all libs use this auth lib move metadata check here
@@ -104,25 +125,62 @@ func OnGCE() bool {
 //   - On Google Compute Engine, Google App Engine standard second generation
 //     runtimes, and Google App Engine flexible environment, it fetches
 //     credentials from the metadata server.
+//
+// The order these places are searched in can be changed, or some of them
+// skipped, with [Options.DetectOrder].
+//
+// If [Options.ExternalAccount] is set, detection is skipped and workload
+// identity federation credentials are built from it instead.
 func DefaultCredentials(opts *Options) (*Credentials, error) {
 	// TODO(codyoss): add some validation logic here.
+	if opts.ExternalAccount != nil {
+		return externalAccountCredentials(opts)
+	}
 	if opts.CredentialsJSON != nil {
 		return readCredentialsFileJSON(opts.CredentialsJSON, opts)
 	}
-	if filename := internaldetect.GetFileNameFromEnv(opts.CredentialsFile); filename != "" {
-		if creds, err := readCredentialsFile(filename, opts); err == nil {
-			return creds, err
-		}
+	order, err := opts.detectOrder()
+	if err != nil {
+		return nil, err
 	}
-
-	fileName := internaldetect.GetWellKnownFileName()
-	if b, err := os.ReadFile(fileName); err == nil {
-		return readCredentialsFileJSON(b, opts)
+	if opts.MetadataServerTimeout < 0 {
+		return nil, errors.New("detect: MetadataServerTimeout must not be negative")
 	}
-
-	if OnGCE() {
-		id, _ := metadata.ProjectID()
-		return newCredentials(computeTokenProvider(opts.EarlyTokenRefresh, opts.Scopes...), nil, id, ""), nil
+	// cause is the first reason a source that was configured or available
+	// could not be used, and is reported in place of the generic error.
+	var cause error
+	for _, src := range order {
+		switch src {
+		case CredentialSourceEnvFile:
+			if filename := internaldetect.GetFileNameFromEnv(opts.CredentialsFile); filename != "" {
+				creds, err := readCredentialsFile(filename, opts)
+				if err == nil {
+					return creds, err
+				}
+				if cause == nil {
+					cause = fmt.Errorf("unable to use credentials file %q: %w", filename, err)
+				}
+			}
+		case CredentialSourceWellKnownFile:
+			fileName := internaldetect.GetWellKnownFileName()
+			if b, err := os.ReadFile(fileName); err == nil {
+				return readCredentialsFileJSON(b, opts)
+			}
+		case CredentialSourceMetadataServer:
+			onGCE, err := opts.onGCE()
+			if onGCE {
+				id, _ := metadata.ProjectID()
+				creds := newCredentials(computeTokenProvider(opts.EarlyTokenRefresh, opts.Scopes...), nil, id, "")
+				creds.metadataServer = true
+				return creds, nil
+			}
+			if err != nil && cause == nil {
+				cause = fmt.Errorf("could not detect a metadata server: %w", err)
+			}
+		}
+	}
+	if cause != nil {
+		return nil, fmt.Errorf("detect: could not find default credentials, %w. See %v for more information", cause, adcSetupURL)
 	}
 
 	return nil, fmt.Errorf("detect: could not find default credentials. See %v for more information", adcSetupURL)
@@ -159,6 +217,10 @@ type Options struct {
 	// CredentialsJSON overrides detection logic and uses the JSON bytes as the
 	// source for the credential. Optional.
 	CredentialsJSON []byte
+	// ExternalAccount overrides detection logic and configures workload
+	// identity federation credentials directly, without a credentials file.
+	// It is incompatible with CredentialsFile and CredentialsJSON. Optional.
+	ExternalAccount *ExternalAccountOptions
 	// UseSelfSignedJWT directs service account based credentials to create a
 	// self-signed JWT with the private key found in the file, skipping any
 	// network requests that would normally be made. Optional.
@@ -166,6 +228,121 @@ type Options struct {
 	// Client configures the underlying client used to make network requests
 	// when fetching tokens. Optional.
 	Client *http.Client
+	// DetectOrder overrides the order credentials are searched for in, the
+	// first source in which credentials are found is used. Sources that are
+	// not listed are not searched. Each source may only be listed once. If
+	// unset, the sources are searched in the order documented on
+	// [DefaultCredentials]. CredentialsFile is only read if
+	// CredentialSourceEnvFile is listed. It is ignored if ExternalAccount or
+	// CredentialsJSON is set. Optional.
+	DetectOrder []CredentialSource
+	// MetadataServerTimeout bounds the time spent checking whether the
+	// metadata server is available while searching for credentials, so that
+	// detection fails fast on hosts without one. The check is sent with
+	// Client if set. If unset, the checks of
+	// [cloud.google.com/go/compute/metadata] and their timeouts are used.
+	// Optional.
+	MetadataServerTimeout time.Duration
+}
+
+// onGCE reports whether the metadata server is available, probing it with
+// Client within MetadataServerTimeout if set.
+func (o *Options) onGCE() (bool, error) {
+	if !allowOnGCECheck {
+		return false, nil
+	}
+	if o.MetadataServerTimeout == 0 {
+		return metadata.OnGCE(), nil
+	}
+	return probeMetadataServer(o.Client, o.MetadataServerTimeout)
+}
+
+// CredentialSource is a place [DefaultCredentials] searches for credentials.
+type CredentialSource int
+
+const (
+	// CredentialSourceEnvFile is the JSON file named by CredentialsFile or,
+	// if unset, by the GOOGLE_APPLICATION_CREDENTIALS environment variable.
+	CredentialSourceEnvFile CredentialSource = iota + 1
+	// CredentialSourceWellKnownFile is the JSON file in the location known
+	// to the gcloud command-line tool.
+	CredentialSourceWellKnownFile
+	// CredentialSourceMetadataServer is the metadata server available when
+	// running on Google Cloud.
+	CredentialSourceMetadataServer
+)
+
+// defaultDetectOrder is the order credentials are searched for in if
+// DetectOrder is unset.
+var defaultDetectOrder = []CredentialSource{
+	CredentialSourceEnvFile,
+	CredentialSourceWellKnownFile,
+	CredentialSourceMetadataServer,
+}
+
+// String returns the name of the source.
+func (s CredentialSource) String() string {
+	switch s {
+	case CredentialSourceEnvFile:
+		return "env-file"
+	case CredentialSourceWellKnownFile:
+		return "well-known-file"
+	case CredentialSourceMetadataServer:
+		return "metadata-server"
+	default:
+		return fmt.Sprintf("CredentialSource(%d)", int(s))
+	}
+}
+
+// detectOrder returns the order credentials should be searched for in, or an
+// error if DetectOrder contains unknown or duplicate sources.
+func (o *Options) detectOrder() ([]CredentialSource, error) {
+	if len(o.DetectOrder) == 0 {
+		return defaultDetectOrder, nil
+	}
+	seen := make(map[CredentialSource]bool, len(o.DetectOrder))
+	for _, src := range o.DetectOrder {
+		if src < CredentialSourceEnvFile || src > CredentialSourceMetadataServer {
+			return nil, fmt.Errorf("detect: unknown credential source %v in DetectOrder", src)
+		}
+		if seen[src] {
+			return nil, fmt.Errorf("detect: credential source %v is listed more than once in DetectOrder", src)
+		}
+		seen[src] = true
+	}
+	return o.DetectOrder, nil
+}
+
+// ExternalAccountOptions configures credentials that exchange a subject token,
+// issued by an external identity provider, for a Google access token with the
+// Security Token Service (STS).
+type ExternalAccountOptions struct {
+	// Audience is the STS audience, the full resource name of the workload
+	// identity pool or workforce pool provider. Required.
+	Audience string
+	// SubjectTokenType is the type of the subject token, for example
+	// "urn:ietf:params:oauth:token-type:jwt". Required.
+	SubjectTokenType string
+	// TokenURL is the STS token exchange endpoint. If unset the default value
+	// is: https://sts.googleapis.com/v1/token. Optional.
+	TokenURL string
+	// SubjectTokenSupplier returns a subject token from the external identity
+	// provider. It is called every time a new access token is needed.
+	// Required.
+	SubjectTokenSupplier func(ctx context.Context) (string, error)
+	// ServiceAccountImpersonationURL is the URL used to exchange the STS
+	// token for an access token of a service account. Optional.
+	ServiceAccountImpersonationURL string
+	// WorkforcePoolUserProject is the project used for quota and billing of
+	// workforce pool credentials. Optional.
+	WorkforcePoolUserProject string
+}
+
+func (o *ExternalAccountOptions) tokenURL() string {
+	if o.TokenURL != "" {
+		return o.TokenURL
+	}
+	return stsTokenURL
 }
 
 func (o *Options) tokenURL() string {
@@ -15,13 +15,16 @@
 package detect
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -31,6 +34,7 @@ import (
 	"cloud.google.com/go/auth/internal"
 	"cloud.google.com/go/auth/internal/internaldetect"
 	"cloud.google.com/go/auth/internal/jwt"
+	"cloud.google.com/go/auth/internal/testutil"
 )
 
 type tokResp struct {
@@ -301,6 +305,45 @@ func TestDefaultCredentials_ServiceAccountKeySelfSigned(t *testing.T) {
 	}
 }
 
+func TestDefaultCredentials_UniverseDomain(t *testing.T) {
+	b, err := os.ReadFile("../internal/testdata/sa.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	m["universe_domain"] = "example.com"
+	ub, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		b    []byte
+		want string
+	}{
+		{name: "default", b: b, want: "googleapis.com"},
+		{name: "from file", b: ub, want: "example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			creds, err := DefaultCredentials(&Options{
+				CredentialsJSON:  tt.b,
+				Audience:         "aud",
+				UseSelfSignedJWT: true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := creds.UniverseDomain(); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestDefaultCredentials_ClientCredentials(t *testing.T) {
 	b, err := os.ReadFile("../internal/testdata/clientcreds_installed.json")
 	if err != nil {
@@ -443,6 +486,107 @@ func TestDefaultCredentials_ExternalAccountKey(t *testing.T) {
 	}
 }
 
+func TestDefaultCredentials_ExternalAccountOptions(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if got, want := r.Form.Get("subject_token"), "a_fake_token_base"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		if got, want := r.Form.Get("audience"), "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/provider"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		if got, want := r.Form.Get("subject_token_type"), "urn:ietf:params:oauth:token-type:jwt"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		resp := &struct {
+			AccessToken string `json:"access_token"`
+			TokenType   string `json:"token_type"`
+			ExpiresIn   int    `json:"expires_in"`
+		}{
+			AccessToken: "a_fake_token_sts",
+			TokenType:   internal.TokenTypeBearer,
+			ExpiresIn:   60,
+		}
+		if err := json.NewEncoder(w).Encode(&resp); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer ts.Close()
+
+	creds, err := DefaultCredentials(&Options{
+		Scopes: []string{"https://www.googleapis.com/auth/cloud-platform"},
+		ExternalAccount: &ExternalAccountOptions{
+			Audience:         "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/provider",
+			SubjectTokenType: "urn:ietf:params:oauth:token-type:jwt",
+			TokenURL:         ts.URL,
+			SubjectTokenSupplier: func(context.Context) (string, error) {
+				return "a_fake_token_base", nil
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := creds.Token(context.Background())
+	if err != nil {
+		t.Fatalf("creds.Token() = %v", err)
+	}
+	if want := "a_fake_token_sts"; tok.Value != want {
+		t.Fatalf("got %q, want %q", tok.Value, want)
+	}
+	if creds.FromMetadataServer() {
+		t.Error("creds.FromMetadataServer() = true, want false")
+	}
+}
+
+func TestDefaultCredentials_ExternalAccountOptionsInvalid(t *testing.T) {
+	supplier := func(context.Context) (string, error) { return "", nil }
+	tests := []struct {
+		name string
+		opts *Options
+	}{
+		{
+			name: "missing audience",
+			opts: &Options{ExternalAccount: &ExternalAccountOptions{
+				SubjectTokenType:     "urn:ietf:params:oauth:token-type:jwt",
+				SubjectTokenSupplier: supplier,
+			}},
+		},
+		{
+			name: "missing subject token type",
+			opts: &Options{ExternalAccount: &ExternalAccountOptions{
+				Audience:             "aud",
+				SubjectTokenSupplier: supplier,
+			}},
+		},
+		{
+			name: "missing supplier",
+			opts: &Options{ExternalAccount: &ExternalAccountOptions{
+				Audience:         "aud",
+				SubjectTokenType: "urn:ietf:params:oauth:token-type:jwt",
+			}},
+		},
+		{
+			name: "with credentials file",
+			opts: &Options{
+				CredentialsFile: "../internal/testdata/sa.json",
+				ExternalAccount: &ExternalAccountOptions{
+					Audience:             "aud",
+					SubjectTokenType:     "urn:ietf:params:oauth:token-type:jwt",
+					SubjectTokenSupplier: supplier,
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DefaultCredentials(tt.opts); err == nil {
+				t.Fatal("DefaultCredentials() = _, nil, want error")
+			}
+		})
+	}
+}
+
 func TestDefaultCredentials_Fails(t *testing.T) {
 	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "nothingToSeeHere")
 	t.Setenv("HOME", "nothingToSeeHere")
@@ -456,6 +600,176 @@ func TestDefaultCredentials_Fails(t *testing.T) {
 	}
 }
 
+func TestDefaultCredentials_DetectOrder(t *testing.T) {
+	home := t.TempDir()
+	wellKnown := filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")
+	if err := os.MkdirAll(filepath.Dir(wellKnown), 0755); err != nil {
+		t.Fatal(err)
+	}
+	userJSON, err := os.ReadFile("../internal/testdata/user.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(wellKnown, userJSON, 0600); err != nil {
+		t.Fatal(err)
+	}
+	saJSON, err := os.ReadFile("../internal/testdata/sa.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "../internal/testdata/sa.json")
+	t.Setenv("HOME", home)
+	t.Setenv("APPDATA", filepath.Join(home, ".config"))
+	allowOnGCECheck = false
+	defer func() { allowOnGCECheck = true }()
+
+	tests := []struct {
+		name     string
+		order    []CredentialSource
+		wantJSON []byte
+		wantErr  string
+	}{
+		{
+			name:     "default",
+			wantJSON: saJSON,
+		},
+		{
+			name:     "well-known file first",
+			order:    []CredentialSource{CredentialSourceWellKnownFile, CredentialSourceEnvFile},
+			wantJSON: userJSON,
+		},
+		{
+			name:    "only metadata server",
+			order:   []CredentialSource{CredentialSourceMetadataServer},
+			wantErr: adcSetupURL,
+		},
+		{
+			name:    "duplicate",
+			order:   []CredentialSource{CredentialSourceEnvFile, CredentialSourceEnvFile},
+			wantErr: "env-file is listed more than once",
+		},
+		{
+			name:    "unknown",
+			order:   []CredentialSource{42},
+			wantErr: "unknown credential source CredentialSource(42)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			creds, err := DefaultCredentials(&Options{
+				Scopes:      []string{"https://www.googleapis.com/auth/cloud-platform"},
+				DetectOrder: tt.order,
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(creds.JSON(), tt.wantJSON) {
+				t.Errorf("got JSON %s, want %s", creds.JSON(), tt.wantJSON)
+			}
+		})
+	}
+}
+
+func TestDefaultCredentials_MetadataServerTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		delay   time.Duration
+		wantErr bool
+	}{
+		{
+			name: "responds",
+		},
+		{
+			name:    "times out",
+			delay:   time.Second,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			done := make(chan struct{})
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-time.After(tt.delay):
+				case <-done:
+				}
+				w.Header().Set("Metadata-Flavor", "Google")
+				if r.URL.Path == "/computeMetadata/v1/project/project-id" {
+					w.Write([]byte("fake-project"))
+				}
+			}))
+			defer ts.Close()
+			defer close(done)
+			t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(ts.URL, "http://"))
+			t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+			t.Setenv("HOME", "nothingToSeeHere")
+			t.Setenv("APPDATA", "nothingToSeeHere")
+
+			creds, err := DefaultCredentials(&Options{
+				Scopes:                []string{"https://www.googleapis.com/auth/cloud-platform"},
+				MetadataServerTimeout: 100 * time.Millisecond,
+			})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("DefaultCredentials() = nil, want error")
+				}
+				if !strings.Contains(err.Error(), "could not detect a metadata server") || !strings.Contains(err.Error(), "within 100ms") {
+					t.Errorf("got %v, want an error about detecting the metadata server", err)
+				}
+				var authErr *auth.Error
+				if errors.As(err, &authErr) {
+					t.Errorf("got auth error %v, want a detection error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DefaultCredentials() = %v", err)
+			}
+			if got, want := creds.ProjectID(), "fake-project"; got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+			if !creds.FromMetadataServer() {
+				t.Error("creds.FromMetadataServer() = false, want true")
+			}
+		})
+	}
+}
+
+func TestDefaultCredentials_MetadataServerTimeoutClient(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Metadata-Flavor", "Google")
+	}))
+	defer ts.Close()
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(ts.URL, "http://"))
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+	t.Setenv("HOME", "nothingToSeeHere")
+	t.Setenv("APPDATA", "nothingToSeeHere")
+
+	var probes int
+	client := &http.Client{
+		Transport: testutil.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			probes++
+			return http.DefaultTransport.RoundTrip(req)
+		}),
+	}
+	if _, err := DefaultCredentials(&Options{
+		DetectOrder:           []CredentialSource{CredentialSourceMetadataServer},
+		MetadataServerTimeout: time.Second,
+		Client:                client,
+	}); err != nil {
+		t.Fatalf("DefaultCredentials() = %v", err)
+	}
+	if probes != 1 {
+		t.Errorf("got %d probes sent with the client, want 1", probes)
+	}
+}
+
 func TestDefaultCredentials_BadFiletype(t *testing.T) {
 	if _, err := DefaultCredentials(&Options{
 		CredentialsJSON: []byte(`{"type":"42"}`),
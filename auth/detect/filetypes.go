@@ -21,7 +21,7 @@ import (
 	"cloud.google.com/go/auth"
 	"cloud.google.com/go/auth/detect/internal/externalaccount"
 	"cloud.google.com/go/auth/detect/internal/gdch"
-	"cloud.google.com/go/auth/detect/internal/impersonate"
+	"cloud.google.com/go/auth/internal/impersonate"
 	"cloud.google.com/go/auth/internal/internaldetect"
 )
 
@@ -141,6 +141,36 @@ func handleExternalAccount(f *internaldetect.ExternalAccountFile, opts *Options)
 	return externalaccount.NewTokenProvider(externalOpts)
 }
 
+func externalAccountCredentials(opts *Options) (*Credentials, error) {
+	ea := opts.ExternalAccount
+	switch {
+	case opts.CredentialsFile != "" || len(opts.CredentialsJSON) > 0:
+		return nil, errors.New("detect: ExternalAccount is incompatible with CredentialsFile and CredentialsJSON")
+	case ea.Audience == "":
+		return nil, errors.New("detect: ExternalAccount requires an Audience")
+	case ea.SubjectTokenType == "":
+		return nil, errors.New("detect: ExternalAccount requires a SubjectTokenType")
+	case ea.SubjectTokenSupplier == nil:
+		return nil, errors.New("detect: ExternalAccount requires a SubjectTokenSupplier")
+	}
+	tp, err := externalaccount.NewTokenProvider(&externalaccount.Options{
+		Audience:                       ea.Audience,
+		SubjectTokenType:               ea.SubjectTokenType,
+		TokenURL:                       ea.tokenURL(),
+		ServiceAccountImpersonationURL: ea.ServiceAccountImpersonationURL,
+		SubjectTokenSupplier:           ea.SubjectTokenSupplier,
+		Scopes:                         opts.scopes(),
+		WorkforcePoolUserProject:       ea.WorkforcePoolUserProject,
+		Client:                         opts.client(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newCredentials(auth.NewCachedTokenProvider(tp, &auth.CachedTokenProviderOptions{
+		ExpireEarly: opts.EarlyTokenRefresh,
+	}), nil, "", ""), nil
+}
+
 func handleImpersonatedServiceAccount(f *internaldetect.ImpersonatedServiceAccountFile, opts *Options) (auth.TokenProvider, error) {
 	if f.ServiceAccountImpersonationURL == "" || f.CredSource == nil {
 		return nil, errors.New("missing 'source_credentials' field or 'service_account_impersonation_url' in credentials")
@@ -24,7 +24,7 @@ import (
 	"time"
 
 	"cloud.google.com/go/auth"
-	"cloud.google.com/go/auth/detect/internal/impersonate"
+	"cloud.google.com/go/auth/internal/impersonate"
 	"cloud.google.com/go/auth/internal/internaldetect"
 )
 
@@ -73,6 +73,9 @@ type Options struct {
 	// CredentialSource contains the necessary information to retrieve the token itself, as well
 	// as some environmental information.
 	CredentialSource internaldetect.CredentialSource
+	// SubjectTokenSupplier, if set, is used to source subject tokens instead
+	// of CredentialSource.
+	SubjectTokenSupplier func(context.Context) (string, error)
 	// QuotaProjectID is injected by gCloud. If the value is non-empty, the Auth libraries
 	// will set the x-goog-user-project which overrides the project associated with the credentials.
 	QuotaProjectID string
@@ -190,8 +193,11 @@ func (tp *tokenProvider) Token(ctx context.Context) (*auth.Token, error) {
 }
 
 // newSubjectTokenProvider determines the type of internaldetect.CredentialSource needed to create a
-// subjectTokenProvider
+// subjectTokenProvider, unless a SubjectTokenSupplier is provided
 func newSubjectTokenProvider(o *Options) (subjectTokenProvider, error) {
+	if o.SubjectTokenSupplier != nil {
+		return &supplierSubjectProvider{supplier: o.SubjectTokenSupplier}, nil
+	}
 	if len(o.CredentialSource.EnvironmentID) > 3 && o.CredentialSource.EnvironmentID[:3] == "aws" {
 		if awsVersion, err := strconv.Atoi(o.CredentialSource.EnvironmentID[3:]); err == nil {
 			if awsVersion != 1 {
@@ -0,0 +1,38 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package externalaccount
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// supplierSubjectProvider sources subject tokens from a user provided
+// function.
+type supplierSubjectProvider struct {
+	supplier func(context.Context) (string, error)
+}
+
+func (sp *supplierSubjectProvider) subjectToken(ctx context.Context) (string, error) {
+	token, err := sp.supplier(ctx)
+	if err != nil {
+		return "", fmt.Errorf("detect: failed to supply subject token: %w", err)
+	}
+	if token == "" {
+		return "", errors.New("detect: supplied subject token is empty")
+	}
+	return token, nil
+}
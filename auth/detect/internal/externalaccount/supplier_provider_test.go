@@ -0,0 +1,77 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package externalaccount
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRetrieveSupplierSubjectToken(t *testing.T) {
+	var tests = []struct {
+		name     string
+		supplier func(context.Context) (string, error)
+		want     string
+		wantErr  bool
+	}{
+		{
+			name: "token",
+			supplier: func(context.Context) (string, error) {
+				return "street123", nil
+			},
+			want: "street123",
+		},
+		{
+			name: "error",
+			supplier: func(context.Context) (string, error) {
+				return "", errors.New("no token")
+			},
+			wantErr: true,
+		},
+		{
+			name: "empty token",
+			supplier: func(context.Context) (string, error) {
+				return "", nil
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := cloneTestOpts()
+			opts.SubjectTokenSupplier = test.supplier
+			base, err := newSubjectTokenProvider(opts)
+			if err != nil {
+				t.Fatalf("parse() failed %v", err)
+			}
+
+			out, err := base.subjectToken(context.Background())
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("subjectToken() = nil, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("subjectToken() = %v", err)
+			}
+			if test.want != out {
+				t.Errorf("got %v, want %v", out, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httptransport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"cloud.google.com/go/auth"
+)
+
+// AuthErrorKind classifies why the credentials of a request could not be
+// obtained.
+type AuthErrorKind int
+
+const (
+	// AuthErrorUnknown is the kind of failures that could not be classified.
+	AuthErrorUnknown AuthErrorKind = iota
+	// AuthErrorCredentialsNotFound means no credentials could be found, for
+	// example because a credentials file does not exist.
+	AuthErrorCredentialsNotFound
+	// AuthErrorPermissionDenied means the credentials were rejected by the
+	// token endpoint, for example because they were revoked or may not be
+	// used for the requested scopes. Retrying does not help.
+	AuthErrorPermissionDenied
+	// AuthErrorTransient means the failure is likely temporary, for example
+	// a 5xx response from the token endpoint or a timeout, and the request
+	// may be retried.
+	AuthErrorTransient
+	// AuthErrorConfigInvalid means the request can not succeed with the
+	// options of the client, for example because per-request scopes are used
+	// with a TokenProvider.
+	AuthErrorConfigInvalid
+)
+
+// String returns the name of the kind.
+func (k AuthErrorKind) String() string {
+	switch k {
+	case AuthErrorCredentialsNotFound:
+		return "credentials-not-found"
+	case AuthErrorPermissionDenied:
+		return "permission-denied"
+	case AuthErrorTransient:
+		return "transient"
+	case AuthErrorConfigInvalid:
+		return "config-invalid"
+	default:
+		return "unknown"
+	}
+}
+
+// AuthError is returned by requests sent with a client created by [NewClient]
+// when the token or API key to authenticate them with could not be obtained.
+// Use [errors.As] to inspect its Kind, the error it wraps is available with
+// [errors.Unwrap].
+type AuthError struct {
+	// Kind classifies the failure.
+	Kind AuthErrorKind
+	// Err is the underlying error.
+	Err error
+	// RequestID is the X-Request-Id header of the request that failed, if it
+	// has one, for example because [Options.GenerateRequestID] is set.
+	RequestID string
+}
+
+func (e *AuthError) Error() string {
+	if e.RequestID != "" {
+		return fmt.Sprintf("%v (request ID %s)", e.Err, e.RequestID)
+	}
+	return e.Err.Error()
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// newAuthError returns err wrapped in an [AuthError] of the kind it is
+// classified as, or of kind fallback if it can not be classified. err is
+// returned unmodified if it already is an AuthError.
+func newAuthError(err error, fallback AuthErrorKind) error {
+	var aerr *AuthError
+	if errors.As(err, &aerr) {
+		return err
+	}
+	return &AuthError{Kind: classifyAuthError(err, fallback), Err: err}
+}
+
+// withRequestID returns a copy of err with the request ID of req set, if err
+// is an [AuthError] and req has an ID. err is returned unmodified otherwise.
+func withRequestID(err error, req *http.Request) error {
+	id := req.Header.Get(requestIDHeaderKey)
+	aerr, ok := err.(*AuthError)
+	if id == "" || !ok {
+		return err
+	}
+	e := *aerr
+	e.RequestID = id
+	return &e
+}
+
+// configError returns an [AuthError] of kind AuthErrorConfigInvalid.
+func configError(format string, args ...interface{}) error {
+	return &AuthError{Kind: AuthErrorConfigInvalid, Err: fmt.Errorf(format, args...)}
+}
+
+func classifyAuthError(err error, fallback AuthErrorKind) AuthErrorKind {
+	if errors.Is(err, context.DeadlineExceeded) || isTransientTokenError(err) {
+		return AuthErrorTransient
+	}
+	if errors.Is(err, context.Canceled) {
+		return AuthErrorUnknown
+	}
+	var aerr *auth.Error
+	if errors.As(err, &aerr) && aerr.Response != nil {
+		if aerr.Temporary() {
+			return AuthErrorTransient
+		}
+		switch aerr.Response.StatusCode {
+		case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden:
+			return AuthErrorPermissionDenied
+		}
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return AuthErrorCredentialsNotFound
+	}
+	return fallback
+}
@@ -0,0 +1,147 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httptransport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/auth"
+	"cloud.google.com/go/auth/internal/testutil"
+)
+
+func TestNewClient_AuthError(t *testing.T) {
+	tests := []struct {
+		name     string
+		tpErr    error
+		opts     *Options
+		ctx      context.Context
+		wantKind AuthErrorKind
+	}{
+		{
+			name:     "5xx from token endpoint",
+			tpErr:    &auth.Error{Response: &http.Response{StatusCode: http.StatusServiceUnavailable}},
+			wantKind: AuthErrorTransient,
+		},
+		{
+			name:     "429 from token endpoint",
+			tpErr:    &auth.Error{Response: &http.Response{StatusCode: http.StatusTooManyRequests}},
+			wantKind: AuthErrorTransient,
+		},
+		{
+			name:     "rejected by token endpoint",
+			tpErr:    &auth.Error{Response: &http.Response{StatusCode: http.StatusUnauthorized}},
+			wantKind: AuthErrorPermissionDenied,
+		},
+		{
+			name:     "deadline exceeded",
+			tpErr:    fmt.Errorf("fetch: %w", context.DeadlineExceeded),
+			wantKind: AuthErrorTransient,
+		},
+		{
+			name:     "missing file",
+			tpErr:    fmt.Errorf("read: %w", os.ErrNotExist),
+			wantKind: AuthErrorCredentialsNotFound,
+		},
+		{
+			name:     "unclassified",
+			tpErr:    errors.New("no token"),
+			wantKind: AuthErrorUnknown,
+		},
+		{
+			name: "per-request scopes with token provider",
+			opts: &Options{
+				TokenProvider: testutil.StaticTokenProvider("fakeToken"),
+			},
+			ctx:      NewContextWithScopes(context.Background(), "a"),
+			wantKind: AuthErrorConfigInvalid,
+		},
+		{
+			name: "min token lifetime not satisfied",
+			opts: &Options{
+				TokenProvider:    &countingTP{expiresIn: time.Minute},
+				MinTokenLifetime: time.Hour,
+			},
+			wantKind: AuthErrorConfigInvalid,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			if opts == nil {
+				opts = &Options{
+					TokenProvider: &fixedTP{err: tt.tpErr},
+				}
+			}
+			opts.BaseRoundTripper = &recordingRT{}
+			client, err := NewClient(opts)
+			if err != nil {
+				t.Fatalf("NewClient() = %v", err)
+			}
+			ctx := tt.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://foo.googleapis.com", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = client.Do(req)
+			var aerr *AuthError
+			if !errors.As(err, &aerr) {
+				t.Fatalf("client.Do() = %v, want an AuthError", err)
+			}
+			if aerr.Kind != tt.wantKind {
+				t.Errorf("got kind %v, want %v", aerr.Kind, tt.wantKind)
+			}
+			if tt.tpErr != nil && !errors.Is(err, tt.tpErr) {
+				t.Errorf("got %v, want it to wrap %v", err, tt.tpErr)
+			}
+		})
+	}
+}
+
+func TestNewClient_AuthErrorRequestID(t *testing.T) {
+	client, err := NewClient(&Options{
+		TokenProvider:     &fixedTP{err: errors.New("no token")},
+		GenerateRequestID: true,
+		BaseRoundTripper:  &recordingRT{},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	req, err := http.NewRequest(http.MethodGet, "https://foo.googleapis.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Request-Id", "caller-id")
+	_, err = client.Do(req)
+	var aerr *AuthError
+	if !errors.As(err, &aerr) {
+		t.Fatalf("client.Do() = %v, want an AuthError", err)
+	}
+	if aerr.RequestID != "caller-id" {
+		t.Errorf("got request ID %q, want %q", aerr.RequestID, "caller-id")
+	}
+	if !strings.Contains(err.Error(), "caller-id") {
+		t.Errorf("got %v, want it to contain the request ID", err)
+	}
+}
@@ -15,15 +15,27 @@
 package httptransport
 
 import (
+	"context"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
 
 	"cloud.google.com/go/auth"
 	"cloud.google.com/go/auth/detect"
 	"cloud.google.com/go/auth/internal"
+	"cloud.google.com/go/auth/internal/impersonate"
+	"cloud.google.com/go/auth/internal/internaldetect"
 	"cloud.google.com/go/auth/internal/transport"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/oauth2"
 )
 
 // ClientCertProvider is a function that returns a TLS client certificate to be
@@ -31,12 +43,63 @@ import (
 // [crypto/tls.Config.GetClientCertificate].
 type ClientCertProvider = func(*tls.CertificateRequestInfo) (*tls.Certificate, error)
 
+const (
+	cloudPlatformScope           = "https://www.googleapis.com/auth/cloud-platform"
+	serviceAccountResourcePrefix = "projects/-/serviceAccounts/"
+)
+
+var (
+	// for testing
+	iamCredentialsEndpoint = func(universeDomain string) string {
+		return "https://iamcredentials." + universeDomain
+	}
+)
+
+// APIKeyPlacement specifies where on a request an API key is sent.
+type APIKeyPlacement int
+
+const (
+	// APIKeyPlacementQueryParam sends the API key in the "key" query parameter.
+	// This is the default.
+	APIKeyPlacementQueryParam APIKeyPlacement = iota
+	// APIKeyPlacementHeader sends the API key in the X-Goog-Api-Key header.
+	APIKeyPlacementHeader
+)
+
+// TokenEvent describes an attempt to acquire a token for a request, as
+// reported to [Options.TokenObserver].
+type TokenEvent struct {
+	// Cached reports whether the token was served from a cache rather than
+	// fetched from the underlying provider, either the cache of the client or
+	// the cache of detected credentials.
+	Cached bool
+	// Duration is the time it took to acquire the token.
+	Duration time.Duration
+	// Err is the error that occurred while acquiring the token, if any.
+	Err error
+}
+
 // Options used to configure a [net/http.Client] from [NewClient].
 type Options struct {
 	// DisableTelemetry disables default telemetry (OpenCensus). An example
 	// reason to do so would be to bind custom telemetry that overrides the
-	// defaults.
+	// defaults. It also disables the spans of TracerProvider.
 	DisableTelemetry bool
+	// TracerProvider, if set, is used to create OpenTelemetry spans in place
+	// of the default OpenCensus telemetry: a client span for every request,
+	// with the HTTP method, URL, and status code, that ends once the response
+	// body is closed, and a child span around every token acquisition. The
+	// trace context is propagated with the global OpenTelemetry propagator.
+	// Optional.
+	TracerProvider trace.TracerProvider
+	// RequireTelemetry makes [NewClient] return an error, rather than a
+	// client that emits no spans, if telemetry can not be set up: it requires
+	// TracerProvider to be set, as the default OpenCensus telemetry can not
+	// be checked, and to create spans, which a no-op provider does not. The
+	// check starts and ends a span with an unsampled parent, which is only
+	// exported by samplers that ignore the parent. It is incompatible with
+	// DisableTelemetry. Optional.
+	RequireTelemetry bool
 	// DisableAuthentication specifies that no authentication should be used. It
 	// is suitable only for testing and for accessing public resources, like
 	// public Google Cloud Storage buckets.
@@ -44,41 +107,792 @@ type Options struct {
 	// Headers are extra HTTP headers that will be appended to every outgoing
 	// request.
 	Headers http.Header
+	// HeaderFunc, if set, is called every time a request is sent, including
+	// retries, to compute headers such as trace IDs or signed timestamps. It
+	// is given the request with all other headers, including Headers and the
+	// Authorization header, already set, and must not modify it. Values it
+	// returns replace those of Headers and of the request for the same keys.
+	// If it returns an error, the request is not sent and fails with that
+	// error. Optional.
+	HeaderFunc func(req *http.Request) (http.Header, error)
+	// ProofHeaderFunc, if set, is called every time a token is attached to a
+	// request, including when a request is retried with a fresh token, to
+	// compute a proof-of-possession header, such as a DPoP proof, that binds
+	// the token to the request. It is given the request with the
+	// Authorization header already set, which it must not modify, and the
+	// token attached to it. The returned header is set on the request unless
+	// name is empty; it may not replace the header the token is sent in. If
+	// it returns an error, the request is not sent and fails with that
+	// error. Optional.
+	ProofHeaderFunc func(req *http.Request, token *auth.Token) (name, value string, err error)
+	// MaxHeaderBytes limits the total size of the headers of outgoing
+	// requests, counted as the sum of the lengths of the "Name: value\r\n"
+	// lines once all headers, including those of Headers, HeaderFunc, and the
+	// Authorization header, are set. Requests exceeding it fail without being
+	// sent with an error naming the largest header, rather than being rejected
+	// by the server. Zero means no limit. Optional.
+	MaxHeaderBytes int
+	// SendProjectIDHeader names a header that is set on every request to the
+	// project ID of the credentials, either the detected credentials or a
+	// TokenProvider with a ProjectID method. If the project ID is unknown,
+	// [NewClient] returns an error. It is incompatible with APIKey and
+	// DisableAuthentication. Optional.
+	SendProjectIDHeader string
+	// QuotaProjectID is the project to be billed for requests, sent in the
+	// X-Goog-User-Project header. If unset, the GOOGLE_CLOUD_QUOTA_PROJECT
+	// environment variable and then the quota project of the detected
+	// credentials are used. It is ignored if DisableAuthentication is set.
+	// Optional.
+	QuotaProjectID string
 	// Endpoint overrides the default endpoint to be used for a service.
+	// Requests sent to the host of [InternalOptions.DefaultEndpoint] are
+	// routed to this endpoint instead. An endpoint without a scheme is assumed
+	// to use https. Endpoints using http are rejected unless
+	// AllowInsecureEndpoint or DisableAuthentication is set, so that
+	// credentials are not sent in cleartext.
 	Endpoint string
+	// EndpointOverrides routes requests sent to a host, the key, to a
+	// different endpoint, the value, preserving the path and query of the
+	// request. Hosts are matched case-insensitively against the host, and
+	// port if any, of the request URL. Requests to other hosts are untouched.
+	// An override for the host of [InternalOptions.DefaultEndpoint] takes
+	// precedence over Endpoint. Endpoints follow the same rules as Endpoint.
+	// Optional.
+	EndpointOverrides map[string]string
+	// AudienceForHost selects the audience of the self-signed JWTs attached
+	// to requests sent to a host, the key, matched case-insensitively against
+	// the host, and port if any, of the request URL. Requests to other hosts
+	// use the audience of DetectOpts or [InternalOptions.DefaultAudience], as
+	// without it, and so do requests that set scopes with
+	// [NewContextWithScopes]. Tokens are cached per audience. It requires
+	// self-signed JWTs, enabled by DetectOpts.UseSelfSignedJWT,
+	// DetectOpts.Audience, or [InternalOptions.EnableJWTWithScope], and is
+	// incompatible with TokenProvider, APIKey, DisableAuthentication, and
+	// ImpersonateServiceAccount. Optional.
+	AudienceForHost map[string]string
+	// UseIDToken attaches Google-signed ID tokens for the audience
+	// DetectOpts.Audience to requests instead of access tokens, as is needed
+	// to call Cloud Run services or services behind Identity-Aware Proxy.
+	// Unlike self-signed JWTs, the tokens are minted by Google: from a
+	// service account key, the metadata server, or the IAM Credentials API
+	// for credentials that impersonate a service account, including those of
+	// DetectOpts.ExternalAccount, and with ImpersonateServiceAccount. Other
+	// credentials types are not supported. Tokens are cached and refreshed as access
+	// tokens are. It requires DetectOpts.Audience to be set and is
+	// incompatible with TokenProvider, APIKey, DisableAuthentication, and
+	// AudienceForHost. Optional.
+	UseIDToken bool
+	// AllowInsecureEndpoint allows Endpoint to use http even though
+	// credentials are attached to requests, for example to reach a local
+	// emulator. Optional.
+	AllowInsecureEndpoint bool
+	// UniverseDomain is the universe domain of the service, used in place of
+	// the googleapis.com domain of the default endpoints. Detected credentials
+	// must be valid for the same universe domain. If unset,
+	// [InternalOptions.DefaultUniverseDomain] is used, or "googleapis.com" if
+	// that is also unset. Optional.
+	UniverseDomain string
 	// APIKey specifies an API key to be used as the basis for authentication.
 	// If set DetectOpts are ignored.
 	APIKey string
+	// APIKeyProvider, if set, is called to obtain the API key sent on
+	// requests, which allows keys to be rotated without creating a new
+	// client. The key it returns is cached for five minutes, concurrent
+	// requests share a single call. If it returns an error, requests fail
+	// with an error wrapping it. It takes precedence over APIKey, and
+	// everything said about APIKey in these options applies to it as well.
+	// Optional.
+	APIKeyProvider func(ctx context.Context) (string, error)
+	// APIKeyPlacement specifies where on requests the APIKey is sent. If
+	// unset, the key is sent as the "key" query parameter, replacing any value
+	// already present on the request. Optional.
+	APIKeyPlacement APIKeyPlacement
 	// TokenProvider specifies the provider used to add Authorization header to
 	// all requests. If set DetectOpts are ignored.
 	TokenProvider auth.TokenProvider
+	// AuthHeaderName is the name of the header tokens are sent in, for
+	// proxies that expect them under a different header such as
+	// Proxy-Authorization. If unset, the Authorization header is used.
+	// Optional.
+	AuthHeaderName string
+	// TokenTypeOverride is the authentication scheme tokens are sent with,
+	// for example "DPoP", in place of the type reported by the token. It must
+	// be a valid HTTP token, without spaces or control characters. If unset,
+	// the type of the token is used, or Bearer if it has none. Optional.
+	TokenTypeOverride string
+	// SkipAuthForHosts are hosts that requests are sent to without
+	// credentials, neither an Authorization header nor an API key, for
+	// example because they are authenticated at the network layer. An entry matches a host exactly, or, if it has the form
+	// "*.example.com", any subdomain of example.com. Hosts are compared
+	// case-insensitively against the URL of the request before it is routed to
+	// Endpoint. Requests to other hosts are authorized as usual. Optional.
+	SkipAuthForHosts []string
+	// SkipAuthForPaths are URL paths that requests are sent to without
+	// credentials, neither an Authorization header nor an API key, for
+	// example public discovery documents of an otherwise authenticated
+	// service. An entry matches a path exactly, or, if it ends with "*", any
+	// path that starts with the rest of the entry, so "/v1/public/*" matches
+	// "/v1/public/doc" but not "/v1/public". Paths are compared
+	// case-sensitively against the unescaped path of the request and must
+	// start with "/". Requests to other paths are authorized as usual.
+	// Optional.
+	SkipAuthForPaths []string
+	// FallbackTokenProvider is used to fetch tokens when the primary provider,
+	// either TokenProvider or the detected credentials, fails to provide one.
+	// It is also used on its own if no credentials can be detected. Tokens
+	// from either provider are cached. It is incompatible with APIKey and
+	// DisableAuthentication. Optional.
+	FallbackTokenProvider auth.TokenProvider
 	// ClientCertProvider is a function that returns a TLS client certificate to
 	// be used when opening TLS connections. It follows the same semantics as
-	// crypto/tls.Config.GetClientCertificate.
+	// crypto/tls.Config.GetClientCertificate: it is called on every TLS
+	// handshake and its result is not cached, so a provider that returns
+	// rotated certificates has them presented on new connections. Pooled
+	// connections keep the certificate they were opened with, see
+	// CertReloadInterval.
 	ClientCertProvider ClientCertProvider
+	// CertReloadInterval, if set, recycles the connections of the default
+	// base transport at this interval so that new TLS handshakes pick up
+	// rotated client certificates promptly. Once the interval has elapsed,
+	// the next request replaces the connection pool with a new one and
+	// closes the idle connections of the old pool; connections busy at that
+	// time are closed once idle, with the next recycling or after
+	// IdleConnTimeout. Recycling reopens connections even if the certificate
+	// did not change, so it should not be much shorter than the rotation
+	// period of the certificates. It is incompatible with BaseRoundTripper.
+	// Optional.
+	CertReloadInterval time.Duration
+	// TLSConfig configures the TLS connections of the default base transport,
+	// for example to require a minimum TLS version or restrict cipher suites.
+	// A copy of it is used, with GetClientCertificate set to the client
+	// certificate provider if one is in use, either ClientCertProvider or the
+	// default client certificate. It is incompatible with BaseRoundTripper.
+	// Optional.
+	TLSConfig *tls.Config
+	// MaxIdleConnsPerHost is the maximum number of idle connections the
+	// default base transport keeps open to each host. If unset, the default
+	// value is 100. It is incompatible with BaseRoundTripper and ForceHTTP2.
+	// Optional.
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost limits the number of connections the default base
+	// transport opens to each host, including connections in use. If unset,
+	// the number is not limited. It is incompatible with BaseRoundTripper and
+	// ForceHTTP2. Optional.
+	MaxConnsPerHost int
+	// IdleConnTimeout is how long the default base transport keeps an idle
+	// connection open before closing it. If unset, the default of
+	// [net/http.DefaultTransport] is used. It is incompatible with
+	// BaseRoundTripper and ForceHTTP2. Optional.
+	IdleConnTimeout time.Duration
+	// Proxy returns the proxy to send a request through, or nil if the
+	// request should be sent directly, and is set as the Proxy of the default
+	// base transport. Credentials in the user info of the returned URL are
+	// sent to the proxy in the Proxy-Authorization header, and a
+	// Proxy-Authorization header set on a request is sent unmodified. If
+	// unset, [net/http.ProxyFromEnvironment] is used. It is incompatible with
+	// BaseRoundTripper, and with an AuthHeaderName of Proxy-Authorization.
+	// Optional.
+	Proxy func(*http.Request) (*url.URL, error)
+	// ForceHTTP2 makes the default base transport send https requests over
+	// HTTP/2 only, rather than negotiating the protocol with the server, so
+	// requests to servers that do not support HTTP/2 fail. The HTTP/2
+	// transport has no connection pool limits of its own, so it is
+	// incompatible with MaxIdleConnsPerHost, MaxConnsPerHost, and
+	// IdleConnTimeout, as well as with BaseRoundTripper and Proxy. Optional.
+	ForceHTTP2 bool
+	// AllowH2C makes the default base transport send http requests over
+	// HTTP/2 cleartext (h2c), as is needed to reach some services that are
+	// not fronted by TLS. As credentials are sent in cleartext, it requires
+	// AllowInsecureEndpoint or DisableAuthentication to be set. It is
+	// incompatible with BaseRoundTripper and Proxy. Optional.
+	AllowH2C bool
+	// CredentialsEnvVar names an environment variable holding credentials to
+	// use instead of searching for Application Default Credentials. Its value
+	// is either inline credentials JSON or the path to a credentials file. It
+	// is ignored if DetectOpts.CredentialsJSON or DetectOpts.CredentialsFile
+	// is set. If the variable is empty or unset, [NewClient] returns an error.
+	// Optional.
+	CredentialsEnvVar string
 	// DetectOpts configures settings for detect Application Default
 	// Credentials.
 	DetectOpts *detect.Options
+	// BaseRoundTripper overrides the base transport that is wrapped with
+	// authentication, headers, and telemetry. A provided base takes
+	// responsibility for its own TLS configuration, so ClientCertProvider and
+	// any default client certificate are not applied to it. Requests are still
+	// routed to the resolved endpoint. Optional.
+	BaseRoundTripper http.RoundTripper
+	// ImpersonateServiceAccount is the email of a service account to
+	// impersonate. If set, the source credentials, either TokenProvider or the
+	// detected credentials, are used to generate access tokens for this
+	// service account with the IAM Credentials API. The source credentials
+	// must be granted roles/iam.serviceAccountTokenCreator on the service
+	// account, or on the first of the ImpersonateDelegates. Optional.
+	ImpersonateServiceAccount string
+	// ImpersonateDelegates are the service account emails in a delegation
+	// chain between the source credentials and ImpersonateServiceAccount. Each
+	// service account must be granted roles/iam.serviceAccountTokenCreator on
+	// the next service account in the chain. Optional.
+	ImpersonateDelegates []string
+	// EarlyTokenRefresh configures how early before a token expires that it
+	// should be refreshed. If unset, the default value is 10 seconds. Optional.
+	EarlyTokenRefresh time.Duration
+	// DisableTokenCache specifies that tokens should not be cached by the
+	// client, so a token is fetched from the TokenProvider for every request.
+	// This adds the latency of a token fetch to each request and is meant for
+	// short lived processes and tests. Detected credentials still cache the
+	// tokens they fetch. It can not be combined with EarlyTokenRefresh.
+	// Optional.
+	DisableTokenCache bool
+	// MinTokenLifetime is the time a token must remain valid for when it is
+	// attached to a request. Unlike EarlyTokenRefresh it is checked for every
+	// request as it is sent, and a new token is fetched if the cached one
+	// expires too soon. The request fails with an error, without being sent,
+	// if the new token does not remain valid for long enough either. Tokens
+	// without an expiry satisfy any minimum. Optional.
+	MinTokenLifetime time.Duration
+	// TokenFetchRetries is the number of times a failed token fetch is retried,
+	// pausing as decided by Backoff, before the request using the token
+	// fails. Only transient failures are retried: 5xx responses from the
+	// token endpoint, timeouts, and reset connections. If unset, fetches are
+	// not retried. Optional.
+	TokenFetchRetries int
+	// Backoff decides how long to pause before every retry: of a token fetch
+	// by TokenFetchRetries, of a request by RetryOnUnauthorized and
+	// RetryOnInvalidTokenChallenge, and of a request by HonorRetryAfter,
+	// which waits for the longer of the pause and the delay requested by the
+	// server, up to MaxRetryAfter. Pauses end early if the context of the request is done. If
+	// unset, an [ExponentialBackoff] with default values is used. Optional.
+	Backoff Backoff
+	// RequestTimeout is the time limit applied to requests whose context has
+	// no deadline. It covers the whole exchange, including reading the
+	// response body, and never replaces a deadline set by the caller, so
+	// requests such as long running streams can opt out by setting their own.
+	// If unset, no limit is applied. Optional.
+	RequestTimeout time.Duration
+	// RetryOnUnauthorized specifies that a request which receives a 401
+	// response should be sent once more with a freshly fetched token. Only
+	// requests that are safe to replay, because their method is idempotent or
+	// they carry an X-Idempotency-Key header, set by the caller or by
+	// AutoIdempotencyKey, and whose body can be re-read, because it is empty
+	// or [net/http.Request.GetBody] is set, are retried; see
+	// AllowUnsafeRetries. Optional.
+	RetryOnUnauthorized bool
+	// RetryOnInvalidTokenChallenge specifies that a request whose response,
+	// whatever its status code, carries a WWW-Authenticate challenge of
+	// Bearer error="invalid_token" should be sent once more with a freshly
+	// fetched token. Unlike RetryOnUnauthorized, other 401 responses are not
+	// retried. Requests are retried at most once, under the same conditions
+	// as RetryOnUnauthorized. Optional.
+	RetryOnInvalidTokenChallenge bool
+	// HonorRetryAfter specifies that a request which receives a 429 or 503
+	// response with a Retry-After header should be sent once more after the
+	// requested delay. Requests are retried under the same conditions as
+	// RetryOnUnauthorized. Optional.
+	HonorRetryAfter bool
+	// MaxRetryAfter is the longest delay requested by a Retry-After header
+	// that is waited for when HonorRetryAfter is set. Responses requesting a
+	// longer delay are returned as is. If unset, the default value is 30
+	// seconds. Optional.
+	MaxRetryAfter time.Duration
+	// CompressRequests specifies that request bodies of at least
+	// CompressMinBytes should be gzip compressed. Bodies are compressed as
+	// they are sent, without buffering them. Bodies of requests that already
+	// set a Content-Encoding header, and bodies of unknown length without a
+	// GetBody, are sent as is. Optional.
+	CompressRequests bool
+	// CompressMinBytes is the minimum size of a request body that is
+	// compressed when CompressRequests is set. If unset, the default value is
+	// 4 KiB. Optional.
+	CompressMinBytes int
+	// AutoIdempotencyKey specifies that a random X-Idempotency-Key header
+	// should be set on requests that do not already have one. The key is
+	// generated when a request is sent with the client and is the same for
+	// all attempts made by RetryOnUnauthorized and HonorRetryAfter, so the
+	// service can deduplicate them. Each call to send a request generates a
+	// new key, callers that retry requests themselves should set the header.
+	// Optional.
+	AutoIdempotencyKey bool
+	// AllowUnsafeRetries lets RetryOnUnauthorized,
+	// RetryOnInvalidTokenChallenge, and HonorRetryAfter retry requests that
+	// are not safe to replay, such as a POST without an X-Idempotency-Key
+	// header, which may then take effect twice. Only set it if the service
+	// tolerates duplicate requests. Optional.
+	AllowUnsafeRetries bool
+	// GenerateRequestID specifies that a random X-Request-Id header should
+	// be set on requests that do not already have one, so that client and
+	// server logs can be correlated. Like the key of AutoIdempotencyKey, the
+	// ID is the same for all attempts of a request. It is reported by
+	// [RequestID] for the responses of a client, and an [AuthError] for a
+	// request holds it. Response headers are left as the server sent them. The ID is also recorded by
+	// Logf, MetricsObserver, and the spans of TracerProvider. Optional.
+	GenerateRequestID bool
+	// TokenObserver, if set, is called synchronously after every attempt to
+	// acquire a token for a request, whether it is served from the cache or
+	// fetched. It is intended for collecting metrics. Optional.
+	TokenObserver func(TokenEvent)
+	// MetricsObserver, if set, is called with the number of body bytes sent
+	// and received for every request sent to the service, including each
+	// retry, once its response body is closed or, if no response was
+	// received, once the request fails. Bodies are counted as they are
+	// streamed and are not buffered. It is called synchronously from Close or
+	// from the request and is intended for collecting metrics. Optional.
+	MetricsObserver func(RequestMetrics)
+	// OnTokenRefresh, if set, is called in its own goroutine every time a new
+	// token is fetched for the client, but not when a cached token is used.
+	// It is called once per fetch, even if several concurrent requests were
+	// waiting for the token, and only if the token differs in value or
+	// expiry from the previous token, including when DisableTokenCache is
+	// set. tok is a copy of the token; its Value is a credential and should
+	// not be logged. Optional.
+	OnTokenRefresh func(tok *auth.Token)
+	// Logf, if set, is called once per request with the method, URL, status
+	// code, latency, and headers of the request as it was sent to the
+	// service. Retries made by the client are included in a single log line.
+	// The values of the Authorization header and API key query parameter are
+	// redacted. Optional.
+	Logf func(format string, args ...interface{})
 
 	// InternalOptions are NOT meant to be set directly by consumers of this
 	// package, they should only be set by generated client code.
 	InternalOptions *InternalOptions
+
+	// now is used in place of time.Now to decide whether cached tokens have
+	// expired, if set. For testing.
+	now func() time.Time
+}
+
+// Clone returns a deep copy of o, which is safe to modify without affecting
+// o. Headers, DetectOpts, InternalOptions, and slices are copied. Values that
+// are used as set, such as TokenProvider, BaseRoundTripper, and functions, are
+// shared with o.
+func (o *Options) Clone() *Options {
+	if o == nil {
+		return nil
+	}
+	o2 := *o
+	o2.Headers = o.Headers.Clone()
+	if o.DetectOpts != nil {
+		o2.DetectOpts = transport.CloneDetectOptions(o.DetectOpts)
+	}
+	if o.InternalOptions != nil {
+		io := *o.InternalOptions
+		io.DefaultScopes = cloneStrings(o.InternalOptions.DefaultScopes)
+		o2.InternalOptions = &io
+	}
+	o2.ImpersonateDelegates = cloneStrings(o.ImpersonateDelegates)
+	o2.SkipAuthForHosts = cloneStrings(o.SkipAuthForHosts)
+	o2.SkipAuthForPaths = cloneStrings(o.SkipAuthForPaths)
+	if o.EndpointOverrides != nil {
+		o2.EndpointOverrides = make(map[string]string, len(o.EndpointOverrides))
+		for k, v := range o.EndpointOverrides {
+			o2.EndpointOverrides[k] = v
+		}
+	}
+	if o.AudienceForHost != nil {
+		o2.AudienceForHost = make(map[string]string, len(o.AudienceForHost))
+		for k, v := range o.AudienceForHost {
+			o2.AudienceForHost[k] = v
+		}
+	}
+	return &o2
+}
+
+func cloneStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	s2 := make([]string, len(s))
+	copy(s2, s)
+	return s2
+}
+
+// usesAPIKey reports whether requests are authenticated with an API key.
+func (o *Options) usesAPIKey() bool {
+	return o.APIKey != "" || o.APIKeyProvider != nil
 }
 
 func (o *Options) validate() error {
 	if o == nil {
 		return errors.New("httptransport: opts required to be non-nil")
 	}
-	hasCreds := o.APIKey != "" ||
+	hasCreds := o.usesAPIKey() ||
 		o.TokenProvider != nil ||
+		o.FallbackTokenProvider != nil ||
+		o.CredentialsEnvVar != "" ||
 		(o.DetectOpts != nil && len(o.DetectOpts.CredentialsJSON) > 0) ||
-		(o.DetectOpts != nil && o.DetectOpts.CredentialsFile != "")
+		(o.DetectOpts != nil && o.DetectOpts.CredentialsFile != "") ||
+		(o.DetectOpts != nil && o.DetectOpts.ExternalAccount != nil)
 	if o.DisableAuthentication && hasCreds {
 		return errors.New("httptransport: DisableAuthentication is incompatible with options that set or detect credentials")
 	}
+	if o.DetectOpts != nil && o.DetectOpts.ExternalAccount != nil && (o.usesAPIKey() || o.TokenProvider != nil) {
+		return errors.New("httptransport: DetectOpts.ExternalAccount is incompatible with APIKey and TokenProvider")
+	}
+	if o.TLSConfig != nil && o.BaseRoundTripper != nil {
+		return errors.New("httptransport: TLSConfig is incompatible with BaseRoundTripper")
+	}
+	if o.MaxIdleConnsPerHost < 0 || o.MaxConnsPerHost < 0 || o.IdleConnTimeout < 0 {
+		return errors.New("httptransport: MaxIdleConnsPerHost, MaxConnsPerHost, and IdleConnTimeout must not be negative")
+	}
+	if (o.MaxIdleConnsPerHost != 0 || o.MaxConnsPerHost != 0 || o.IdleConnTimeout != 0) && o.BaseRoundTripper != nil {
+		return errors.New("httptransport: MaxIdleConnsPerHost, MaxConnsPerHost, and IdleConnTimeout are incompatible with BaseRoundTripper")
+	}
+	if (o.MaxIdleConnsPerHost != 0 || o.MaxConnsPerHost != 0 || o.IdleConnTimeout != 0) && o.ForceHTTP2 {
+		return errors.New("httptransport: MaxIdleConnsPerHost, MaxConnsPerHost, and IdleConnTimeout are incompatible with ForceHTTP2")
+	}
+	if o.ImpersonateServiceAccount != "" && (o.usesAPIKey() || o.DisableAuthentication) {
+		return errors.New("httptransport: ImpersonateServiceAccount is incompatible with APIKey and DisableAuthentication")
+	}
+	if o.FallbackTokenProvider != nil && o.usesAPIKey() {
+		return errors.New("httptransport: FallbackTokenProvider is incompatible with APIKey")
+	}
+	if o.SendProjectIDHeader != "" && (o.usesAPIKey() || o.DisableAuthentication) {
+		return errors.New("httptransport: SendProjectIDHeader is incompatible with APIKey and DisableAuthentication")
+	}
+	if o.ImpersonateServiceAccount == "" && len(o.ImpersonateDelegates) > 0 {
+		return errors.New("httptransport: ImpersonateDelegates requires ImpersonateServiceAccount to be set")
+	}
+	if o.EarlyTokenRefresh < 0 {
+		return errors.New("httptransport: EarlyTokenRefresh must not be negative")
+	}
+	if o.DisableTokenCache && o.EarlyTokenRefresh != 0 {
+		return errors.New("httptransport: EarlyTokenRefresh is incompatible with DisableTokenCache")
+	}
+	if len(o.AudienceForHost) > 0 {
+		if o.TokenProvider != nil || o.usesAPIKey() || o.DisableAuthentication || o.ImpersonateServiceAccount != "" {
+			return errors.New("httptransport: AudienceForHost is incompatible with TokenProvider, APIKey, DisableAuthentication, and ImpersonateServiceAccount")
+		}
+		selfSigned := (o.DetectOpts != nil && (o.DetectOpts.UseSelfSignedJWT || o.DetectOpts.Audience != "")) ||
+			(o.InternalOptions != nil && o.InternalOptions.EnableJWTWithScope)
+		if !selfSigned {
+			return errors.New("httptransport: AudienceForHost requires self-signed JWTs, set DetectOpts.UseSelfSignedJWT")
+		}
+		for host, aud := range o.AudienceForHost {
+			if host == "" || aud == "" {
+				return errors.New("httptransport: AudienceForHost must not contain an empty host or audience")
+			}
+		}
+	}
+	if o.UseIDToken {
+		if o.TokenProvider != nil || o.usesAPIKey() || o.DisableAuthentication || len(o.AudienceForHost) > 0 {
+			return errors.New("httptransport: UseIDToken is incompatible with TokenProvider, APIKey, DisableAuthentication, and AudienceForHost")
+		}
+		if o.DetectOpts == nil || o.DetectOpts.Audience == "" {
+			return errors.New("httptransport: UseIDToken requires DetectOpts.Audience to be set")
+		}
+	}
+	if o.MinTokenLifetime < 0 {
+		return errors.New("httptransport: MinTokenLifetime must not be negative")
+	}
+	if o.TokenFetchRetries < 0 {
+		return errors.New("httptransport: TokenFetchRetries must not be negative")
+	}
+	if o.RequestTimeout < 0 {
+		return errors.New("httptransport: RequestTimeout must not be negative")
+	}
+	if o.MaxRetryAfter < 0 {
+		return errors.New("httptransport: MaxRetryAfter must not be negative")
+	}
+	if o.CertReloadInterval < 0 {
+		return errors.New("httptransport: CertReloadInterval must not be negative")
+	}
+	if o.CertReloadInterval != 0 && o.BaseRoundTripper != nil {
+		return errors.New("httptransport: CertReloadInterval is incompatible with BaseRoundTripper")
+	}
+	if o.RequireTelemetry && o.DisableTelemetry {
+		return errors.New("httptransport: RequireTelemetry is incompatible with DisableTelemetry")
+	}
+	if o.RequireTelemetry && o.TracerProvider == nil {
+		return errors.New("httptransport: RequireTelemetry requires TracerProvider to be set")
+	}
+	if o.MaxHeaderBytes < 0 {
+		return errors.New("httptransport: MaxHeaderBytes must not be negative")
+	}
+	if o.CompressMinBytes < 0 {
+		return errors.New("httptransport: CompressMinBytes must not be negative")
+	}
+	if o.AuthHeaderName != "" && !httpguts.ValidHeaderFieldName(o.AuthHeaderName) {
+		return fmt.Errorf("httptransport: invalid AuthHeaderName %q", o.AuthHeaderName)
+	}
+	if o.TokenTypeOverride != "" && !httpguts.ValidHeaderFieldName(o.TokenTypeOverride) {
+		return fmt.Errorf("httptransport: invalid TokenTypeOverride %q", o.TokenTypeOverride)
+	}
+	if o.Proxy != nil && o.BaseRoundTripper != nil {
+		return errors.New("httptransport: Proxy is incompatible with BaseRoundTripper")
+	}
+	if o.Proxy != nil && http.CanonicalHeaderKey(o.AuthHeaderName) == "Proxy-Authorization" {
+		// Tokens would replace the credentials of the proxy.
+		return errors.New("httptransport: Proxy is incompatible with an AuthHeaderName of Proxy-Authorization")
+	}
+	if (o.ForceHTTP2 || o.AllowH2C) && (o.BaseRoundTripper != nil || o.Proxy != nil) {
+		return errors.New("httptransport: ForceHTTP2 and AllowH2C are incompatible with BaseRoundTripper and Proxy")
+	}
+	if o.AllowH2C && !o.AllowInsecureEndpoint && !o.DisableAuthentication {
+		return errors.New("httptransport: AllowH2C would send credentials in cleartext, set AllowInsecureEndpoint")
+	}
+	for _, h := range o.SkipAuthForHosts {
+		if h == "" || strings.Contains(strings.TrimPrefix(h, "*."), "*") {
+			return fmt.Errorf("httptransport: invalid SkipAuthForHosts entry %q", h)
+		}
+	}
+	for _, p := range o.SkipAuthForPaths {
+		if !strings.HasPrefix(p, "/") || strings.Contains(strings.TrimSuffix(p, "*"), "*") {
+			return fmt.Errorf("httptransport: invalid SkipAuthForPaths entry %q", p)
+		}
+	}
+	return nil
+}
+
+// quotaProjectID returns the quota project the user explicitly configured,
+// either with QuotaProjectID or through Headers.
+func (o *Options) quotaProjectID() string {
+	if o.QuotaProjectID != "" {
+		return o.QuotaProjectID
+	}
+	return o.Headers.Get(quotaProjectHeaderKey)
+}
+
+// universeDomain returns the universe domain requests should be sent to.
+func (o *Options) universeDomain() string {
+	if o.UniverseDomain != "" {
+		return o.UniverseDomain
+	}
+	if o.InternalOptions != nil && o.InternalOptions.DefaultUniverseDomain != "" {
+		return o.InternalOptions.DefaultUniverseDomain
+	}
+	return internal.DefaultUniverseDomain
+}
+
+// resolveEndpoint normalizes an endpoint resolved from a user provided
+// Endpoint, defaulting its scheme to https and trimming trailing slashes. An
+// error is returned if the endpoint is malformed, or if it would send
+// credentials in cleartext without AllowInsecureEndpoint set. Endpoints that
+// are not derived from Endpoint are returned unmodified.
+func (o *Options) resolveEndpoint(endpoint string) (string, error) {
+	if o.Endpoint == "" || endpoint == "" {
+		return endpoint, nil
+	}
+	u, err := o.parseUserEndpoint(endpoint)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(u.String(), "/"), nil
+}
+
+// resolveEndpointOverrides parses EndpointOverrides, keying the endpoints by
+// lowercase host. The same rules as for Endpoint apply to the endpoints.
+func (o *Options) resolveEndpointOverrides() (map[string]*url.URL, error) {
+	if len(o.EndpointOverrides) == 0 {
+		return nil, nil
+	}
+	overrides := make(map[string]*url.URL, len(o.EndpointOverrides))
+	for host, endpoint := range o.EndpointOverrides {
+		if host == "" {
+			return nil, errors.New("httptransport: EndpointOverrides must not contain an empty host")
+		}
+		u, err := o.parseUserEndpoint(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		overrides[strings.ToLower(host)] = u
+	}
+	return overrides, nil
+}
+
+// parseUserEndpoint parses a user provided endpoint, defaulting its scheme to
+// https. An error is returned if the endpoint is malformed, or if it would
+// send credentials in cleartext without AllowInsecureEndpoint set.
+func (o *Options) parseUserEndpoint(endpoint string) (*url.URL, error) {
+	u, err := parseEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "https":
+	case "http":
+		if !o.DisableAuthentication && !o.AllowInsecureEndpoint {
+			return nil, fmt.Errorf("httptransport: endpoint %q would send credentials in cleartext, use https or set AllowInsecureEndpoint", endpoint)
+		}
+	default:
+		return nil, fmt.Errorf("httptransport: invalid endpoint %q: unsupported scheme %q", endpoint, u.Scheme)
+	}
+	return u, nil
+}
+
+// resolvedCredentials are the credentials used to authorize requests.
+type resolvedCredentials struct {
+	// tp is the provider used to authorize requests.
+	tp auth.TokenProvider
+	// quotaProjectID is the quota project that should be sent with requests.
+	quotaProjectID string
+	// projectID is the project of the credentials, if known.
+	projectID string
+}
+
+// resolveTokenProvider returns the credentials used to authorize requests,
+// either the explicitly configured provider or detected credentials.
+func (o *Options) resolveTokenProvider() (*resolvedCredentials, error) {
+	if o.TokenProvider != nil {
+		tp, err := o.impersonate(o.TokenProvider, o.resolveDetectOptions())
+		if err != nil {
+			return nil, err
+		}
+		rc := &resolvedCredentials{
+			tp:             o.withFallback(o.withFetchRetries(tp)),
+			quotaProjectID: internal.GetQuotaProject(nil, o.quotaProjectID()),
+		}
+		if p, ok := o.TokenProvider.(interface{ ProjectID() string }); ok {
+			rc.projectID = p.ProjectID()
+		}
+		return rc, nil
+	}
+	if o.UseIDToken {
+		return o.resolveIDTokenProvider()
+	}
+	creds, tp, err := o.detectTokenProvider(o.resolveDetectOptions())
+	if err != nil {
+		if o.FallbackTokenProvider == nil {
+			return nil, err
+		}
+		// Credentials could not be detected, for example because the metadata
+		// server is not available, so only the fallback can provide tokens.
+		return &resolvedCredentials{
+			tp:             o.FallbackTokenProvider,
+			quotaProjectID: internal.GetQuotaProject(nil, o.quotaProjectID()),
+		}, nil
+	}
+	qp := o.quotaProjectID()
+	if qp == "" {
+		qp = creds.QuotaProjectID()
+	}
+	return &resolvedCredentials{
+		tp:             o.withFallback(tp),
+		quotaProjectID: qp,
+		projectID:      creds.ProjectID(),
+	}, nil
+}
+
+// loadCredentialsEnvVar sets the credentials JSON of do from the environment
+// variable named by CredentialsEnvVar, unless do already sets credentials
+// explicitly. The value is used as inline JSON if it looks like a JSON
+// object, and as the path to a file otherwise.
+func (o *Options) loadCredentialsEnvVar(do *detect.Options) error {
+	if o.CredentialsEnvVar == "" || len(do.CredentialsJSON) > 0 || do.CredentialsFile != "" {
+		return nil
+	}
+	v := strings.TrimSpace(os.Getenv(o.CredentialsEnvVar))
+	if v == "" {
+		return fmt.Errorf("httptransport: the environment variable %s named by CredentialsEnvVar is empty or unset", o.CredentialsEnvVar)
+	}
+	if strings.HasPrefix(v, "{") {
+		do.CredentialsJSON = []byte(v)
+		return nil
+	}
+	b, err := os.ReadFile(v)
+	if err != nil {
+		return fmt.Errorf("httptransport: unable to read credentials file from %s: %w", o.CredentialsEnvVar, err)
+	}
+	do.CredentialsJSON = b
 	return nil
 }
 
+// withFallback wraps tp so that FallbackTokenProvider is used when tp fails to
+// provide a token. tp is returned unmodified if no fallback is configured.
+func (o *Options) withFallback(tp auth.TokenProvider) auth.TokenProvider {
+	if o.FallbackTokenProvider == nil {
+		return tp
+	}
+	return &fallbackProvider{primary: tp, fallback: o.FallbackTokenProvider}
+}
+
+// detectTokenProvider detects credentials with the provided options and
+// returns them along with the provider that should be used to fetch tokens,
+// which differs from the credentials when impersonating a service account.
+func (o *Options) detectTokenProvider(do *detect.Options) (*detect.Credentials, auth.TokenProvider, error) {
+	if err := o.loadCredentialsEnvVar(do); err != nil {
+		return nil, nil, err
+	}
+	sourceDo := do
+	if o.ImpersonateServiceAccount != "" {
+		// The source credentials only need to be able to call the IAM
+		// Credentials API, the requested scopes apply to the impersonated
+		// token.
+		sourceDo = transport.CloneDetectOptions(do)
+		sourceDo.Scopes = []string{cloudPlatformScope}
+		sourceDo.Audience = ""
+	}
+	creds, err := detect.DefaultCredentials(sourceDo)
+	if err != nil {
+		return nil, nil, err
+	}
+	if credsUD, ok := credentialsUniverseDomain(creds); ok && credsUD != o.universeDomain() {
+		return nil, nil, fmt.Errorf("httptransport: the configured universe domain (%q) does not match the universe domain found in the credentials (%q)", o.universeDomain(), credsUD)
+	}
+	tp, err := o.impersonate(creds, do)
+	if err != nil {
+		return nil, nil, err
+	}
+	return creds, o.withFetchRetries(tp), nil
+}
+
+// credentialsUniverseDomain returns the universe domain of creds, or false if
+// the credentials do not carry one and are valid in the universe they are
+// used in. Credentials of the metadata server and of DetectOpts.ExternalAccount
+// have no JSON, and external account files may omit the universe_domain field.
+func credentialsUniverseDomain(creds *detect.Credentials) (string, bool) {
+	b := creds.JSON()
+	if len(b) == 0 {
+		return "", false
+	}
+	if fileType, err := internaldetect.ParseFileType(b); err == nil && fileType == internaldetect.ExternalAccountKey {
+		var f struct {
+			UniverseDomain string `json:"universe_domain"`
+		}
+		if err := json.Unmarshal(b, &f); err != nil || f.UniverseDomain == "" {
+			return "", false
+		}
+	}
+	return creds.UniverseDomain(), true
+}
+
+// impersonate returns a provider for tokens of ImpersonateServiceAccount
+// generated with the source provider, or source if no service account is to be
+// impersonated.
+func (o *Options) impersonate(source auth.TokenProvider, do *detect.Options) (auth.TokenProvider, error) {
+	if o.ImpersonateServiceAccount == "" {
+		return source, nil
+	}
+	scopes := do.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{cloudPlatformScope}
+	}
+	delegates := make([]string, len(o.ImpersonateDelegates))
+	for i, v := range o.ImpersonateDelegates {
+		delegates[i] = serviceAccountResource(v)
+	}
+	client := do.Client
+	if client == nil {
+		client = internal.CloneDefaultClient()
+	}
+	return impersonate.NewTokenProvider(&impersonate.Options{
+		Tp:        auth.NewCachedTokenProvider(source, nil),
+		URL:       fmt.Sprintf("%s/v1/%s:generateAccessToken", iamCredentialsEndpoint(o.universeDomain()), serviceAccountResource(o.ImpersonateServiceAccount)),
+		Scopes:    scopes,
+		Delegates: delegates,
+		Client:    client,
+	})
+}
+
+// serviceAccountResource returns the resource name of the service account
+// with the provided email, as expected by the IAM Credentials API.
+func serviceAccountResource(email string) string {
+	if strings.HasPrefix(email, serviceAccountResourcePrefix) {
+		return email
+	}
+	return serviceAccountResourcePrefix + email
+}
+
 // client returns the client a user set for the detect options or nil if one was
 // not set.
 func (o *Options) client() *http.Client {
@@ -105,9 +919,79 @@ func (o *Options) resolveDetectOptions() *detect.Options {
 	if len(do.Scopes) == 0 && do.Audience == "" && io != nil {
 		do.Audience = o.InternalOptions.DefaultAudience
 	}
+	if do.EarlyTokenRefresh == 0 {
+		do.EarlyTokenRefresh = o.EarlyTokenRefresh
+	}
 	return do
 }
 
+// ResolvedScopes returns the OAuth2 scopes that tokens of a client created by
+// [NewClient] with o are requested with, once the scopes of DetectOpts are
+// defaulted to [InternalOptions.DefaultScopes] unless an audience is set, and
+// to the cloud-platform scope when impersonating a service account. It is
+// empty if no scopes are requested, because authentication is disabled, an
+// API key or ID tokens are used, a TokenProvider is set without
+// ImpersonateServiceAccount, or self-signed JWTs are used for an audience
+// instead. Scopes set per request with [NewContextWithScopes] are not
+// included. The returned slice is a copy and may be modified.
+func (o *Options) ResolvedScopes() []string {
+	if o == nil || o.DisableAuthentication || o.usesAPIKey() || o.UseIDToken {
+		return []string{}
+	}
+	if o.TokenProvider != nil && o.ImpersonateServiceAccount == "" {
+		return []string{}
+	}
+	scopes := o.resolveDetectOptions().Scopes
+	if len(scopes) == 0 && o.ImpersonateServiceAccount != "" {
+		return []string{cloudPlatformScope}
+	}
+	s := make([]string, len(scopes))
+	copy(s, scopes)
+	return s
+}
+
+// resolveDetectOptionsWithScopes is like resolveDetectOptions, but requests
+// tokens with the provided scopes in place of any configured scopes or
+// audience.
+func (o *Options) resolveDetectOptionsWithScopes(scopes []string) *detect.Options {
+	do := transport.CloneDetectOptions(o.DetectOpts)
+	do.Scopes = make([]string, len(scopes))
+	copy(do.Scopes, scopes)
+	do.Audience = ""
+	o2 := *o
+	o2.DetectOpts = do
+	return o2.resolveDetectOptions()
+}
+
+// resolveDetectOptionsWithAudience is like resolveDetectOptions, but requests
+// self-signed JWTs for the provided audience in place of any configured scopes
+// or audience.
+func (o *Options) resolveDetectOptionsWithAudience(audience string) *detect.Options {
+	do := transport.CloneDetectOptions(o.DetectOpts)
+	do.Scopes = nil
+	do.Audience = audience
+	o2 := *o
+	o2.DetectOpts = do
+	return o2.resolveDetectOptions()
+}
+
+func (o *Options) cachedTokenProviderOptions() *auth.CachedTokenProviderOptions {
+	if o.EarlyTokenRefresh == 0 {
+		return nil
+	}
+	return &auth.CachedTokenProviderOptions{
+		ExpireEarly: o.EarlyTokenRefresh,
+	}
+}
+
+// cacheTokenProvider wraps tp in a cache, unless DisableTokenCache is set.
+func (o *Options) cacheTokenProvider(tp auth.TokenProvider) auth.TokenProvider {
+	if o.DisableTokenCache {
+		return tp
+	}
+	return auth.NewCachedTokenProvider(tp, o.cachedTokenProviderOptions())
+}
+
 // InternalOptions are only meant to be set by generated client code. These are
 // not meant to be set directly by consumers of this package. Configuration in
 // this type is considered EXPERIMENTAL and may be removed at any time in the
@@ -125,6 +1009,9 @@ type InternalOptions struct {
 	// DefaultScopes specifies the default OAuth2 scopes to be used for a
 	// service.
 	DefaultScopes []string
+	// DefaultUniverseDomain specifies the default universe domain of a
+	// service.
+	DefaultUniverseDomain string
 }
 
 // AddAuthorizationMiddleware adds a middleware to the provided client's
@@ -132,43 +1019,205 @@ type InternalOptions struct {
 // provided [cloud.google.com/go/auth.TokenProvider]. An error is returned only
 // if client or tp is nil.
 func AddAuthorizationMiddleware(client *http.Client, tp auth.TokenProvider) error {
+	return AddAuthorizationMiddlewareWithOptions(client, tp, nil)
+}
+
+// AuthorizationMiddlewareOptions configures the middleware added by
+// [AddAuthorizationMiddlewareWithOptions].
+type AuthorizationMiddlewareOptions struct {
+	// EarlyTokenRefresh configures how early before a token expires that it
+	// should be refreshed. If unset, the default value is 10 seconds. Optional.
+	EarlyTokenRefresh time.Duration
+	// DisableTokenCache specifies that tokens should not be cached by the
+	// middleware, so a token is fetched from the provider for every request.
+	// This adds the latency of a token fetch to each request. It can not be
+	// combined with EarlyTokenRefresh. Optional.
+	DisableTokenCache bool
+}
+
+func (o *AuthorizationMiddlewareOptions) validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.EarlyTokenRefresh < 0 {
+		return errors.New("httptransport: EarlyTokenRefresh must not be negative")
+	}
+	if o.DisableTokenCache && o.EarlyTokenRefresh != 0 {
+		return errors.New("httptransport: EarlyTokenRefresh is incompatible with DisableTokenCache")
+	}
+	return nil
+}
+
+func (o *AuthorizationMiddlewareOptions) cachedTokenProviderOptions() *auth.CachedTokenProviderOptions {
+	if o == nil || o.EarlyTokenRefresh == 0 {
+		return nil
+	}
+	return &auth.CachedTokenProviderOptions{
+		ExpireEarly: o.EarlyTokenRefresh,
+	}
+}
+
+// cacheTokenProvider wraps tp in a cache, unless DisableTokenCache is set.
+func (o *AuthorizationMiddlewareOptions) cacheTokenProvider(tp auth.TokenProvider) auth.TokenProvider {
+	if o != nil && o.DisableTokenCache {
+		return tp
+	}
+	return auth.NewCachedTokenProvider(tp, o.cachedTokenProviderOptions())
+}
+
+// AddAuthorizationMiddlewareWithOptions is like [AddAuthorizationMiddleware]
+// but allows configuring the middleware with the provided options, which may
+// be nil. An error is returned if client or tp is nil, or if the options are
+// invalid.
+func AddAuthorizationMiddlewareWithOptions(client *http.Client, tp auth.TokenProvider, opts *AuthorizationMiddlewareOptions) error {
 	if client == nil || tp == nil {
 		return fmt.Errorf("httptransport: client and tp must not be nil")
 	}
+	if err := opts.validate(); err != nil {
+		return err
+	}
 	base := client.Transport
 	if base == nil {
 		base = http.DefaultTransport.(*http.Transport).Clone()
 	}
-	client.Transport = &authTransport{
-		provider: auth.NewCachedTokenProvider(tp, nil),
-		base:     base,
+	client.Transport = newAuthTransport(base, tp, opts.cacheTokenProvider)
+	return nil
+}
+
+// SetTokenProvider replaces the provider of tokens for requests sent with
+// client, which must have been created by [NewClient] with token based
+// authentication or have had a middleware added by
+// [AddAuthorizationMiddleware], without rebuilding the client. Tokens from tp
+// are cached as those of the original provider were, and fetched with the
+// [Options.FallbackTokenProvider] and [Options.TokenFetchRetries] the client
+// was created with. Each request uses either
+// the original provider or tp, requests in flight finish with the provider
+// they started with. Per-request scopes set with [NewContextWithScopes] are
+// not supported afterwards, as with an explicit [Options.TokenProvider], and
+// [Options.AudienceForHost] no longer applies. An
+// error is returned if tp is nil or the client does not authenticate with
+// tokens from this package.
+func SetTokenProvider(client *http.Client, tp auth.TokenProvider) error {
+	if tp == nil {
+		return errors.New("httptransport: tp must not be nil")
+	}
+	if client == nil {
+		return errors.New("httptransport: client must not be nil")
+	}
+	at := findAuthTransport(client.Transport)
+	if at == nil {
+		return errors.New("httptransport: client was not created by this package with token based authentication")
 	}
+	at.setProvider(tp)
 	return nil
 }
 
+// CloseClient closes the idle connections of the base transport of client,
+// which must have been created by [NewClient] or have had a middleware added
+// by [AddAuthorizationMiddleware], so that they are released when a process
+// shuts down rather than when they time out. Requests in flight are not
+// interrupted, and the client may still be used afterwards, opening new
+// connections. Tokens are only fetched while requests are sent, so no
+// background work of the client outlives it. It is safe to call more than
+// once. An error is returned if client was not created by this package.
+func CloseClient(client *http.Client) error {
+	if client == nil {
+		return errors.New("httptransport: client must not be nil")
+	}
+	base, ok := baseTransport(client.Transport)
+	if !ok {
+		return errors.New("httptransport: client was not created by this package")
+	}
+	closeIdleConnections(base)
+	return nil
+}
+
+// resolveTransportConfig returns the transport options derived from o, the
+// transport configuration they resolve to, and the endpoint requests are
+// routed to.
+func (o *Options) resolveTransportConfig() (*transport.Options, *transport.HTTPTransportConfig, string, error) {
+	tOpts := &transport.Options{
+		Endpoint:           o.Endpoint,
+		ClientCertProvider: o.ClientCertProvider,
+		UniverseDomain:     o.universeDomain(),
+	}
+	if io := o.InternalOptions; io != nil {
+		tOpts.DefaultEndpoint = io.DefaultEndpoint
+		tOpts.DefaultMTLSEndpoint = io.DefaultMTLSEndpoint
+	}
+	config, err := transport.GetHTTPTransportConfig(tOpts)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	endpoint, err := o.resolveEndpoint(config.Endpoint)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return tOpts, config, endpoint, nil
+}
+
+// ResolvedEndpoint returns the base URL that a client created by [NewClient]
+// with the provided [Options] would send requests for
+// [InternalOptions.DefaultEndpoint] to, taking into account Endpoint, the
+// universe domain, and the switch to [InternalOptions.DefaultMTLSEndpoint]
+// when a client certificate is used. No client is created and no request is
+// sent. An empty string is returned if neither Endpoint nor a default
+// endpoint is set, as requests are then sent to the URL they were created
+// with. Hosts routed elsewhere by EndpointOverrides are not reflected.
+func ResolvedEndpoint(opts *Options) (string, error) {
+	if err := opts.validate(); err != nil {
+		return "", err
+	}
+	_, _, endpoint, err := opts.resolveTransportConfig()
+	if err != nil {
+		return "", err
+	}
+	return endpoint, nil
+}
+
 // NewClient returns a [net/http.Client] that can be used to communicate with a
 // Google cloud service, configured with the provided [Options]. It
 // automatically appends Authorization headers to all outgoing requests.
+//
+// If a client certificate is available, either from
+// [Options.ClientCertProvider] or from the default source when the
+// GOOGLE_API_USE_CLIENT_CERTIFICATE environment variable is set to true, it is
+// presented during TLS handshakes and requests sent to
+// [InternalOptions.DefaultEndpoint] are routed to
+// [InternalOptions.DefaultMTLSEndpoint]. An explicit [Options.Endpoint] always
+// takes precedence over either default.
 func NewClient(opts *Options) (*http.Client, error) {
 	if err := opts.validate(); err != nil {
 		return nil, err
 	}
-	// TODO(codyoss): re-add in a future PR
-
-	// tOpts := &transport.Options{
-	// 	Endpoint:           opts.Endpoint,
-	// 	ClientCertProvider: opts.ClientCertProvider,
-	// 	Client:             opts.client(),
-	// }
-	// if io := opts.InternalOptions; io != nil {
-	// 	tOpts.DefaultEndpoint = io.DefaultEndpoint
-	// 	tOpts.DefaultMTLSEndpoint = io.DefaultMTLSEndpoint
-	// }
-	// clientCertProvider, dialTLSContext, err := transport.GetHTTPTransportConfig(tOpts)
-	// if err != nil {
-	// 	return nil, err
-	// }
-	trans, err := newTransport(defaultBaseTransport(nil), opts)
+	// The client builds providers and base transports from opts after it is
+	// returned, so it must not see later changes the user makes to opts.
+	opts = opts.Clone()
+	opts.TLSConfig = opts.TLSConfig.Clone()
+	tOpts, config, endpoint, err := opts.resolveTransportConfig()
+	if err != nil {
+		return nil, err
+	}
+	base := opts.BaseRoundTripper
+	if base == nil {
+		newBase := func() http.RoundTripper {
+			return defaultBaseTransport(opts, config.ClientCertProvider, nil)
+		}
+		if opts.CertReloadInterval != 0 {
+			base = newCertReloadTransport(newBase, opts.CertReloadInterval, opts.now)
+		} else {
+			base = newBase()
+		}
+	}
+	overrides, err := opts.resolveEndpointOverrides()
+	if err != nil {
+		return nil, err
+	}
+	base, err = addEndpointTransport(base, tOpts.DefaultEndpoint, endpoint, overrides)
+	if err != nil {
+		return nil, err
+	}
+	trans, err := newTransport(base, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -177,12 +1226,314 @@ func NewClient(opts *Options) (*http.Client, error) {
 	}, nil
 }
 
+type scopesKeyType struct{}
+
+// NewContextWithScopes returns a copy of ctx that carries the provided scopes.
+// Requests sent with the returned context by a client created by [NewClient]
+// are authorized with a token for these scopes rather than the scopes the
+// client was configured with. Tokens are cached separately for each distinct
+// set of scopes. Per-request scopes are only supported for clients that detect
+// credentials, requests fail if an explicit [Options.TokenProvider] is used.
+func NewContextWithScopes(ctx context.Context, scopes ...string) context.Context {
+	s := make([]string, len(scopes))
+	copy(s, scopes)
+	return context.WithValue(ctx, scopesKeyType{}, s)
+}
+
+// RequestWithScopes returns a clone of req that is authorized with a token for
+// the provided scopes, like a request whose context was created by
+// [NewContextWithScopes], which it is equivalent to. The scopes replace any
+// that the context of req carries; scopes set on the context of the returned
+// request afterwards replace them in turn. Tokens are cached for each
+// distinct set of scopes, regardless of which of the two was used.
+func RequestWithScopes(req *http.Request, scopes ...string) *http.Request {
+	return req.Clone(NewContextWithScopes(req.Context(), scopes...))
+}
+
+// scopesFromContext returns the scopes stored in ctx by
+// [NewContextWithScopes], or nil if none were stored.
+func scopesFromContext(ctx context.Context) []string {
+	scopes, _ := ctx.Value(scopesKeyType{}).([]string)
+	return scopes
+}
+
+type metadataKeyType struct{}
+
+// NewContextWithMetadata returns a copy of ctx that carries the provided
+// metadata. Requests sent with the returned context by a client created by
+// [NewClient] have each entry added as a header, in addition to any values
+// the request already has for it, which makes it suitable for forwarding
+// request scoped metadata such as routing hints. Keys must be valid HTTP
+// header names and must not be Authorization, Proxy-Authorization, Host, or
+// [Options.AuthHeaderName]; requests fail if they are not.
+func NewContextWithMetadata(ctx context.Context, md map[string]string) context.Context {
+	m := make(map[string]string, len(md))
+	for k, v := range md {
+		m[k] = v
+	}
+	return context.WithValue(ctx, metadataKeyType{}, m)
+}
+
+// metadataFromContext returns the metadata stored in ctx by
+// [NewContextWithMetadata], or nil if none was stored.
+func metadataFromContext(ctx context.Context) map[string]string {
+	md, _ := ctx.Value(metadataKeyType{}).(map[string]string)
+	return md
+}
+
+// scopesKey returns a key that is the same for any ordering of, and
+// duplicates within, scopes.
+func scopesKey(scopes []string) string {
+	if len(scopes) == 0 {
+		return ""
+	}
+	s := make([]string, len(scopes))
+	copy(s, scopes)
+	sort.Strings(s)
+	uniq := s[:1]
+	for _, v := range s[1:] {
+		if v != uniq[len(uniq)-1] {
+			uniq = append(uniq, v)
+		}
+	}
+	return strings.Join(uniq, " ")
+}
+
+// Token returns the token that a client created by [NewClient] with the
+// provided [Options] would attach to requests, without sending any request to
+// the service. It is intended for diagnostics and for handing tokens to other
+// processes. An error is returned if authentication is disabled or an API key
+// is used, as no token is involved in either case.
+func Token(ctx context.Context, opts *Options) (*auth.Token, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if opts.DisableAuthentication {
+		return nil, errors.New("httptransport: no token is available when DisableAuthentication is set")
+	}
+	if opts.usesAPIKey() {
+		return nil, errors.New("httptransport: no token is available when APIKey is set")
+	}
+	rc, err := opts.resolveTokenProvider()
+	if err != nil {
+		return nil, err
+	}
+	return rc.tp.Token(ctx)
+}
+
+// CheckCredentials resolves the credentials a client created by [NewClient]
+// with o would use and fetches a single token with them, without creating a
+// client or sending any request to the service. It is intended for failing
+// fast at startup, before a process begins serving. The error returned
+// describes why credentials could not be found or could not be used, for
+// example a missing credentials file, an unreachable metadata server, or
+// scopes the credentials may not request. It returns nil without doing
+// anything when authentication is disabled or an API key is used.
+func (o *Options) CheckCredentials(ctx context.Context) error {
+	if err := o.validate(); err != nil {
+		return err
+	}
+	if o.DisableAuthentication || o.usesAPIKey() {
+		return nil
+	}
+	rc, err := o.resolveTokenProvider()
+	if err != nil {
+		return fmt.Errorf("httptransport: unable to find credentials: %w", err)
+	}
+	token, err := fetchToken(ctx, rc.tp)
+	if err != nil {
+		return fmt.Errorf("httptransport: unable to fetch a token with the credentials: %w", err)
+	}
+	if token == nil || token.Value == "" {
+		return errors.New("httptransport: the credentials returned an empty token")
+	}
+	return nil
+}
+
+// TokenSource returns an [golang.org/x/oauth2.TokenSource] that yields the
+// same tokens a client created by [NewClient] with the provided [Options]
+// would attach to requests. It is intended for use with libraries that still
+// expect x/oauth2 types. The provided context is used for every token fetch
+// made by the returned TokenSource. An error is returned if authentication is
+// disabled or an API key is used, as no token is involved in either case.
+func TokenSource(ctx context.Context, opts *Options) (oauth2.TokenSource, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if opts.DisableAuthentication {
+		return nil, errors.New("httptransport: no token source is available when DisableAuthentication is set")
+	}
+	if opts.usesAPIKey() {
+		return nil, errors.New("httptransport: no token source is available when APIKey is set")
+	}
+	rc, err := opts.resolveTokenProvider()
+	if err != nil {
+		return nil, err
+	}
+	if opts.now != nil {
+		ctx = internal.WithClock(ctx, opts.now)
+	}
+	return &tokenSourceAdapter{
+		ctx: ctx,
+		tp:  opts.cacheTokenProvider(rc.tp),
+	}, nil
+}
+
+// tokenSourceAdapter adapts an [cloud.google.com/go/auth.TokenProvider] to
+// the [golang.org/x/oauth2.TokenSource] interface.
+type tokenSourceAdapter struct {
+	ctx context.Context
+	tp  auth.TokenProvider
+}
+
+func (ts *tokenSourceAdapter) Token() (*oauth2.Token, error) {
+	tok, err := ts.tp.Token(ts.ctx)
+	if err != nil {
+		return nil, err
+	}
+	tok2 := &oauth2.Token{
+		AccessToken: tok.Value,
+		TokenType:   tok.Type,
+		Expiry:      tok.Expiry,
+	}
+	if tok.Metadata != nil {
+		tok2 = tok2.WithExtra(tok.Metadata)
+	}
+	return tok2, nil
+}
+
+// PrepareRequest returns a copy of req prepared the way a client created by
+// [NewClient] with the provided [Options] would send it, with headers,
+// credentials, and the quota project applied and routed to the resolved
+// endpoint, without sending it. It is intended for handing authenticated
+// requests to other systems. The body of the returned request may be the body
+// of req. ctx is used to fetch a token and is set on the returned request. An
+// error is returned if the options are invalid, as [NewClient] does, or if
+// the request can not be prepared.
+func PrepareRequest(ctx context.Context, opts *Options, req *http.Request) (*http.Request, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	capture := &captureTransport{}
+	// Nothing is sent, so the base transport and the transports that only
+	// observe or bound an exchange are not needed.
+	o := opts.withBaseRoundTripper(capture)
+	o.MetricsObserver = nil
+	o.DisableTelemetry = true
+	o.RequireTelemetry = false
+	o.Logf = nil
+	o.RequestTimeout = 0
+	o.HonorRetryAfter = false
+	o.RetryOnUnauthorized = false
+	o.RetryOnInvalidTokenChallenge = false
+	client, err := NewClient(o)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := client.Transport.RoundTrip(req.WithContext(ctx)); err != nil {
+		return nil, err
+	}
+	return capture.req, nil
+}
+
+// withBaseRoundTripper returns a copy of o that sends requests with base, with
+// the options that configure the default base transport cleared.
+func (o *Options) withBaseRoundTripper(base http.RoundTripper) *Options {
+	o2 := o.Clone()
+	if o2 == nil {
+		o2 = &Options{}
+	}
+	o2.BaseRoundTripper = base
+	o2.TLSConfig = nil
+	o2.MaxIdleConnsPerHost = 0
+	o2.MaxConnsPerHost = 0
+	o2.IdleConnTimeout = 0
+	o2.Proxy = nil
+	o2.ForceHTTP2 = false
+	o2.AllowH2C = false
+	o2.CertReloadInterval = 0
+	return o2
+}
+
+// captureTransport records the request it is given instead of sending it.
+type captureTransport struct {
+	req *http.Request
+}
+
+func (t *captureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.req = req
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Body:       http.NoBody,
+		Request:    req,
+	}, nil
+}
+
+// WasAuthenticated reports whether a client created by [NewClient] attached
+// credentials, a token or an API key, to the request that produced resp. It
+// returns false for requests sent with DisableAuthentication set or to a host
+// in SkipAuthForHosts or a path in SkipAuthForPaths.
+//
+// The flag is stored in the context of resp.Request, the request as it was
+// sent by the transport, and lives as long as that request. It is not set on
+// the request passed to [net/http.Client.Do]. If a BaseRoundTripper does not
+// set resp.Request to the request it was given, false is returned.
+func WasAuthenticated(resp *http.Response) bool {
+	if resp == nil || resp.Request == nil {
+		return false
+	}
+	ok, _ := resp.Request.Context().Value(authenticatedKey{}).(bool)
+	return ok
+}
+
+// RequestID returns the X-Request-Id header that a client created by
+// [NewClient] with GenerateRequestID set sent with the request that produced
+// resp, whether it was generated or set by the caller. It returns an empty
+// string for clients without GenerateRequestID. Unlike the X-Request-Id header
+// of resp, which is only set if the server echoes the ID, it is reported for
+// every response.
+//
+// Like the flag of [WasAuthenticated], the ID is stored in the context of
+// resp.Request and is not available if a BaseRoundTripper does not set
+// resp.Request to the request it was given.
+func RequestID(resp *http.Response) string {
+	if resp == nil || resp.Request == nil {
+		return ""
+	}
+	id, _ := resp.Request.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
 // SetAuthHeader uses the provided token to set the Authorization header on a
 // request. If the token.Type is empty, the type is assumed to be Bearer.
 func SetAuthHeader(token *auth.Token, req *http.Request) {
+	SetAuthHeaderNamed(defaultAuthHeaderName, token, req)
+}
+
+// SetAuthHeaderNamed uses the provided token to set the header with the
+// provided name on a request, in the same format as [SetAuthHeader]. If name is
+// empty, the Authorization header is set.
+func SetAuthHeaderNamed(name string, token *auth.Token, req *http.Request) {
+	if name == "" {
+		name = defaultAuthHeaderName
+	}
 	typ := token.Type
 	if typ == "" {
 		typ = internal.TokenTypeBearer
 	}
-	req.Header.Set("Authorization", typ+" "+token.Value)
+	req.Header.Set(name, typ+" "+token.Value)
+}
+
+// SetAuthHeaderFromProvider fetches a token from tp and uses it to set the
+// Authorization header on a request, as [SetAuthHeader] does. The token is
+// fetched with ctx. If a token can not be fetched an error is returned and req
+// is not modified.
+func SetAuthHeaderFromProvider(ctx context.Context, tp auth.TokenProvider, req *http.Request) error {
+	token, err := fetchToken(ctx, tp)
+	if err != nil {
+		return fmt.Errorf("httptransport: unable to fetch token: %w", err)
+	}
+	SetAuthHeader(token, req)
+	return nil
 }
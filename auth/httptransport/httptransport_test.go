@@ -15,20 +15,37 @@
 package httptransport
 
 import (
+	"compress/gzip"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/auth"
 	"cloud.google.com/go/auth/detect"
 	"cloud.google.com/go/auth/internal"
+	"cloud.google.com/go/auth/internal/jwt"
+	"cloud.google.com/go/auth/internal/testutil"
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 func TestAddAuthorizationMiddleware(t *testing.T) {
-	tp := staticTP("fakeToken")
+	tp := testutil.StaticTokenProvider("fakeToken")
 	tests := []struct {
 		name    string
 		client  *http.Client
@@ -85,250 +102,4815 @@ func TestAddAuthorizationMiddleware(t *testing.T) {
 	}
 }
 
-func TestNewClient_FailsValidation(t *testing.T) {
+func TestAddAuthorizationMiddlewareWithOptions_EarlyTokenRefresh(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
 	tests := []struct {
-		name string
-		opts *Options
+		name      string
+		opts      *AuthorizationMiddlewareOptions
+		wantCalls int
 	}{
 		{
-			name: "missing options",
-		},
-		{
-			name: "has creds with disable options, tp",
-			opts: &Options{
-				DisableAuthentication: true,
-				TokenProvider:         staticTP("fakeToken"),
-			},
+			name:      "default",
+			wantCalls: 1,
 		},
 		{
-			name: "has creds with disable options, cred file",
-			opts: &Options{
-				DisableAuthentication: true,
-				DetectOpts: &detect.Options{
-					CredentialsFile: "abc.123",
-				},
-			},
+			name:      "refreshes early",
+			opts:      &AuthorizationMiddlewareOptions{EarlyTokenRefresh: time.Hour},
+			wantCalls: 2,
 		},
 		{
-			name: "has creds with disable options, cred json",
-			opts: &Options{
-				DisableAuthentication: true,
-				DetectOpts: &detect.Options{
-					CredentialsJSON: []byte(`{"foo":"bar"}`),
-				},
-			},
+			name:      "cache disabled",
+			opts:      &AuthorizationMiddlewareOptions{DisableTokenCache: true},
+			wantCalls: 2,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			_, err := NewClient(tt.opts)
-			if err == nil {
-				t.Fatal("NewClient() = _, nil, want error")
+			// Tokens expire in one minute, so with a one hour margin every
+			// request needs a fresh token.
+			tp := &countingTP{expiresIn: time.Minute}
+			client := &http.Client{}
+			if err := AddAuthorizationMiddlewareWithOptions(client, tp, tt.opts); err != nil {
+				t.Fatalf("AddAuthorizationMiddlewareWithOptions() = %v", err)
+			}
+			for i := 0; i < 2; i++ {
+				resp, err := client.Get(ts.URL)
+				if err != nil {
+					t.Fatalf("client.Get() = %v", err)
+				}
+				resp.Body.Close()
+			}
+			if tp.calls != tt.wantCalls {
+				t.Errorf("got %d calls, want %d", tp.calls, tt.wantCalls)
 			}
 		})
 	}
+
+	err := AddAuthorizationMiddlewareWithOptions(&http.Client{}, testutil.StaticTokenProvider("fakeToken"), &AuthorizationMiddlewareOptions{EarlyTokenRefresh: -time.Second})
+	if err == nil {
+		t.Error("AddAuthorizationMiddlewareWithOptions() = nil, want error")
+	}
+	err = AddAuthorizationMiddlewareWithOptions(&http.Client{}, testutil.StaticTokenProvider("fakeToken"), &AuthorizationMiddlewareOptions{EarlyTokenRefresh: time.Second, DisableTokenCache: true})
+	if err == nil {
+		t.Error("AddAuthorizationMiddlewareWithOptions() = nil, want error")
+	}
 }
 
-func TestOptions_ResolveDetectOptions(t *testing.T) {
+func TestNewClient_DisableTokenCache(t *testing.T) {
 	tests := []struct {
-		name string
-		in   *Options
-		want *detect.Options
+		name      string
+		disable   bool
+		wantCalls int
 	}{
 		{
-			name: "base",
-			in: &Options{
-				DetectOpts: &detect.Options{
-					Scopes:          []string{"scope"},
-					CredentialsFile: "/path/to/a/file",
-				},
-			},
-			want: &detect.Options{
-				Scopes:          []string{"scope"},
-				CredentialsFile: "/path/to/a/file",
-			},
-		},
-		{
-			name: "self-signed, with scope",
-			in: &Options{
-				InternalOptions: &InternalOptions{
-					EnableJWTWithScope: true,
-				},
-				DetectOpts: &detect.Options{
-					Scopes:          []string{"scope"},
-					CredentialsFile: "/path/to/a/file",
-				},
-			},
-			want: &detect.Options{
-				Scopes:           []string{"scope"},
-				CredentialsFile:  "/path/to/a/file",
-				UseSelfSignedJWT: true,
-			},
+			name:      "default",
+			wantCalls: 1,
 		},
 		{
-			name: "self-signed, with aud",
-			in: &Options{
-				DetectOpts: &detect.Options{
-					Audience:        "aud",
-					CredentialsFile: "/path/to/a/file",
-				},
-			},
-			want: &detect.Options{
-				Audience:         "aud",
-				CredentialsFile:  "/path/to/a/file",
-				UseSelfSignedJWT: true,
-			},
+			name:      "cache disabled",
+			disable:   true,
+			wantCalls: 3,
 		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tp := &countingTP{expiresIn: time.Hour}
+			client, err := NewClient(&Options{
+				BaseRoundTripper:  &recordingRT{},
+				TokenProvider:     tp,
+				DisableTokenCache: tt.disable,
+			})
+			if err != nil {
+				t.Fatalf("NewClient() = %v", err)
+			}
+			for i := 0; i < 3; i++ {
+				resp, err := client.Get("https://foo.googleapis.com")
+				if err != nil {
+					t.Fatalf("client.Get() = %v", err)
+				}
+				resp.Body.Close()
+			}
+			if tp.calls != tt.wantCalls {
+				t.Errorf("got %d calls, want %d", tp.calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestSetTokenProvider(t *testing.T) {
+	tests := []struct {
+		name      string
+		newClient func() (*http.Client, *recordingRT, error)
+	}{
 		{
-			name: "use default scopes",
-			in: &Options{
-				InternalOptions: &InternalOptions{
-					DefaultScopes:   []string{"default"},
-					DefaultAudience: "default",
-				},
-				DetectOpts: &detect.Options{
-					CredentialsFile: "/path/to/a/file",
-				},
-			},
-			want: &detect.Options{
-				Scopes:          []string{"default"},
-				CredentialsFile: "/path/to/a/file",
+			name: "NewClient",
+			newClient: func() (*http.Client, *recordingRT, error) {
+				rt := &recordingRT{}
+				client, err := NewClient(&Options{
+					BaseRoundTripper: rt,
+					TokenProvider:    testutil.StaticTokenProvider("old"),
+					RequestTimeout:   time.Minute,
+					HonorRetryAfter:  true,
+					CompressRequests: true,
+					Logf:             func(string, ...interface{}) {},
+				})
+				return client, rt, err
 			},
 		},
 		{
-			name: "don't use default scopes, scope provided",
-			in: &Options{
-				InternalOptions: &InternalOptions{
-					DefaultScopes:   []string{"default"},
-					DefaultAudience: "default",
-				},
-				DetectOpts: &detect.Options{
-					Scopes:          []string{"non-default"},
-					CredentialsFile: "/path/to/a/file",
-				},
-			},
-			want: &detect.Options{
-				Scopes:          []string{"non-default"},
-				CredentialsFile: "/path/to/a/file",
+			name: "AddAuthorizationMiddleware",
+			newClient: func() (*http.Client, *recordingRT, error) {
+				rt := &recordingRT{}
+				client := &http.Client{Transport: rt}
+				err := AddAuthorizationMiddleware(client, testutil.StaticTokenProvider("old"))
+				return client, rt, err
 			},
 		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, rt, err := tt.newClient()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range []string{"old", "new"} {
+				if want == "new" {
+					if err := SetTokenProvider(client, testutil.StaticTokenProvider("new")); err != nil {
+						t.Fatalf("SetTokenProvider() = %v", err)
+					}
+				}
+				resp, err := client.Get("https://foo.googleapis.com")
+				if err != nil {
+					t.Fatalf("client.Get() = %v", err)
+				}
+				resp.Body.Close()
+				if got := rt.req.Header.Get("Authorization"); got != "Bearer "+want {
+					t.Errorf("got %q, want %q", got, "Bearer "+want)
+				}
+			}
+		})
+	}
+}
+
+func TestSetTokenProvider_FallbackAndRetries(t *testing.T) {
+	rt := &recordingRT{}
+	client, err := NewClient(&Options{
+		BaseRoundTripper:      rt,
+		TokenProvider:         testutil.StaticTokenProvider("old"),
+		FallbackTokenProvider: testutil.StaticTokenProvider("fallback"),
+		TokenFetchRetries:     1,
+		Backoff:               &recordingBackoff{},
+		DisableTokenCache:     true,
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	tests := []struct {
+		name string
+		tp   auth.TokenProvider
+		want string
+	}{
 		{
-			name: "don't use default scopes, aud provided",
-			in: &Options{
-				InternalOptions: &InternalOptions{
-					DefaultScopes:   []string{"default"},
-					DefaultAudience: "default",
-				},
-				DetectOpts: &detect.Options{
-					Audience:        "non-default",
-					CredentialsFile: "/path/to/a/file",
-				},
-			},
-			want: &detect.Options{
-				Audience:         "non-default",
-				CredentialsFile:  "/path/to/a/file",
-				UseSelfSignedJWT: true,
-			},
+			name: "retried",
+			tp:   &failingTP{err: statusError(http.StatusServiceUnavailable), failures: 1},
+			want: "Bearer fakeToken",
 		},
 		{
-			name: "use default aud",
-			in: &Options{
-				InternalOptions: &InternalOptions{
-					DefaultAudience: "default",
-				},
-				DetectOpts: &detect.Options{
-					CredentialsFile: "/path/to/a/file",
-				},
-			},
-			want: &detect.Options{
-				Audience:        "default",
-				CredentialsFile: "/path/to/a/file",
-			},
+			name: "fallback",
+			tp:   &fixedTP{err: errors.New("no token")},
+			want: "Bearer fallback",
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := tt.in.resolveDetectOptions()
-			if diff := cmp.Diff(tt.want, got); diff != "" {
-				t.Errorf("mismatch (-want +got):\n%s", diff)
+			if err := SetTokenProvider(client, tt.tp); err != nil {
+				t.Fatalf("SetTokenProvider() = %v", err)
+			}
+			resp, err := client.Get("https://foo.googleapis.com")
+			if err != nil {
+				t.Fatalf("client.Get() = %v", err)
+			}
+			resp.Body.Close()
+			if got := rt.req.Header.Get("Authorization"); got != tt.want {
+				t.Errorf("got Authorization %q, want %q", got, tt.want)
 			}
 		})
 	}
 }
 
-func TestNewClient_DetectedServiceAccount(t *testing.T) {
-	testQuota := "testquota"
-	wantHeader := "bar"
-	t.Setenv("GOOGLE_CLOUD_QUOTA_PROJECT", testQuota)
+func TestSetTokenProvider_Concurrent(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if got := r.Header.Get("Authorization"); got == "" {
-			t.Errorf(`got "", want an auth token`)
-		}
-		if got := r.Header.Get("Foo"); got != wantHeader {
-			t.Errorf("got %q, want %q", got, wantHeader)
-		}
-		if got := r.Header.Get(quotaProjectHeaderKey); got != testQuota {
-			t.Errorf("got %q, want %q", got, testQuota)
+		if got := r.Header.Get("Authorization"); got != "Bearer old" && got != "Bearer new" {
+			t.Errorf("got unexpected Authorization %q", got)
 		}
 	}))
 	defer ts.Close()
 	client, err := NewClient(&Options{
-		Headers: http.Header{"Foo": []string{wantHeader}},
-		InternalOptions: &InternalOptions{
-			DefaultEndpoint: ts.URL,
-		},
-		DetectOpts: &detect.Options{
-			Audience:         ts.URL,
-			CredentialsFile:  "../internal/testdata/sa.json",
-			UseSelfSignedJWT: true,
-		},
+		TokenProvider: testutil.StaticTokenProvider("old"),
 	})
 	if err != nil {
 		t.Fatalf("NewClient() = %v", err)
 	}
-	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
-	if err != nil {
-		t.Fatal(err)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				resp, err := client.Get(ts.URL)
+				if err != nil {
+					t.Errorf("client.Get() = %v", err)
+					return
+				}
+				resp.Body.Close()
+			}
+		}()
 	}
-	if _, err := client.Do(req); err != nil {
-		t.Fatalf("client.Get() = %v", err)
+	if err := SetTokenProvider(client, testutil.StaticTokenProvider("new")); err != nil {
+		t.Errorf("SetTokenProvider() = %v", err)
 	}
+	wg.Wait()
 }
 
-func TestNewClient_APIKey(t *testing.T) {
-	testQuota := "testquota"
-	apiKey := "thereisnospoon"
-	wantHeader := "bar"
-	t.Setenv("GOOGLE_CLOUD_QUOTA_PROJECT", testQuota)
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		got := r.URL.Query().Get("key")
-		if got != apiKey {
-			t.Errorf("got %q, want %q", got, apiKey)
-		}
-		if got := r.Header.Get("Foo"); got != wantHeader {
-			t.Errorf("got %q, want %q", got, wantHeader)
-		}
-		if got := r.Header.Get(quotaProjectHeaderKey); got != testQuota {
-			t.Errorf("got %q, want %q", got, testQuota)
-		}
-	}))
-	defer ts.Close()
-	client, err := NewClient(&Options{
-		APIKey:  apiKey,
-		Headers: http.Header{"Foo": []string{wantHeader}},
+func TestSetTokenProvider_Errors(t *testing.T) {
+	apiKeyClient, err := NewClient(&Options{
+		BaseRoundTripper: &recordingRT{},
+		APIKey:           "key",
 	})
 	if err != nil {
 		t.Fatalf("NewClient() = %v", err)
 	}
-	if _, err := client.Get(ts.URL); err != nil {
-		t.Fatalf("client.Get() = %v", err)
+	tests := []struct {
+		name   string
+		client *http.Client
+		tp     auth.TokenProvider
+	}{
+		{
+			name:   "nil provider",
+			client: apiKeyClient,
+		},
+		{
+			name: "nil client",
+			tp:   testutil.StaticTokenProvider("new"),
+		},
+		{
+			name:   "foreign client",
+			client: &http.Client{Transport: &recordingRT{}},
+			tp:     testutil.StaticTokenProvider("new"),
+		},
+		{
+			name:   "api key",
+			client: apiKeyClient,
+			tp:     testutil.StaticTokenProvider("new"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := SetTokenProvider(tt.client, tt.tp); err == nil {
+				t.Error("SetTokenProvider() = nil, want error")
+			}
+		})
 	}
 }
 
-type staticTP string
+func TestNewClient_Clock(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	var mu sync.Mutex
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(d)
+	}
+	tp := &clockTP{now: clock, expiresIn: time.Hour}
+	opts := &Options{
+		BaseRoundTripper:  &recordingRT{},
+		TokenProvider:     tp,
+		EarlyTokenRefresh: time.Minute,
+	}
+	opts.now = clock
+	client, err := NewClient(opts)
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	steps := []struct {
+		advance   time.Duration
+		wantCalls int
+	}{
+		{advance: 0, wantCalls: 1},
+		{advance: 58 * time.Minute, wantCalls: 1},
+		// Within a minute of the expiry of the first token.
+		{advance: time.Minute + time.Second, wantCalls: 2},
+		{advance: time.Minute, wantCalls: 2},
+		// Past the expiry of the second token.
+		{advance: 2 * time.Hour, wantCalls: 3},
+	}
+	for i, step := range steps {
+		advance(step.advance)
+		resp, err := client.Get("https://foo.googleapis.com")
+		if err != nil {
+			t.Fatalf("client.Get() = %v", err)
+		}
+		resp.Body.Close()
+		if tp.calls != step.wantCalls {
+			t.Errorf("step %d: got %d calls, want %d", i, tp.calls, step.wantCalls)
+		}
+	}
+}
 
-func (tp staticTP) Token(context.Context) (*auth.Token, error) {
-	return &auth.Token{
-		Value: string(tp),
-	}, nil
+func TestNewClient_OnTokenRefresh(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	refreshed := make(chan *auth.Token, 10)
+	opts := &Options{
+		BaseRoundTripper: testutil.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader("")),
+				Request:    req,
+			}, nil
+		}),
+		TokenProvider: &clockTP{now: clock, expiresIn: time.Hour},
+		OnTokenRefresh: func(tok *auth.Token) {
+			refreshed <- tok
+		},
+	}
+	opts.now = clock
+	client, err := NewClient(opts)
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	get := func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp, err := client.Get("https://foo.googleapis.com")
+				if err != nil {
+					t.Errorf("client.Get() = %v", err)
+					return
+				}
+				resp.Body.Close()
+			}()
+		}
+		wg.Wait()
+	}
+	wait := func(want string) {
+		select {
+		case tok := <-refreshed:
+			if tok.Value != want {
+				t.Errorf("got token %q, want %q", tok.Value, want)
+			}
+			if wantExpiry := now.Add(time.Hour); !tok.Expiry.Equal(wantExpiry) {
+				t.Errorf("got expiry %v, want %v", tok.Expiry, wantExpiry)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("OnTokenRefresh was not called for %q", want)
+		}
+	}
+
+	get()
+	wait("token1")
+	// A second refresh is only expected once the first token has expired.
+	get()
+	now = now.Add(2 * time.Hour)
+	get()
+	wait("token2")
+	select {
+	case tok := <-refreshed:
+		t.Errorf("OnTokenRefresh called with %q, want no more calls", tok.Value)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestNewClient_OnTokenRefreshDetectedCredentials(t *testing.T) {
+	tokens := newTokenServer(t, 3600)
+	refreshed := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/reject" && r.Header.Get("Authorization") == "Bearer tok1" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer ts.Close()
+	client, err := NewClient(&Options{
+		DetectOpts: &detect.Options{
+			CredentialsJSON: serviceAccountJSON(t, tokens.URL),
+			Scopes:          []string{"a"},
+		},
+		// Tokens are still cached by the detected credentials.
+		DisableTokenCache:   true,
+		RetryOnUnauthorized: true,
+		OnTokenRefresh: func(tok *auth.Token) {
+			refreshed <- tok.Value
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	for _, path := range []string{"/", "/", "/reject"} {
+		resp, err := client.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("client.Get() = %v", err)
+		}
+		resp.Body.Close()
+	}
+	for _, want := range []string{"tok1", "tok2"} {
+		select {
+		case got := <-refreshed:
+			if got != want {
+				t.Errorf("got token %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("OnTokenRefresh was not called for %q", want)
+		}
+	}
+	select {
+	case got := <-refreshed:
+		t.Errorf("OnTokenRefresh called with %q, want no more calls", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestNewClient_MinTokenLifetime(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	tests := []struct {
+		name      string
+		expiresIn time.Duration
+		wantCalls int
+		wantErr   bool
+	}{
+		{
+			name:      "cached token valid long enough",
+			expiresIn: time.Hour,
+			wantCalls: 1,
+		},
+		{
+			name:      "cached token refreshed",
+			expiresIn: 40 * time.Minute,
+			wantCalls: 2,
+		},
+		{
+			name:      "fresh token too short",
+			expiresIn: 20 * time.Minute,
+			wantCalls: 3,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+			rt := &recordingRT{}
+			tp := &clockTP{now: clock, expiresIn: tt.expiresIn}
+			opts := &Options{
+				BaseRoundTripper: rt,
+				TokenProvider:    tp,
+				MinTokenLifetime: 30 * time.Minute,
+			}
+			opts.now = clock
+			client, err := NewClient(opts)
+			if err != nil {
+				t.Fatalf("NewClient() = %v", err)
+			}
+			resp, err := client.Get("https://foo.googleapis.com")
+			if err != nil {
+				if !tt.wantErr {
+					t.Fatalf("client.Get() = %v", err)
+				}
+			} else {
+				resp.Body.Close()
+			}
+			// The cached token now has 15 minutes less left.
+			now = now.Add(15 * time.Minute)
+			rt.req = nil
+			resp, err = client.Get("https://foo.googleapis.com")
+			if tt.wantErr {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("client.Get() = nil, want error")
+				}
+				if rt.req != nil {
+					t.Error("request was sent, want it not to be")
+				}
+				if tp.calls != tt.wantCalls {
+					t.Errorf("got %d calls, want %d", tp.calls, tt.wantCalls)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("client.Get() = %v", err)
+			}
+			resp.Body.Close()
+			if tp.calls != tt.wantCalls {
+				t.Errorf("got %d calls, want %d", tp.calls, tt.wantCalls)
+			}
+			want := fmt.Sprintf("Bearer token%d", tt.wantCalls)
+			if got := rt.req.Header.Get("Authorization"); got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestNewClient_MinTokenLifetimeDetectedCredentials(t *testing.T) {
+	tokens := newTokenServer(t, 60, 3600)
+	rt := &recordingRT{}
+	client, err := NewClient(&Options{
+		DetectOpts: &detect.Options{
+			CredentialsJSON: serviceAccountJSON(t, tokens.URL),
+			Scopes:          []string{"a"},
+		},
+		MinTokenLifetime: 5 * time.Minute,
+		BaseRoundTripper: rt,
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	resp, err := client.Get("https://foo.googleapis.com")
+	if err != nil {
+		t.Fatalf("client.Get() = %v", err)
+	}
+	resp.Body.Close()
+	if got, want := rt.req.Header.Get("Authorization"), "Bearer tok2"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if n := tokens.fetches(); n != 2 {
+		t.Errorf("got %d token fetches, want 2", n)
+	}
+}
+
+// clockTP returns tokens that expire expiresIn after the time reported by now.
+type clockTP struct {
+	now       func() time.Time
+	expiresIn time.Duration
+	calls     int
+}
+
+func (tp *clockTP) Token(context.Context) (*auth.Token, error) {
+	tp.calls++
+	return &auth.Token{
+		Value:  fmt.Sprintf("token%d", tp.calls),
+		Expiry: tp.now().Add(tp.expiresIn),
+	}, nil
+}
+
+func TestNewClient_FailsValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		opts *Options
+	}{
+		{
+			name: "missing options",
+		},
+		{
+			name: "connection pool with base round tripper",
+			opts: &Options{
+				TokenProvider:    testutil.StaticTokenProvider("fakeToken"),
+				BaseRoundTripper: &recordingRT{},
+				MaxConnsPerHost:  10,
+			},
+		},
+		{
+			name: "TokenTypeOverride with space",
+			opts: &Options{
+				TokenProvider:     testutil.StaticTokenProvider("fakeToken"),
+				TokenTypeOverride: "Bearer x",
+			},
+		},
+		{
+			name: "TokenTypeOverride with control character",
+			opts: &Options{
+				TokenProvider:     testutil.StaticTokenProvider("fakeToken"),
+				TokenTypeOverride: "DPoP\n",
+			},
+		},
+		{
+			name: "relative SkipAuthForPaths entry",
+			opts: &Options{
+				TokenProvider:    testutil.StaticTokenProvider("fakeToken"),
+				SkipAuthForPaths: []string{"v1/public"},
+			},
+		},
+		{
+			name: "SkipAuthForPaths entry with inner wildcard",
+			opts: &Options{
+				TokenProvider:    testutil.StaticTokenProvider("fakeToken"),
+				SkipAuthForPaths: []string{"/v1/*/public"},
+			},
+		},
+		{
+			name: "proxy with base round tripper",
+			opts: &Options{
+				TokenProvider:    testutil.StaticTokenProvider("fakeToken"),
+				BaseRoundTripper: &recordingRT{},
+				Proxy:            http.ProxyFromEnvironment,
+			},
+		},
+		{
+			name: "force http2 with base round tripper",
+			opts: &Options{
+				TokenProvider:    testutil.StaticTokenProvider("fakeToken"),
+				BaseRoundTripper: &recordingRT{},
+				ForceHTTP2:       true,
+			},
+		},
+		{
+			name: "force http2 with connection pool limits",
+			opts: &Options{
+				TokenProvider:   testutil.StaticTokenProvider("fakeToken"),
+				ForceHTTP2:      true,
+				MaxConnsPerHost: 10,
+			},
+		},
+		{
+			name: "force http2 with idle connection timeout",
+			opts: &Options{
+				TokenProvider:   testutil.StaticTokenProvider("fakeToken"),
+				ForceHTTP2:      true,
+				IdleConnTimeout: time.Minute,
+			},
+		},
+		{
+			name: "h2c with proxy",
+			opts: &Options{
+				TokenProvider:         testutil.StaticTokenProvider("fakeToken"),
+				AllowInsecureEndpoint: true,
+				AllowH2C:              true,
+				Proxy:                 http.ProxyFromEnvironment,
+			},
+		},
+		{
+			name: "audience for host without self-signed jwt",
+			opts: &Options{
+				DetectOpts: &detect.Options{
+					CredentialsFile: "../internal/testdata/sa.json",
+				},
+				AudienceForHost: map[string]string{"foo.googleapis.com": "aud"},
+			},
+		},
+		{
+			name: "audience for host with token provider",
+			opts: &Options{
+				TokenProvider: testutil.StaticTokenProvider("fakeToken"),
+				DetectOpts: &detect.Options{
+					UseSelfSignedJWT: true,
+				},
+				AudienceForHost: map[string]string{"foo.googleapis.com": "aud"},
+			},
+		},
+		{
+			name: "audience for host with empty audience",
+			opts: &Options{
+				DetectOpts: &detect.Options{
+					UseSelfSignedJWT: true,
+				},
+				AudienceForHost: map[string]string{"foo.googleapis.com": ""},
+			},
+		},
+		{
+			name: "id token without audience",
+			opts: &Options{
+				DetectOpts: &detect.Options{
+					CredentialsFile: "../internal/testdata/sa.json",
+				},
+				UseIDToken: true,
+			},
+		},
+		{
+			name: "id token with token provider",
+			opts: &Options{
+				TokenProvider: testutil.StaticTokenProvider("fakeToken"),
+				DetectOpts: &detect.Options{
+					Audience: "https://foo.run.app",
+				},
+				UseIDToken: true,
+			},
+		},
+		{
+			name: "h2c without insecure endpoint",
+			opts: &Options{
+				TokenProvider: testutil.StaticTokenProvider("fakeToken"),
+				AllowH2C:      true,
+			},
+		},
+		{
+			name: "proxy with Proxy-Authorization auth header",
+			opts: &Options{
+				TokenProvider:  testutil.StaticTokenProvider("fakeToken"),
+				AuthHeaderName: "proxy-authorization",
+				Proxy:          http.ProxyFromEnvironment,
+			},
+		},
+		{
+			name: "cert reload interval with base round tripper",
+			opts: &Options{
+				TokenProvider:      testutil.StaticTokenProvider("fakeToken"),
+				BaseRoundTripper:   &recordingRT{},
+				CertReloadInterval: time.Hour,
+			},
+		},
+		{
+			name: "negative max header bytes",
+			opts: &Options{
+				TokenProvider:  testutil.StaticTokenProvider("fakeToken"),
+				MaxHeaderBytes: -1,
+			},
+		},
+		{
+			name: "negative idle connection timeout",
+			opts: &Options{
+				TokenProvider:   testutil.StaticTokenProvider("fakeToken"),
+				IdleConnTimeout: -time.Second,
+			},
+		},
+		{
+			name: "early token refresh with token cache disabled",
+			opts: &Options{
+				TokenProvider:     testutil.StaticTokenProvider("fakeToken"),
+				EarlyTokenRefresh: time.Minute,
+				DisableTokenCache: true,
+			},
+		},
+		{
+			name: "has creds with disable options, tp",
+			opts: &Options{
+				DisableAuthentication: true,
+				TokenProvider:         testutil.StaticTokenProvider("fakeToken"),
+			},
+		},
+		{
+			name: "has creds with disable options, cred file",
+			opts: &Options{
+				DisableAuthentication: true,
+				DetectOpts: &detect.Options{
+					CredentialsFile: "abc.123",
+				},
+			},
+		},
+		{
+			name: "has creds with disable options, cred json",
+			opts: &Options{
+				DisableAuthentication: true,
+				DetectOpts: &detect.Options{
+					CredentialsJSON: []byte(`{"foo":"bar"}`),
+				},
+			},
+		},
+		{
+			name: "impersonation with api key",
+			opts: &Options{
+				APIKey:                    "thereisnospoon",
+				ImpersonateServiceAccount: "target@example.com",
+			},
+		},
+		{
+			name: "impersonation with disable authentication",
+			opts: &Options{
+				DisableAuthentication:     true,
+				ImpersonateServiceAccount: "target@example.com",
+			},
+		},
+		{
+			name: "delegates without impersonation",
+			opts: &Options{
+				TokenProvider:        testutil.StaticTokenProvider("fakeToken"),
+				ImpersonateDelegates: []string{"delegate@example.com"},
+			},
+		},
+		{
+			name: "negative early token refresh",
+			opts: &Options{
+				TokenProvider:     testutil.StaticTokenProvider("fakeToken"),
+				EarlyTokenRefresh: -time.Second,
+			},
+		},
+		{
+			name: "negative min token lifetime",
+			opts: &Options{
+				TokenProvider:    testutil.StaticTokenProvider("fakeToken"),
+				MinTokenLifetime: -time.Second,
+			},
+		},
+		{
+			name: "external account with token provider",
+			opts: &Options{
+				TokenProvider: testutil.StaticTokenProvider("fakeToken"),
+				DetectOpts: &detect.Options{
+					ExternalAccount: &detect.ExternalAccountOptions{
+						Audience: "aud",
+					},
+				},
+			},
+		},
+		{
+			name: "external account with api key",
+			opts: &Options{
+				APIKey: "thereisnospoon",
+				DetectOpts: &detect.Options{
+					ExternalAccount: &detect.ExternalAccountOptions{
+						Audience: "aud",
+					},
+				},
+			},
+		},
+		{
+			name: "invalid skip auth host",
+			opts: &Options{
+				TokenProvider:    testutil.StaticTokenProvider("fakeToken"),
+				SkipAuthForHosts: []string{"foo.*.internal"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewClient(tt.opts)
+			if err == nil {
+				t.Fatal("NewClient() = _, nil, want error")
+			}
+		})
+	}
+}
+
+// TestOptions_CloneFieldTest is meant to fail every time a new field is added
+// to the Options type. This tests exists to make sure the Clone method is
+// updated to deep copy any new fields that need it. To make the test pass
+// simply bump the int, but please also clone the relevant fields.
+func TestOptions_CloneFieldTest(t *testing.T) {
+	const WantNumberOfFields = 60
+	got := reflect.TypeOf(Options{}).NumField()
+	if got != WantNumberOfFields {
+		t.Errorf("if this fails please read comment above the test: got %v, want %v", got, WantNumberOfFields)
+	}
+}
+
+func TestOptions_Clone(t *testing.T) {
+	if got := (*Options)(nil).Clone(); got != nil {
+		t.Fatalf("got %v, want nil", got)
+	}
+	opts := &Options{
+		Headers:       http.Header{"Foo": []string{"bar"}},
+		TokenProvider: testutil.StaticTokenProvider("fakeToken"),
+		DetectOpts: &detect.Options{
+			Scopes: []string{"a"},
+		},
+		InternalOptions: &InternalOptions{
+			DefaultEndpoint: "https://foo.googleapis.com",
+			DefaultScopes:   []string{"b"},
+		},
+		ImpersonateServiceAccount: "sa@example.iam.gserviceaccount.com",
+		ImpersonateDelegates:      []string{"c"},
+		SkipAuthForHosts:          []string{"d"},
+		EndpointOverrides:         map[string]string{"e": "f"},
+		EarlyTokenRefresh:         time.Minute,
+	}
+	clone := opts.Clone()
+	if diff := cmp.Diff(opts, clone, cmp.Comparer(func(a, b auth.TokenProvider) bool { return a == b }), cmpopts.IgnoreUnexported(Options{})); diff != "" {
+		t.Fatalf("Clone() mismatch (-want +got):\n%s", diff)
+	}
+
+	clone.Headers.Set("Foo", "baz")
+	clone.DetectOpts.Scopes[0] = "z"
+	clone.InternalOptions.DefaultEndpoint = "https://bar.googleapis.com"
+	clone.InternalOptions.DefaultScopes[0] = "z"
+	clone.ImpersonateDelegates[0] = "z"
+	clone.SkipAuthForHosts[0] = "z"
+	clone.EndpointOverrides["e"] = "z"
+	if got := opts.Headers.Get("Foo"); got != "bar" {
+		t.Errorf("Headers: got %q, want %q", got, "bar")
+	}
+	if got := opts.DetectOpts.Scopes[0]; got != "a" {
+		t.Errorf("DetectOpts.Scopes: got %q, want %q", got, "a")
+	}
+	if got := opts.InternalOptions.DefaultEndpoint; got != "https://foo.googleapis.com" {
+		t.Errorf("InternalOptions.DefaultEndpoint: got %q, want %q", got, "https://foo.googleapis.com")
+	}
+	if got := opts.InternalOptions.DefaultScopes[0]; got != "b" {
+		t.Errorf("InternalOptions.DefaultScopes: got %q, want %q", got, "b")
+	}
+	if got := opts.ImpersonateDelegates[0]; got != "c" {
+		t.Errorf("ImpersonateDelegates: got %q, want %q", got, "c")
+	}
+	if got := opts.SkipAuthForHosts[0]; got != "d" {
+		t.Errorf("SkipAuthForHosts: got %q, want %q", got, "d")
+	}
+	if got := opts.EndpointOverrides["e"]; got != "f" {
+		t.Errorf("EndpointOverrides: got %q, want %q", got, "f")
+	}
+}
+
+func TestOptions_ResolveDetectOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		in   *Options
+		want *detect.Options
+	}{
+		{
+			name: "base",
+			in: &Options{
+				DetectOpts: &detect.Options{
+					Scopes:          []string{"scope"},
+					CredentialsFile: "/path/to/a/file",
+				},
+			},
+			want: &detect.Options{
+				Scopes:          []string{"scope"},
+				CredentialsFile: "/path/to/a/file",
+			},
+		},
+		{
+			name: "self-signed, with scope",
+			in: &Options{
+				InternalOptions: &InternalOptions{
+					EnableJWTWithScope: true,
+				},
+				DetectOpts: &detect.Options{
+					Scopes:          []string{"scope"},
+					CredentialsFile: "/path/to/a/file",
+				},
+			},
+			want: &detect.Options{
+				Scopes:           []string{"scope"},
+				CredentialsFile:  "/path/to/a/file",
+				UseSelfSignedJWT: true,
+			},
+		},
+		{
+			name: "self-signed, with aud",
+			in: &Options{
+				DetectOpts: &detect.Options{
+					Audience:        "aud",
+					CredentialsFile: "/path/to/a/file",
+				},
+			},
+			want: &detect.Options{
+				Audience:         "aud",
+				CredentialsFile:  "/path/to/a/file",
+				UseSelfSignedJWT: true,
+			},
+		},
+		{
+			name: "use default scopes",
+			in: &Options{
+				InternalOptions: &InternalOptions{
+					DefaultScopes:   []string{"default"},
+					DefaultAudience: "default",
+				},
+				DetectOpts: &detect.Options{
+					CredentialsFile: "/path/to/a/file",
+				},
+			},
+			want: &detect.Options{
+				Scopes:          []string{"default"},
+				CredentialsFile: "/path/to/a/file",
+			},
+		},
+		{
+			name: "don't use default scopes, scope provided",
+			in: &Options{
+				InternalOptions: &InternalOptions{
+					DefaultScopes:   []string{"default"},
+					DefaultAudience: "default",
+				},
+				DetectOpts: &detect.Options{
+					Scopes:          []string{"non-default"},
+					CredentialsFile: "/path/to/a/file",
+				},
+			},
+			want: &detect.Options{
+				Scopes:          []string{"non-default"},
+				CredentialsFile: "/path/to/a/file",
+			},
+		},
+		{
+			name: "don't use default scopes, aud provided",
+			in: &Options{
+				InternalOptions: &InternalOptions{
+					DefaultScopes:   []string{"default"},
+					DefaultAudience: "default",
+				},
+				DetectOpts: &detect.Options{
+					Audience:        "non-default",
+					CredentialsFile: "/path/to/a/file",
+				},
+			},
+			want: &detect.Options{
+				Audience:         "non-default",
+				CredentialsFile:  "/path/to/a/file",
+				UseSelfSignedJWT: true,
+			},
+		},
+		{
+			name: "early token refresh",
+			in: &Options{
+				EarlyTokenRefresh: time.Minute,
+				DetectOpts: &detect.Options{
+					CredentialsFile: "/path/to/a/file",
+				},
+			},
+			want: &detect.Options{
+				CredentialsFile:   "/path/to/a/file",
+				EarlyTokenRefresh: time.Minute,
+			},
+		},
+		{
+			name: "early token refresh, detect options take precedence",
+			in: &Options{
+				EarlyTokenRefresh: time.Minute,
+				DetectOpts: &detect.Options{
+					CredentialsFile:   "/path/to/a/file",
+					EarlyTokenRefresh: time.Hour,
+				},
+			},
+			want: &detect.Options{
+				CredentialsFile:   "/path/to/a/file",
+				EarlyTokenRefresh: time.Hour,
+			},
+		},
+		{
+			name: "use default aud",
+			in: &Options{
+				InternalOptions: &InternalOptions{
+					DefaultAudience: "default",
+				},
+				DetectOpts: &detect.Options{
+					CredentialsFile: "/path/to/a/file",
+				},
+			},
+			want: &detect.Options{
+				Audience:        "default",
+				CredentialsFile: "/path/to/a/file",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.in.resolveDetectOptions()
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNewClient_DetectedServiceAccount(t *testing.T) {
+	testQuota := "testquota"
+	wantHeader := "bar"
+	t.Setenv("GOOGLE_CLOUD_QUOTA_PROJECT", testQuota)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got == "" {
+			t.Errorf(`got "", want an auth token`)
+		}
+		if got := r.Header.Get("Foo"); got != wantHeader {
+			t.Errorf("got %q, want %q", got, wantHeader)
+		}
+		if got := r.Header.Get(quotaProjectHeaderKey); got != testQuota {
+			t.Errorf("got %q, want %q", got, testQuota)
+		}
+	}))
+	defer ts.Close()
+	client, err := NewClient(&Options{
+		Headers: http.Header{"Foo": []string{wantHeader}},
+		InternalOptions: &InternalOptions{
+			DefaultEndpoint: ts.URL,
+		},
+		DetectOpts: &detect.Options{
+			Audience:         ts.URL,
+			CredentialsFile:  "../internal/testdata/sa.json",
+			UseSelfSignedJWT: true,
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Do(req); err != nil {
+		t.Fatalf("client.Get() = %v", err)
+	}
+}
+
+func TestNewClient_ExternalAccount(t *testing.T) {
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if got, want := r.Form.Get("subject_token"), "fakeSubjectToken"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		w.Write([]byte(`{"access_token": "fakeSTSToken", "token_type": "Bearer", "expires_in": 3600}`))
+	}))
+	defer sts.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.Header.Get("Authorization"), "Bearer fakeSTSToken"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}))
+	defer ts.Close()
+
+	client, err := NewClient(&Options{
+		DetectOpts: &detect.Options{
+			Scopes: []string{"https://www.googleapis.com/auth/cloud-platform"},
+			ExternalAccount: &detect.ExternalAccountOptions{
+				Audience:         "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/provider",
+				SubjectTokenType: "urn:ietf:params:oauth:token-type:jwt",
+				TokenURL:         sts.URL,
+				SubjectTokenSupplier: func(context.Context) (string, error) {
+					return "fakeSubjectToken", nil
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("client.Get() = %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestNewClient_SendProjectIDHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    *Options
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "detected credentials",
+			opts: &Options{
+				DetectOpts: &detect.Options{
+					Audience:         "aud",
+					CredentialsFile:  "../internal/testdata/sa.json",
+					UseSelfSignedJWT: true,
+				},
+			},
+			want: "fake_project",
+		},
+		{
+			name: "token provider with project",
+			opts: &Options{
+				TokenProvider: projectTP("my_project"),
+			},
+			want: "my_project",
+		},
+		{
+			name: "unknown project",
+			opts: &Options{
+				TokenProvider: testutil.StaticTokenProvider("fakeToken"),
+			},
+			wantErr: true,
+		},
+		{
+			name: "api key",
+			opts: &Options{
+				APIKey: "thereisnospoon",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := &recordingRT{}
+			tt.opts.BaseRoundTripper = base
+			tt.opts.SendProjectIDHeader = "X-My-Project"
+			client, err := NewClient(tt.opts)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("NewClient() = _, nil, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewClient() = %v", err)
+			}
+			resp, err := client.Get("https://foo.googleapis.com/v1/foo")
+			if err != nil {
+				t.Fatalf("client.Get() = %v", err)
+			}
+			resp.Body.Close()
+			if got := base.req.Header.Get("X-My-Project"); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// projectTP is a provider that knows the project it belongs to.
+type projectTP string
+
+func (tp projectTP) Token(context.Context) (*auth.Token, error) {
+	return &auth.Token{Value: "fakeToken"}, nil
+}
+
+func (tp projectTP) ProjectID() string {
+	return string(tp)
+}
+
+func TestNewClient_CredentialsEnvVar(t *testing.T) {
+	b, err := os.ReadFile("../internal/testdata/sa.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		value   string
+		set     bool
+		do      *detect.Options
+		wantErr bool
+	}{
+		{
+			name:  "inline json",
+			value: string(b),
+			set:   true,
+		},
+		{
+			name:  "file path",
+			value: "../internal/testdata/sa.json",
+			set:   true,
+		},
+		{
+			name:    "unset",
+			wantErr: true,
+		},
+		{
+			name:    "empty",
+			set:     true,
+			wantErr: true,
+		},
+		{
+			name:    "missing file",
+			value:   "../internal/testdata/nope.json",
+			set:     true,
+			wantErr: true,
+		},
+		{
+			name:  "overridden by CredentialsJSON",
+			value: "not credentials",
+			set:   true,
+			do:    &detect.Options{CredentialsJSON: b},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.set {
+				t.Setenv("MY_CREDENTIALS", tt.value)
+			}
+			do := tt.do
+			if do == nil {
+				do = &detect.Options{}
+			}
+			do.Audience = "aud"
+			do.UseSelfSignedJWT = true
+			opts := &Options{
+				BaseRoundTripper:  &recordingRT{},
+				CredentialsEnvVar: "MY_CREDENTIALS",
+				DetectOpts:        do,
+			}
+			client, err := NewClient(opts)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("NewClient() = _, nil, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewClient() = %v", err)
+			}
+			resp, err := client.Get("https://foo.googleapis.com/v1/foo")
+			if err != nil {
+				t.Fatalf("client.Get() = %v", err)
+			}
+			resp.Body.Close()
+			if got := resp.Request.Header.Get("Authorization"); !strings.HasPrefix(got, "Bearer ") {
+				t.Errorf("got %q, want a bearer token", got)
+			}
+		})
+	}
+}
+
+func TestNewClient_APIKey(t *testing.T) {
+	testQuota := "testquota"
+	apiKey := "thereisnospoon"
+	wantHeader := "bar"
+	t.Setenv("GOOGLE_CLOUD_QUOTA_PROJECT", testQuota)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := r.URL.Query().Get("key")
+		if got != apiKey {
+			t.Errorf("got %q, want %q", got, apiKey)
+		}
+		if got := r.Header.Get("Foo"); got != wantHeader {
+			t.Errorf("got %q, want %q", got, wantHeader)
+		}
+		if got := r.Header.Get(quotaProjectHeaderKey); got != testQuota {
+			t.Errorf("got %q, want %q", got, testQuota)
+		}
+	}))
+	defer ts.Close()
+	client, err := NewClient(&Options{
+		APIKey:  apiKey,
+		Headers: http.Header{"Foo": []string{wantHeader}},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	if _, err := client.Get(ts.URL); err != nil {
+		t.Fatalf("client.Get() = %v", err)
+	}
+}
+
+func TestNewClient_ClientCertProvider(t *testing.T) {
+	t.Setenv("GOOGLE_API_USE_MTLS_ENDPOINT", "")
+	var gotCertProvider bool
+	certProvider := func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		gotCertProvider = true
+		return &tls.Certificate{}, nil
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.URL.Path, "/v1/foo"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		if got, want := r.URL.Query().Get("bar"), "baz"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}))
+	defer ts.Close()
+	mtlsEndpoint := strings.Replace(ts.URL, "127.0.0.1", "localhost", 1)
+
+	tests := []struct {
+		name     string
+		opts     *Options
+		reqURL   string
+		wantHost string
+	}{
+		{
+			name: "cert selects mtls endpoint",
+			opts: &Options{
+				ClientCertProvider: certProvider,
+				InternalOptions: &InternalOptions{
+					DefaultEndpoint:     "https://foo.googleapis.com",
+					DefaultMTLSEndpoint: mtlsEndpoint,
+				},
+			},
+			reqURL:   "https://foo.googleapis.com/v1/foo?bar=baz",
+			wantHost: strings.TrimPrefix(mtlsEndpoint, "http://"),
+		},
+		{
+			name: "explicit endpoint wins over mtls endpoint",
+			opts: &Options{
+				Endpoint:           ts.URL,
+				ClientCertProvider: certProvider,
+				InternalOptions: &InternalOptions{
+					DefaultEndpoint:     "https://foo.googleapis.com",
+					DefaultMTLSEndpoint: "https://foo.mtls.googleapis.com",
+				},
+			},
+			reqURL:   "https://foo.googleapis.com/v1/foo?bar=baz",
+			wantHost: strings.TrimPrefix(ts.URL, "http://"),
+		},
+		{
+			name: "other hosts are untouched",
+			opts: &Options{
+				ClientCertProvider: certProvider,
+				InternalOptions: &InternalOptions{
+					DefaultEndpoint:     "https://foo.googleapis.com",
+					DefaultMTLSEndpoint: "https://foo.mtls.googleapis.com",
+				},
+			},
+			reqURL:   ts.URL + "/v1/foo?bar=baz",
+			wantHost: strings.TrimPrefix(ts.URL, "http://"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.DisableAuthentication = true
+			client, err := NewClient(tt.opts)
+			if err != nil {
+				t.Fatalf("NewClient() = %v", err)
+			}
+			resp, err := client.Get(tt.reqURL)
+			if err != nil {
+				t.Fatalf("client.Get() = %v", err)
+			}
+			defer resp.Body.Close()
+			if got := resp.Request.URL.Host; got != tt.wantHost {
+				t.Errorf("got host %q, want %q", got, tt.wantHost)
+			}
+		})
+	}
+
+	trans := defaultBaseTransport(&Options{}, certProvider, nil).(*http.Transport)
+	if trans.TLSClientConfig == nil || trans.TLSClientConfig.GetClientCertificate == nil {
+		t.Fatal("base transport does not present a client certificate")
+	}
+	trans.TLSClientConfig.GetClientCertificate(&tls.CertificateRequestInfo{})
+	if !gotCertProvider {
+		t.Error("ClientCertProvider was not called")
+	}
+}
+
+func TestNewClient_CertReloadInterval(t *testing.T) {
+	t.Setenv("GOOGLE_API_USE_MTLS_ENDPOINT", "")
+	var handshakes int
+	certProvider := func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		handshakes++
+		return &tls.Certificate{}, nil
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+
+	now := time.Now()
+	opts := &Options{
+		DisableAuthentication: true,
+		ClientCertProvider:    certProvider,
+		TLSConfig:             &tls.Config{RootCAs: pool},
+		CertReloadInterval:    time.Hour,
+	}
+	opts.now = func() time.Time { return now }
+	client, err := NewClient(opts)
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	get := func() {
+		t.Helper()
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			t.Fatalf("client.Get() = %v", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	get()
+	get()
+	if handshakes != 1 {
+		t.Fatalf("got %d handshakes, want 1 for a pooled connection", handshakes)
+	}
+	// The provider is called again, not cached, for a new connection.
+	if err := CloseClient(client); err != nil {
+		t.Fatal(err)
+	}
+	get()
+	if handshakes != 2 {
+		t.Fatalf("got %d handshakes after closing connections, want 2", handshakes)
+	}
+	now = now.Add(time.Hour)
+	get()
+	if handshakes != 3 {
+		t.Errorf("got %d handshakes after CertReloadInterval, want 3", handshakes)
+	}
+	get()
+	if handshakes != 3 {
+		t.Errorf("got %d handshakes, want the recycled connection to be pooled", handshakes)
+	}
+}
+
+func TestDefaultBaseTransport_TLSConfig(t *testing.T) {
+	certProvider := func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return &tls.Certificate{}, nil
+	}
+	tests := []struct {
+		name         string
+		certProvider ClientCertProvider
+	}{
+		{name: "without client certificate"},
+		{name: "with client certificate", certProvider: certProvider},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConfig := &tls.Config{
+				ServerName:   "example.com",
+				MinVersion:   tls.VersionTLS13,
+				CipherSuites: []uint16{tls.TLS_AES_128_GCM_SHA256},
+			}
+			trans := defaultBaseTransport(&Options{TLSConfig: tlsConfig}, tt.certProvider, nil).(*http.Transport)
+			got := trans.TLSClientConfig
+			if got == tlsConfig {
+				t.Fatal("TLSClientConfig should be a copy of TLSConfig")
+			}
+			if got.ServerName != "example.com" {
+				t.Errorf("got ServerName %q, want %q", got.ServerName, "example.com")
+			}
+			if got.MinVersion != tls.VersionTLS13 {
+				t.Errorf("got MinVersion %v, want %v", got.MinVersion, tls.VersionTLS13)
+			}
+			if diff := cmp.Diff(tlsConfig.CipherSuites, got.CipherSuites); diff != "" {
+				t.Errorf("CipherSuites mismatch (-want +got):\n%s", diff)
+			}
+			if gotCert := got.GetClientCertificate != nil; gotCert != (tt.certProvider != nil) {
+				t.Errorf("got GetClientCertificate set %v, want %v", gotCert, tt.certProvider != nil)
+			}
+			if tlsConfig.GetClientCertificate != nil || len(tlsConfig.NextProtos) > 0 {
+				t.Error("TLSConfig was modified")
+			}
+		})
+	}
+}
+
+func TestNewClient_Proxy(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.URL.String(), "http://foo.googleapis.com/v1/foo"; got != want {
+			t.Errorf("got proxied URL %q, want %q", got, want)
+		}
+		if got, want := r.Header.Get("Proxy-Authorization"), "Basic dXNlcjpwYXNz"; got != want {
+			t.Errorf("got Proxy-Authorization %q, want %q", got, want)
+		}
+		if got, want := r.Header.Get("Authorization"), "Bearer fakeToken"; got != want {
+			t.Errorf("got Authorization %q, want %q", got, want)
+		}
+	}))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		proxyURL  *url.URL
+		setHeader bool
+	}{
+		{
+			name:     "credentials in proxy URL",
+			proxyURL: &url.URL{Scheme: proxyURL.Scheme, Host: proxyURL.Host, User: url.UserPassword("user", "pass")},
+		},
+		{
+			name:      "header set on request",
+			proxyURL:  proxyURL,
+			setHeader: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var proxied bool
+			client, err := NewClient(&Options{
+				TokenProvider: testutil.StaticTokenProvider("fakeToken"),
+				Proxy: func(*http.Request) (*url.URL, error) {
+					proxied = true
+					return tt.proxyURL, nil
+				},
+			})
+			if err != nil {
+				t.Fatalf("NewClient() = %v", err)
+			}
+			req, err := http.NewRequest(http.MethodGet, "http://foo.googleapis.com/v1/foo", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.setHeader {
+				req.Header.Set("Proxy-Authorization", "Basic dXNlcjpwYXNz")
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("client.Do() = %v", err)
+			}
+			resp.Body.Close()
+			if !proxied {
+				t.Error("Proxy was not called")
+			}
+		})
+	}
+}
+
+func TestCloseClient(t *testing.T) {
+	tests := []struct {
+		name    string
+		client  func(base http.RoundTripper) (*http.Client, error)
+		wantErr bool
+	}{
+		{
+			name: "token provider",
+			client: func(base http.RoundTripper) (*http.Client, error) {
+				return NewClient(&Options{
+					BaseRoundTripper: base,
+					TokenProvider:    testutil.StaticTokenProvider("fakeToken"),
+					HonorRetryAfter:  true,
+					RequestTimeout:   time.Minute,
+				})
+			},
+		},
+		{
+			name: "api key",
+			client: func(base http.RoundTripper) (*http.Client, error) {
+				return NewClient(&Options{
+					BaseRoundTripper: base,
+					APIKey:           "thereisnospoon",
+				})
+			},
+		},
+		{
+			name: "disable authentication",
+			client: func(base http.RoundTripper) (*http.Client, error) {
+				return NewClient(&Options{
+					BaseRoundTripper:      base,
+					DisableAuthentication: true,
+				})
+			},
+		},
+		{
+			name: "authorization middleware",
+			client: func(base http.RoundTripper) (*http.Client, error) {
+				client := &http.Client{Transport: base}
+				return client, AddAuthorizationMiddleware(client, testutil.StaticTokenProvider("fakeToken"))
+			},
+		},
+		{
+			name: "not created by this package",
+			client: func(base http.RoundTripper) (*http.Client, error) {
+				return &http.Client{Transport: base}, nil
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := &closeCountingRT{}
+			client, err := tt.client(base)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				err := CloseClient(client)
+				if tt.wantErr {
+					if err == nil {
+						t.Fatal("CloseClient() = nil, want error")
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("CloseClient() = %v", err)
+				}
+			}
+			want := 2
+			if tt.wantErr {
+				want = 0
+			}
+			if base.closes != want {
+				t.Errorf("got %d calls to CloseIdleConnections, want %d", base.closes, want)
+			}
+		})
+	}
+
+	client, err := NewClient(&Options{TokenProvider: testutil.StaticTokenProvider("fakeToken")})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	if err := CloseClient(client); err != nil {
+		t.Errorf("CloseClient() with the default base transport = %v", err)
+	}
+}
+
+// closeCountingRT counts calls to CloseIdleConnections.
+type closeCountingRT struct {
+	recordingRT
+	closes int
+}
+
+func (rt *closeCountingRT) CloseIdleConnections() {
+	rt.closes++
+}
+
+func TestNewClient_ForceHTTP2(t *testing.T) {
+	tests := []struct {
+		name       string
+		enableH2   bool
+		forceHTTP2 bool
+		wantProto  int
+		wantErr    bool
+	}{
+		{
+			name:      "negotiated http1",
+			wantProto: 1,
+		},
+		{
+			name:      "negotiated http2",
+			enableH2:  true,
+			wantProto: 2,
+		},
+		{
+			name:       "forced http2",
+			enableH2:   true,
+			forceHTTP2: true,
+			wantProto:  2,
+		},
+		{
+			name:       "forced http2 unsupported",
+			forceHTTP2: true,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if got, want := r.Header.Get("Authorization"), "Bearer fakeToken"; got != want {
+					t.Errorf("got Authorization %q, want %q", got, want)
+				}
+			}))
+			ts.EnableHTTP2 = tt.enableH2
+			ts.StartTLS()
+			defer ts.Close()
+			pool := x509.NewCertPool()
+			pool.AddCert(ts.Certificate())
+			client, err := NewClient(&Options{
+				TokenProvider: testutil.StaticTokenProvider("fakeToken"),
+				TLSConfig:     &tls.Config{RootCAs: pool},
+				ForceHTTP2:    tt.forceHTTP2,
+			})
+			if err != nil {
+				t.Fatalf("NewClient() = %v", err)
+			}
+			resp, err := client.Get(ts.URL)
+			if tt.wantErr {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("client.Get() = nil, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("client.Get() = %v", err)
+			}
+			resp.Body.Close()
+			if resp.ProtoMajor != tt.wantProto {
+				t.Errorf("got protocol %s, want major version %d", resp.Proto, tt.wantProto)
+			}
+		})
+	}
+}
+
+func TestNewClient_AllowH2C(t *testing.T) {
+	ts := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("got protocol %s, want HTTP/2", r.Proto)
+		}
+		if got, want := r.Header.Get("Authorization"), "Bearer fakeToken"; got != want {
+			t.Errorf("got Authorization %q, want %q", got, want)
+		}
+	}), &http2.Server{}))
+	defer ts.Close()
+	client, err := NewClient(&Options{
+		TokenProvider:         testutil.StaticTokenProvider("fakeToken"),
+		AllowInsecureEndpoint: true,
+		AllowH2C:              true,
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("client.Get() = %v", err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("got protocol %s, want HTTP/2", resp.Proto)
+	}
+}
+
+func TestDefaultBaseTransport_ConnectionPool(t *testing.T) {
+	tests := []struct {
+		name                    string
+		opts                    *Options
+		wantMaxIdleConnsPerHost int
+		wantMaxIdleConns        int
+		wantMaxConnsPerHost     int
+		wantIdleConnTimeout     time.Duration
+	}{
+		{
+			name:                    "defaults",
+			opts:                    &Options{},
+			wantMaxIdleConnsPerHost: 100,
+			wantMaxIdleConns:        http.DefaultTransport.(*http.Transport).MaxIdleConns,
+			wantIdleConnTimeout:     http.DefaultTransport.(*http.Transport).IdleConnTimeout,
+		},
+		{
+			name: "configured",
+			opts: &Options{
+				MaxIdleConnsPerHost: 500,
+				MaxConnsPerHost:     1000,
+				IdleConnTimeout:     time.Minute,
+			},
+			wantMaxIdleConnsPerHost: 500,
+			wantMaxIdleConns:        500,
+			wantMaxConnsPerHost:     1000,
+			wantIdleConnTimeout:     time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trans := defaultBaseTransport(tt.opts, nil, nil).(*http.Transport)
+			if trans.MaxIdleConnsPerHost != tt.wantMaxIdleConnsPerHost {
+				t.Errorf("got MaxIdleConnsPerHost %d, want %d", trans.MaxIdleConnsPerHost, tt.wantMaxIdleConnsPerHost)
+			}
+			if trans.MaxIdleConns != tt.wantMaxIdleConns {
+				t.Errorf("got MaxIdleConns %d, want %d", trans.MaxIdleConns, tt.wantMaxIdleConns)
+			}
+			if trans.MaxConnsPerHost != tt.wantMaxConnsPerHost {
+				t.Errorf("got MaxConnsPerHost %d, want %d", trans.MaxConnsPerHost, tt.wantMaxConnsPerHost)
+			}
+			if trans.IdleConnTimeout != tt.wantIdleConnTimeout {
+				t.Errorf("got IdleConnTimeout %v, want %v", trans.IdleConnTimeout, tt.wantIdleConnTimeout)
+			}
+		})
+	}
+}
+
+func TestNewClient_TLSConfig(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	client, err := NewClient(&Options{
+		DisableAuthentication: true,
+		TLSConfig: &tls.Config{
+			RootCAs:    roots,
+			MinVersion: tls.VersionTLS13,
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("client.Get() = %v", err)
+	}
+	resp.Body.Close()
+	if resp.TLS == nil || resp.TLS.Version != tls.VersionTLS13 {
+		t.Errorf("got TLS state %+v, want TLS 1.3", resp.TLS)
+	}
+
+	if _, err := NewClient(&Options{
+		DisableAuthentication: true,
+		TLSConfig:             &tls.Config{},
+		BaseRoundTripper:      &recordingRT{},
+	}); err == nil {
+		t.Error("NewClient() = _, nil, want error for TLSConfig with BaseRoundTripper")
+	}
+}
+
+func TestNewClient_HeaderFunc(t *testing.T) {
+	base := &recordingRT{}
+	var calls int
+	client, err := NewClient(&Options{
+		BaseRoundTripper: base,
+		TokenProvider:    testutil.StaticTokenProvider("fakeToken"),
+		Headers: http.Header{
+			"Static":   []string{"static"},
+			"Override": []string{"static"},
+		},
+		HeaderFunc: func(req *http.Request) (http.Header, error) {
+			calls++
+			if got, want := req.Header.Get("Authorization"), "Bearer fakeToken"; got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+			if req.URL.Path == "/fail" {
+				return nil, errors.New("no header for you")
+			}
+			return http.Header{
+				"override": []string{"dynamic"},
+				"Trace-Id": []string{fmt.Sprint(calls)},
+			}, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	resp, err := client.Get("https://foo.googleapis.com/v1/foo")
+	if err != nil {
+		t.Fatalf("client.Get() = %v", err)
+	}
+	resp.Body.Close()
+	for k, want := range map[string]string{
+		"Static":   "static",
+		"Override": "dynamic",
+		"Trace-Id": "1",
+	} {
+		if got := base.req.Header.Get(k); got != want {
+			t.Errorf("%s: got %q, want %q", k, got, want)
+		}
+	}
+
+	base.req = nil
+	if _, err := client.Get("https://foo.googleapis.com/fail"); err == nil {
+		t.Fatal("client.Get() = _, nil, want error")
+	}
+	if base.req != nil {
+		t.Error("request was sent after HeaderFunc failed")
+	}
+}
+
+func TestNewClient_ProofHeaderFunc(t *testing.T) {
+	var proofs []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proofs = append(proofs, r.Header.Get("DPoP"))
+		if r.Header.Get("Authorization") == "Bearer token1" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer ts.Close()
+	client, err := NewClient(&Options{
+		TokenProvider:       &sequenceTP{},
+		RetryOnUnauthorized: true,
+		Backoff:             &recordingBackoff{},
+		ProofHeaderFunc: func(req *http.Request, token *auth.Token) (string, string, error) {
+			if got, want := req.Header.Get("Authorization"), "Bearer "+token.Value; got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+			if req.URL.Path == "/fail" {
+				return "", "", errors.New("no proof for you")
+			}
+			return "DPoP", "proof-" + token.Value, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("client.Get() = %v", err)
+	}
+	resp.Body.Close()
+	if diff := cmp.Diff([]string{"proof-token1", "proof-token2"}, proofs); diff != "" {
+		t.Errorf("proofs mismatch (-want +got):\n%s", diff)
+	}
+
+	proofs = nil
+	if _, err := client.Get(ts.URL + "/fail"); err == nil {
+		t.Fatal("client.Get() = _, nil, want error")
+	}
+	if len(proofs) != 0 {
+		t.Error("request was sent after ProofHeaderFunc failed")
+	}
+}
+
+func TestNewClient_ProofHeaderFuncReservedHeader(t *testing.T) {
+	base := &recordingRT{}
+	client, err := NewClient(&Options{
+		TokenProvider:    testutil.StaticTokenProvider("fakeToken"),
+		BaseRoundTripper: base,
+		ProofHeaderFunc: func(*http.Request, *auth.Token) (string, string, error) {
+			return "authorization", "DPoP proof", nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	if _, err := client.Get("https://foo.googleapis.com"); err == nil {
+		t.Fatal("client.Get() = _, nil, want error")
+	}
+	if base.req != nil {
+		t.Error("request was sent with a replaced Authorization header")
+	}
+}
+
+func TestNewClient_MaxHeaderBytes(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxBytes int
+		wantErr  bool
+	}{
+		{name: "no limit"},
+		{name: "under limit", maxBytes: 1000},
+		{name: "over limit", maxBytes: 100, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := &recordingRT{}
+			client, err := NewClient(&Options{
+				BaseRoundTripper: base,
+				TokenProvider:    testutil.StaticTokenProvider("fakeToken"),
+				DisableTelemetry: true,
+				HeaderFunc: func(*http.Request) (http.Header, error) {
+					return http.Header{"Big": []string{strings.Repeat("a", 100)}}, nil
+				},
+				MaxHeaderBytes: tt.maxBytes,
+			})
+			if err != nil {
+				t.Fatalf("NewClient() = %v", err)
+			}
+			resp, err := client.Get("https://foo.googleapis.com")
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("client.Get() = %v", err)
+				}
+				resp.Body.Close()
+				return
+			}
+			if err == nil {
+				t.Fatal("client.Get() = _, nil, want error")
+			}
+			if !strings.Contains(err.Error(), `"Big"`) {
+				t.Errorf("got %v, want it to name the Big header", err)
+			}
+			if base.req != nil {
+				t.Error("request was sent with oversized headers")
+			}
+		})
+	}
+}
+
+func TestNewContextWithMetadata(t *testing.T) {
+	tests := []struct {
+		name    string
+		md      map[string]string
+		want    http.Header
+		wantErr bool
+	}{
+		{
+			name: "added",
+			md: map[string]string{
+				"x-goog-request-params": "name=foo",
+				"X-Goog-Static":         "dynamic",
+			},
+			want: http.Header{
+				"X-Goog-Request-Params": []string{"name=foo"},
+				"X-Goog-Static":         []string{"static", "dynamic"},
+			},
+		},
+		{
+			name:    "invalid key",
+			md:      map[string]string{"x goog": "foo"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid value",
+			md:      map[string]string{"x-goog-foo": "foo\r\nbar"},
+			wantErr: true,
+		},
+		{
+			name:    "authorization",
+			md:      map[string]string{"authorization": "Bearer other"},
+			wantErr: true,
+		},
+		{
+			name:    "host",
+			md:      map[string]string{"Host": "example.com"},
+			wantErr: true,
+		},
+		{
+			name:    "auth header name",
+			md:      map[string]string{"x-goog-iap-jwt-assertion": "other"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := &recordingRT{}
+			client, err := NewClient(&Options{
+				BaseRoundTripper: base,
+				TokenProvider:    testutil.StaticTokenProvider("fakeToken"),
+				Headers:          http.Header{"X-Goog-Static": []string{"static"}},
+				AuthHeaderName:   "X-Goog-Iap-Jwt-Assertion",
+			})
+			if err != nil {
+				t.Fatalf("NewClient() = %v", err)
+			}
+			ctx := NewContextWithMetadata(context.Background(), tt.md)
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://foo.googleapis.com", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Do(req)
+			if tt.wantErr {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("client.Do() = nil, want error")
+				}
+				if base.req != nil {
+					t.Error("request was sent, want it not to be")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("client.Do() = %v", err)
+			}
+			resp.Body.Close()
+			for k, want := range tt.want {
+				if got := base.req.Header.Values(k); !cmp.Equal(got, want) {
+					t.Errorf("%s: got %q, want %q", k, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewClient_QuotaProject(t *testing.T) {
+	tests := []struct {
+		name string
+		opts *Options
+		env  string
+		want string
+	}{
+		{
+			name: "field",
+			opts: &Options{
+				QuotaProjectID: "field",
+				TokenProvider:  testutil.StaticTokenProvider("fakeToken"),
+			},
+			want: "field",
+		},
+		{
+			name: "field takes precedence over env",
+			opts: &Options{
+				QuotaProjectID: "field",
+				TokenProvider:  testutil.StaticTokenProvider("fakeToken"),
+			},
+			env:  "env",
+			want: "field",
+		},
+		{
+			name: "field takes precedence over headers",
+			opts: &Options{
+				QuotaProjectID: "field",
+				Headers:        http.Header{quotaProjectHeaderKey: []string{"header"}},
+				TokenProvider:  testutil.StaticTokenProvider("fakeToken"),
+			},
+			want: "field",
+		},
+		{
+			name: "env fallback",
+			opts: &Options{
+				TokenProvider: testutil.StaticTokenProvider("fakeToken"),
+			},
+			env:  "env",
+			want: "env",
+		},
+		{
+			name: "api key",
+			opts: &Options{
+				QuotaProjectID: "field",
+				APIKey:         "thereisnospoon",
+			},
+			env:  "env",
+			want: "field",
+		},
+		{
+			name: "detected credentials",
+			opts: &Options{
+				QuotaProjectID: "field",
+				DetectOpts: &detect.Options{
+					Audience:         "aud",
+					CredentialsFile:  "../internal/testdata/sa.json",
+					UseSelfSignedJWT: true,
+				},
+			},
+			env:  "env",
+			want: "field",
+		},
+		{
+			name: "none",
+			opts: &Options{
+				TokenProvider: testutil.StaticTokenProvider("fakeToken"),
+			},
+		},
+		{
+			name: "disable authentication",
+			opts: &Options{
+				QuotaProjectID:        "field",
+				DisableAuthentication: true,
+			},
+			env: "env",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("GOOGLE_CLOUD_QUOTA_PROJECT", tt.env)
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if got := r.Header.Get(quotaProjectHeaderKey); got != tt.want {
+					t.Errorf("got %q, want %q", got, tt.want)
+				}
+			}))
+			defer ts.Close()
+			client, err := NewClient(tt.opts)
+			if err != nil {
+				t.Fatalf("NewClient() = %v", err)
+			}
+			resp, err := client.Get(ts.URL)
+			if err != nil {
+				t.Fatalf("client.Get() = %v", err)
+			}
+			resp.Body.Close()
+		})
+	}
+}
+
+func TestNewClient_DoesNotModifyHeaders(t *testing.T) {
+	t.Setenv("GOOGLE_CLOUD_QUOTA_PROJECT", "")
+	headers := http.Header{"Foo": []string{"bar"}}
+	if _, err := NewClient(&Options{
+		Headers:        headers,
+		QuotaProjectID: "field",
+		TokenProvider:  testutil.StaticTokenProvider("fakeToken"),
+	}); err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	if got := headers.Get(quotaProjectHeaderKey); got != "" {
+		t.Errorf("got %q, want user headers to be unmodified", got)
+	}
+}
+
+func TestNewClient_RetryOnUnauthorized(t *testing.T) {
+	tests := []struct {
+		name        string
+		disable     bool
+		alwaysFail  bool
+		body        func() io.Reader
+		wantCode    int
+		wantHits    int
+		wantFetches int
+	}{
+		{
+			name:        "retries with fresh token",
+			wantCode:    http.StatusOK,
+			wantHits:    2,
+			wantFetches: 2,
+		},
+		{
+			name:        "retry disabled",
+			disable:     true,
+			wantCode:    http.StatusUnauthorized,
+			wantHits:    1,
+			wantFetches: 1,
+		},
+		{
+			name:        "rewindable body",
+			body:        func() io.Reader { return strings.NewReader("hello") },
+			wantCode:    http.StatusOK,
+			wantHits:    2,
+			wantFetches: 2,
+		},
+		{
+			name:        "non-rewindable body",
+			body:        func() io.Reader { return io.MultiReader(strings.NewReader("hello")) },
+			wantCode:    http.StatusUnauthorized,
+			wantHits:    1,
+			wantFetches: 1,
+		},
+		{
+			name:        "retries only once",
+			alwaysFail:  true,
+			wantCode:    http.StatusUnauthorized,
+			wantHits:    2,
+			wantFetches: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits int
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits++
+				if tt.body != nil {
+					b, err := io.ReadAll(r.Body)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got, want := string(b), "hello"; got != want {
+						t.Errorf("got body %q, want %q", got, want)
+					}
+				}
+				if tt.alwaysFail || r.Header.Get("Authorization") == "Bearer token1" {
+					w.WriteHeader(http.StatusUnauthorized)
+				}
+			}))
+			defer ts.Close()
+			tp := &sequenceTP{}
+			client, err := NewClient(&Options{
+				TokenProvider:       tp,
+				RetryOnUnauthorized: !tt.disable,
+			})
+			if err != nil {
+				t.Fatalf("NewClient() = %v", err)
+			}
+			var body io.Reader
+			if tt.body != nil {
+				body = tt.body()
+			}
+			req, err := http.NewRequest(http.MethodPut, ts.URL, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("client.Do() = %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantCode {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.wantCode)
+			}
+			if hits != tt.wantHits {
+				t.Errorf("got %d requests, want %d", hits, tt.wantHits)
+			}
+			if tp.calls != tt.wantFetches {
+				t.Errorf("got %d token fetches, want %d", tp.calls, tt.wantFetches)
+			}
+		})
+	}
+}
+
+func TestNewClient_RetryDetectedCredentials(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      *Options
+		status    int
+		challenge string
+	}{
+		{
+			name:   "unauthorized",
+			opts:   &Options{RetryOnUnauthorized: true},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:      "invalid token challenge",
+			opts:      &Options{RetryOnInvalidTokenChallenge: true},
+			status:    http.StatusForbidden,
+			challenge: `Bearer error="invalid_token"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens := newTokenServer(t, 3600)
+			var got []string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = append(got, r.Header.Get("Authorization"))
+				if r.Header.Get("Authorization") == "Bearer tok1" {
+					if tt.challenge != "" {
+						w.Header().Set("WWW-Authenticate", tt.challenge)
+					}
+					w.WriteHeader(tt.status)
+				}
+			}))
+			defer ts.Close()
+			tt.opts.DetectOpts = &detect.Options{
+				CredentialsJSON: serviceAccountJSON(t, tokens.URL),
+				Scopes:          []string{"a"},
+			}
+			client, err := NewClient(tt.opts)
+			if err != nil {
+				t.Fatalf("NewClient() = %v", err)
+			}
+			resp, err := client.Get(ts.URL)
+			if err != nil {
+				t.Fatalf("client.Get() = %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+			if want := []string{"Bearer tok1", "Bearer tok2"}; !cmp.Equal(got, want) {
+				t.Errorf("got Authorization headers %q, want %q", got, want)
+			}
+			if n := tokens.fetches(); n != 2 {
+				t.Errorf("got %d token fetches, want 2", n)
+			}
+		})
+	}
+}
+
+func TestNewClient_RetryOnInvalidTokenChallenge(t *testing.T) {
+	tests := []struct {
+		name       string
+		disable    bool
+		alwaysFail bool
+		status     int
+		challenge  string
+		wantCode   int
+		wantHits   int
+	}{
+		{
+			name:      "retries with fresh token",
+			status:    http.StatusForbidden,
+			challenge: `Bearer realm="example", error="invalid_token", error_description="The access token expired"`,
+			wantCode:  http.StatusOK,
+			wantHits:  2,
+		},
+		{
+			name:      "retry disabled",
+			disable:   true,
+			status:    http.StatusForbidden,
+			challenge: `Bearer error="invalid_token"`,
+			wantCode:  http.StatusForbidden,
+			wantHits:  1,
+		},
+		{
+			name:      "other error",
+			status:    http.StatusForbidden,
+			challenge: `Bearer error="insufficient_scope", scope="foo"`,
+			wantCode:  http.StatusForbidden,
+			wantHits:  1,
+		},
+		{
+			name:     "unauthorized without challenge",
+			status:   http.StatusUnauthorized,
+			wantCode: http.StatusUnauthorized,
+			wantHits: 1,
+		},
+		{
+			name:       "retries only once",
+			alwaysFail: true,
+			status:     http.StatusUnauthorized,
+			challenge:  `Basic realm="foo", bearer error=invalid_token`,
+			wantCode:   http.StatusUnauthorized,
+			wantHits:   2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits int
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits++
+				if tt.alwaysFail || r.Header.Get("Authorization") == "Bearer token1" {
+					if tt.challenge != "" {
+						w.Header().Set("WWW-Authenticate", tt.challenge)
+					}
+					w.WriteHeader(tt.status)
+				}
+			}))
+			defer ts.Close()
+			client, err := NewClient(&Options{
+				TokenProvider:                &sequenceTP{},
+				RetryOnInvalidTokenChallenge: !tt.disable,
+			})
+			if err != nil {
+				t.Fatalf("NewClient() = %v", err)
+			}
+			resp, err := client.Get(ts.URL)
+			if err != nil {
+				t.Fatalf("client.Get() = %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantCode {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.wantCode)
+			}
+			if hits != tt.wantHits {
+				t.Errorf("got %d hits, want %d", hits, tt.wantHits)
+			}
+		})
+	}
+}
+
+func TestParseChallenges(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []challenge
+	}{
+		{
+			in: `Bearer`,
+			want: []challenge{
+				{scheme: "Bearer", params: map[string]string{}},
+			},
+		},
+		{
+			in: `Bearer realm="a, \"b\"", Error = invalid_token, Basic realm=c`,
+			want: []challenge{
+				{scheme: "Bearer", params: map[string]string{"realm": `a, "b"`, "error": "invalid_token"}},
+				{scheme: "Basic", params: map[string]string{"realm": "c"}},
+			},
+		},
+		{
+			in: `Bearer error="invalid_token`,
+			want: []challenge{
+				{scheme: "Bearer", params: map[string]string{}},
+			},
+		},
+		{
+			in: `realm="a"`,
+		},
+	}
+	for _, tt := range tests {
+		got := parseChallenges(tt.in)
+		if diff := cmp.Diff(tt.want, got, cmp.AllowUnexported(challenge{})); diff != "" {
+			t.Errorf("parseChallenges(%q) mismatch (-want +got):\n%s", tt.in, diff)
+		}
+	}
+}
+
+func TestOptions_CheckCredentials(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    *Options
+		wantErr string
+	}{
+		{
+			name: "token provider",
+			opts: &Options{
+				TokenProvider: testutil.StaticTokenProvider("fakeToken"),
+			},
+		},
+		{
+			name: "failing token provider",
+			opts: &Options{
+				TokenProvider: &fixedTP{err: errors.New("no token")},
+			},
+			wantErr: "no token",
+		},
+		{
+			name: "missing credentials file",
+			opts: &Options{
+				DetectOpts: &detect.Options{
+					CredentialsFile: "../internal/testdata/does-not-exist.json",
+				},
+			},
+			wantErr: "does-not-exist.json",
+		},
+		{
+			name: "detected credentials",
+			opts: &Options{
+				DetectOpts: &detect.Options{
+					Audience:         "aud",
+					CredentialsFile:  "../internal/testdata/sa.json",
+					UseSelfSignedJWT: true,
+				},
+			},
+		},
+		{
+			name: "api key",
+			opts: &Options{
+				APIKey: "thereisnospoon",
+			},
+		},
+		{
+			name: "disable authentication",
+			opts: &Options{
+				DisableAuthentication: true,
+			},
+		},
+		{
+			name: "invalid options",
+			opts: &Options{
+				APIKey:                "thereisnospoon",
+				DisableAuthentication: true,
+			},
+			wantErr: "DisableAuthentication is incompatible",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.CheckCredentials(context.Background())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("CheckCredentials() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("CheckCredentials() = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    *Options
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "token provider",
+			opts: &Options{
+				TokenProvider: testutil.StaticTokenProvider("fakeToken"),
+			},
+			want: "fakeToken",
+		},
+		{
+			name: "detected credentials",
+			opts: &Options{
+				DetectOpts: &detect.Options{
+					Audience:         "aud",
+					CredentialsFile:  "../internal/testdata/sa.json",
+					UseSelfSignedJWT: true,
+				},
+			},
+		},
+		{
+			name:    "invalid options",
+			wantErr: true,
+		},
+		{
+			name: "disable authentication",
+			opts: &Options{
+				DisableAuthentication: true,
+			},
+			wantErr: true,
+		},
+		{
+			name: "api key",
+			opts: &Options{
+				APIKey: "thereisnospoon",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tok, err := Token(context.Background(), tt.opts)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Token() = nil, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Token() = %v", err)
+			}
+			if !tok.IsValid() {
+				t.Fatalf("got invalid token %+v", tok)
+			}
+			if tt.want != "" && tok.Value != tt.want {
+				t.Errorf("got %q, want %q", tok.Value, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenSource(t *testing.T) {
+	expiry := time.Now().Add(time.Hour).Round(0)
+	ts, err := TokenSource(context.Background(), &Options{
+		TokenProvider: &fixedTP{tok: &auth.Token{
+			Value:    "fakeToken",
+			Type:     "MAC",
+			Expiry:   expiry,
+			Metadata: map[string]interface{}{"id_token": "fakeIDToken"},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("TokenSource() = %v", err)
+	}
+	tok, err := ts.Token()
+	if err != nil {
+		t.Fatalf("Token() = %v", err)
+	}
+	if tok.AccessToken != "fakeToken" {
+		t.Errorf("got AccessToken %q, want %q", tok.AccessToken, "fakeToken")
+	}
+	if tok.TokenType != "MAC" {
+		t.Errorf("got TokenType %q, want %q", tok.TokenType, "MAC")
+	}
+	if !tok.Expiry.Equal(expiry) {
+		t.Errorf("got Expiry %v, want %v", tok.Expiry, expiry)
+	}
+	if got := tok.Extra("id_token"); got != "fakeIDToken" {
+		t.Errorf("got Extra(id_token) %v, want %q", got, "fakeIDToken")
+	}
+
+	for _, opts := range []*Options{
+		nil,
+		{DisableAuthentication: true},
+		{APIKey: "thereisnospoon"},
+	} {
+		if _, err := TokenSource(context.Background(), opts); err == nil {
+			t.Errorf("TokenSource(%+v) = nil, want error", opts)
+		}
+	}
+}
+
+func TestNewClient_ContextScopes(t *testing.T) {
+	var gotTokens []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotTokens = append(gotTokens, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	}))
+	defer ts.Close()
+	client, err := NewClient(&Options{
+		InternalOptions: &InternalOptions{
+			EnableJWTWithScope: true,
+		},
+		DetectOpts: &detect.Options{
+			Scopes:          []string{"default"},
+			CredentialsFile: "../internal/testdata/sa.json",
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	ctxs := []context.Context{
+		context.Background(),
+		NewContextWithScopes(context.Background(), "a", "b"),
+		NewContextWithScopes(context.Background(), "b", "a", "a"),
+		NewContextWithScopes(context.Background()),
+	}
+	for _, ctx := range ctxs {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("client.Do() = %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	var gotScopes []string
+	for _, tok := range gotTokens {
+		claims, err := jwt.DecodeJWS(tok)
+		if err != nil {
+			t.Fatalf("jwt.DecodeJWS() = %v", err)
+		}
+		gotScopes = append(gotScopes, claims.Scope)
+	}
+	if diff := cmp.Diff([]string{"default", "a b", "a b", "default"}, gotScopes); diff != "" {
+		t.Errorf("scopes mismatch (-want +got):\n%s", diff)
+	}
+	if gotTokens[1] != gotTokens[2] {
+		t.Errorf("tokens for the same set of scopes were not cached")
+	}
+	if gotTokens[0] != gotTokens[3] {
+		t.Errorf("tokens for the default scopes were not cached")
+	}
+}
+
+func TestNewClient_OptionsModifiedAfterwards(t *testing.T) {
+	rt := &recordingRT{}
+	opts := &Options{
+		InternalOptions: &InternalOptions{
+			EnableJWTWithScope: true,
+		},
+		DetectOpts: &detect.Options{
+			CredentialsFile: "../internal/testdata/sa.json",
+		},
+		Headers:          http.Header{"Foo": []string{"bar"}},
+		BaseRoundTripper: rt,
+	}
+	client, err := NewClient(opts)
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	opts.DetectOpts.CredentialsFile = "does-not-exist.json"
+	opts.DetectOpts.CredentialsJSON = []byte(`{"type": "bogus"}`)
+	opts.Headers.Set("Foo", "baz")
+	req, err := http.NewRequestWithContext(NewContextWithScopes(context.Background(), "a"), http.MethodGet, "https://foo.googleapis.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("client.Do() = %v", err)
+	}
+	resp.Body.Close()
+	if got := rt.req.Header.Get("Foo"); got != "bar" {
+		t.Errorf("got Foo %q, want %q", got, "bar")
+	}
+}
+
+func TestRequestWithScopes(t *testing.T) {
+	var gotScopes []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := jwt.DecodeJWS(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if err != nil {
+			t.Errorf("jwt.DecodeJWS() = %v", err)
+			return
+		}
+		gotScopes = append(gotScopes, claims.Scope)
+	}))
+	defer ts.Close()
+	client, err := NewClient(&Options{
+		InternalOptions: &InternalOptions{
+			EnableJWTWithScope: true,
+		},
+		DetectOpts: &detect.Options{
+			Scopes:          []string{"default"},
+			CredentialsFile: "../internal/testdata/sa.json",
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	req, err := http.NewRequestWithContext(NewContextWithScopes(context.Background(), "c"), http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []*http.Request{
+		RequestWithScopes(req, "a", "b"),
+		req,
+		RequestWithScopes(req),
+		RequestWithScopes(req, "a").WithContext(NewContextWithScopes(context.Background(), "b")),
+	} {
+		resp, err := client.Do(r)
+		if err != nil {
+			t.Fatalf("client.Do() = %v", err)
+		}
+		resp.Body.Close()
+	}
+	if diff := cmp.Diff([]string{"a b", "c", "default", "b"}, gotScopes); diff != "" {
+		t.Errorf("scopes mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestNewClient_AudienceForHost(t *testing.T) {
+	rt := &recordingRT{}
+	client, err := NewClient(&Options{
+		BaseRoundTripper: rt,
+		DetectOpts: &detect.Options{
+			Audience:        "default-aud",
+			CredentialsFile: "../internal/testdata/sa.json",
+		},
+		AudienceForHost: map[string]string{
+			"Foo.googleapis.com":      "foo-aud",
+			"bar.googleapis.com:8443": "bar-aud",
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	tests := []struct {
+		url     string
+		wantAud string
+	}{
+		{url: "https://foo.googleapis.com/v1/foo", wantAud: "foo-aud"},
+		{url: "https://FOO.googleapis.com/v1/foo", wantAud: "foo-aud"},
+		{url: "https://bar.googleapis.com:8443/v1/bar", wantAud: "bar-aud"},
+		{url: "https://bar.googleapis.com/v1/bar", wantAud: "default-aud"},
+		{url: "https://baz.googleapis.com/v1/baz", wantAud: "default-aud"},
+	}
+	for _, tt := range tests {
+		resp, err := client.Get(tt.url)
+		if err != nil {
+			t.Fatalf("client.Get() = %v", err)
+		}
+		resp.Body.Close()
+		claims, err := jwt.DecodeJWS(strings.TrimPrefix(rt.req.Header.Get("Authorization"), "Bearer "))
+		if err != nil {
+			t.Fatalf("jwt.DecodeJWS() = %v", err)
+		}
+		if claims.Aud != tt.wantAud {
+			t.Errorf("%s: got audience %q, want %q", tt.url, claims.Aud, tt.wantAud)
+		}
+	}
+}
+
+func TestNewClient_ContextScopesTokenProvider(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	client, err := NewClient(&Options{
+		TokenProvider: testutil.StaticTokenProvider("fakeToken"),
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	req, err := http.NewRequestWithContext(NewContextWithScopes(context.Background(), "a"), http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Do(req); err == nil {
+		t.Fatal("client.Do() = nil, want error")
+	}
+}
+
+func TestNewClient_Logf(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "Bearer token1" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer ts.Close()
+	tests := []struct {
+		name       string
+		opts       *Options
+		wantLog    []string
+		wantNotLog []string
+	}{
+		{
+			name: "token",
+			opts: &Options{
+				TokenProvider:       &sequenceTP{},
+				RetryOnUnauthorized: true,
+			},
+			wantLog:    []string{"GET", ts.URL, "status=200", "Authorization:[REDACTED]"},
+			wantNotLog: []string{"token1", "token2"},
+		},
+		{
+			name: "api key",
+			opts: &Options{
+				APIKey: "thereisnospoon",
+			},
+			wantLog:    []string{"GET", "key=REDACTED", "status=200"},
+			wantNotLog: []string{"thereisnospoon"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs []string
+			tt.opts.Logf = func(format string, args ...interface{}) {
+				logs = append(logs, fmt.Sprintf(format, args...))
+			}
+			client, err := NewClient(tt.opts)
+			if err != nil {
+				t.Fatalf("NewClient() = %v", err)
+			}
+			resp, err := client.Get(ts.URL)
+			if err != nil {
+				t.Fatalf("client.Get() = %v", err)
+			}
+			resp.Body.Close()
+			if len(logs) != 1 {
+				t.Fatalf("got %d log lines, want 1: %q", len(logs), logs)
+			}
+			for _, want := range tt.wantLog {
+				if !strings.Contains(logs[0], want) {
+					t.Errorf("log %q does not contain %q", logs[0], want)
+				}
+			}
+			for _, notWant := range tt.wantNotLog {
+				if strings.Contains(logs[0], notWant) {
+					t.Errorf("log %q contains %q", logs[0], notWant)
+				}
+			}
+		})
+	}
+}
+
+func TestNewClient_UniverseDomain(t *testing.T) {
+	b, err := os.ReadFile("../internal/testdata/sa.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	m["universe_domain"] = "example.com"
+	ub, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		opts    *Options
+		json    []byte
+		wantErr bool
+	}{
+		{
+			name: "default universe",
+			opts: &Options{},
+			json: b,
+		},
+		{
+			name: "matching universe",
+			opts: &Options{UniverseDomain: "example.com"},
+			json: ub,
+		},
+		{
+			name: "matching default universe",
+			opts: &Options{InternalOptions: &InternalOptions{DefaultUniverseDomain: "example.com"}},
+			json: ub,
+		},
+		{
+			name:    "configured universe does not match credentials",
+			opts:    &Options{UniverseDomain: "example.com"},
+			json:    b,
+			wantErr: true,
+		},
+		{
+			name:    "credentials universe does not match default",
+			opts:    &Options{},
+			json:    ub,
+			wantErr: true,
+		},
+		{
+			name: "token provider is not checked",
+			opts: &Options{
+				UniverseDomain: "example.com",
+				TokenProvider:  testutil.StaticTokenProvider("fakeToken"),
+			},
+		},
+		{
+			name: "external account options are not checked",
+			opts: &Options{
+				UniverseDomain: "example.com",
+				DetectOpts: &detect.Options{
+					ExternalAccount: &detect.ExternalAccountOptions{
+						Audience:         "//iam.example.com/projects/123/locations/global/workloadIdentityPools/pool/providers/provider",
+						SubjectTokenType: "urn:ietf:params:oauth:token-type:jwt",
+						SubjectTokenSupplier: func(context.Context) (string, error) {
+							return "fakeSubjectToken", nil
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "external account file without universe is not checked",
+			opts: &Options{
+				UniverseDomain: "example.com",
+				DetectOpts: &detect.Options{
+					CredentialsFile: "../internal/testdata/exaccount_file.json",
+				},
+			},
+		},
+		{
+			name: "external account file universe does not match",
+			opts: &Options{
+				UniverseDomain: "example.com",
+				DetectOpts: &detect.Options{
+					CredentialsJSON: []byte(`{"type": "external_account", "audience": "aud", "subject_token_type": "urn:ietf:params:oauth:token-type:jwt", "token_url": "https://sts.googleapis.com/v1/token", "credential_source": {"file": "token"}, "universe_domain": "googleapis.com"}`),
+				},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.json != nil {
+				tt.opts.DetectOpts = &detect.Options{
+					Audience:         "aud",
+					CredentialsJSON:  tt.json,
+					UseSelfSignedJWT: true,
+				}
+			}
+			_, err := NewClient(tt.opts)
+			if tt.wantErr && err == nil {
+				t.Fatal("NewClient() = nil, want error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("NewClient() = %v", err)
+			}
+		})
+	}
+}
+
+func TestNewClient_TokenFetchRespectsContext(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request should not have been sent")
+	}))
+	defer ts.Close()
+	tests := []struct {
+		name string
+		tp   auth.TokenProvider
+	}{
+		{name: "provider returns context error", tp: blockingTP{}},
+		{name: "provider returns other error", tp: blockingTP{err: errors.New("metadata: request canceled")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := NewClient(&Options{
+				TokenProvider: tt.tp,
+			})
+			if err != nil {
+				t.Fatalf("NewClient() = %v", err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = client.Do(req)
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("client.Do() = %v, want error wrapping %v", err, context.DeadlineExceeded)
+			}
+		})
+	}
+}
+
+// blockingTP blocks until the context is done, then fails with err or, if
+// it is nil, the error of the context.
+type blockingTP struct {
+	err error
+}
+
+func (tp blockingTP) Token(ctx context.Context) (*auth.Token, error) {
+	<-ctx.Done()
+	if tp.err != nil {
+		return nil, tp.err
+	}
+	return nil, ctx.Err()
+}
+
+func TestNewClient_Impersonation(t *testing.T) {
+	iam := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.URL.Path, "/v1/projects/-/serviceAccounts/target@example.com:generateAccessToken"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		if got := r.Header.Get("Authorization"); got == "" {
+			t.Error("source credentials were not used")
+		}
+		var body struct {
+			Delegates []string `json:"delegates"`
+			Scope     []string `json:"scope"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff([]string{"projects/-/serviceAccounts/a@example.com", "projects/-/serviceAccounts/b@example.com"}, body.Delegates); diff != "" {
+			t.Errorf("delegates mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff([]string{"scope"}, body.Scope); diff != "" {
+			t.Errorf("scope mismatch (-want +got):\n%s", diff)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"accessToken":"impersonated","expireTime":%q}`, time.Now().Add(time.Hour).Format(time.RFC3339))
+	}))
+	defer iam.Close()
+	oldEndpoint := iamCredentialsEndpoint
+	iamCredentialsEndpoint = func(string) string { return iam.URL }
+	defer func() { iamCredentialsEndpoint = oldEndpoint }()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.Header.Get("Authorization"), "Bearer impersonated"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name string
+		opts *Options
+	}{
+		{
+			name: "token provider",
+			opts: &Options{
+				TokenProvider: testutil.StaticTokenProvider("source"),
+				DetectOpts: &detect.Options{
+					Scopes: []string{"scope"},
+				},
+			},
+		},
+		{
+			name: "detected credentials",
+			opts: &Options{
+				InternalOptions: &InternalOptions{
+					EnableJWTWithScope: true,
+				},
+				DetectOpts: &detect.Options{
+					Scopes:          []string{"scope"},
+					CredentialsFile: "../internal/testdata/sa.json",
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.ImpersonateServiceAccount = "target@example.com"
+			tt.opts.ImpersonateDelegates = []string{"a@example.com", "projects/-/serviceAccounts/b@example.com"}
+			client, err := NewClient(tt.opts)
+			if err != nil {
+				t.Fatalf("NewClient() = %v", err)
+			}
+			resp, err := client.Get(ts.URL)
+			if err != nil {
+				t.Fatalf("client.Get() = %v", err)
+			}
+			resp.Body.Close()
+		})
+	}
+}
+
+func TestNewClient_Endpoint(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    *Options
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "bare host defaults to https",
+			opts: &Options{
+				Endpoint:      "my-service.example.com",
+				TokenProvider: testutil.StaticTokenProvider("fakeToken"),
+			},
+			want: "https://my-service.example.com/v1/foo",
+		},
+		{
+			name: "trailing slash",
+			opts: &Options{
+				Endpoint:      "https://my-service.example.com/",
+				TokenProvider: testutil.StaticTokenProvider("fakeToken"),
+			},
+			want: "https://my-service.example.com/v1/foo",
+		},
+		{
+			name: "http with credentials",
+			opts: &Options{
+				Endpoint:      "http://my-service.example.com",
+				TokenProvider: testutil.StaticTokenProvider("fakeToken"),
+			},
+			wantErr: true,
+		},
+		{
+			name: "http with api key",
+			opts: &Options{
+				Endpoint: "http://my-service.example.com",
+				APIKey:   "thereisnospoon",
+			},
+			wantErr: true,
+		},
+		{
+			name: "http with AllowInsecureEndpoint",
+			opts: &Options{
+				Endpoint:              "http://my-service.example.com",
+				AllowInsecureEndpoint: true,
+				TokenProvider:         testutil.StaticTokenProvider("fakeToken"),
+			},
+			want: "http://my-service.example.com/v1/foo",
+		},
+		{
+			name: "http without authentication",
+			opts: &Options{
+				Endpoint:              "http://my-service.example.com",
+				DisableAuthentication: true,
+			},
+			want: "http://my-service.example.com/v1/foo",
+		},
+		{
+			name: "missing host",
+			opts: &Options{
+				Endpoint:      "https://",
+				TokenProvider: testutil.StaticTokenProvider("fakeToken"),
+			},
+			wantErr: true,
+		},
+		{
+			name: "unsupported scheme",
+			opts: &Options{
+				Endpoint:      "ftp://my-service.example.com",
+				TokenProvider: testutil.StaticTokenProvider("fakeToken"),
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := &recordingRT{}
+			tt.opts.BaseRoundTripper = base
+			tt.opts.InternalOptions = &InternalOptions{
+				DefaultEndpoint: "https://foo.googleapis.com",
+			}
+			client, err := NewClient(tt.opts)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("NewClient() = _, nil, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewClient() = %v", err)
+			}
+			resp, err := client.Get("https://foo.googleapis.com/v1/foo")
+			if err != nil {
+				t.Fatalf("client.Get() = %v", err)
+			}
+			resp.Body.Close()
+			if got := base.req.URL.String(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolvedEndpoint(t *testing.T) {
+	certProvider := func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return &tls.Certificate{}, nil
+	}
+	io := &InternalOptions{
+		DefaultEndpoint:     "https://foo.googleapis.com",
+		DefaultMTLSEndpoint: "https://foo.mtls.googleapis.com",
+	}
+	tests := []struct {
+		name    string
+		opts    *Options
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "no endpoint",
+			opts: &Options{
+				TokenProvider: testutil.StaticTokenProvider("fakeToken"),
+			},
+			want: "",
+		},
+		{
+			name: "default endpoint",
+			opts: &Options{
+				TokenProvider:   testutil.StaticTokenProvider("fakeToken"),
+				InternalOptions: io,
+			},
+			want: "https://foo.googleapis.com",
+		},
+		{
+			name: "mTLS endpoint",
+			opts: &Options{
+				TokenProvider:      testutil.StaticTokenProvider("fakeToken"),
+				ClientCertProvider: certProvider,
+				InternalOptions:    io,
+			},
+			want: "https://foo.mtls.googleapis.com",
+		},
+		{
+			name: "universe domain",
+			opts: &Options{
+				TokenProvider:   testutil.StaticTokenProvider("fakeToken"),
+				UniverseDomain:  "example.com",
+				InternalOptions: io,
+			},
+			want: "https://foo.example.com",
+		},
+		{
+			name: "endpoint merged with default",
+			opts: &Options{
+				TokenProvider:   testutil.StaticTokenProvider("fakeToken"),
+				Endpoint:        "eu-foo.example.com:8443",
+				InternalOptions: io,
+			},
+			want: "https://eu-foo.example.com:8443",
+		},
+		{
+			name: "endpoint takes precedence over mTLS",
+			opts: &Options{
+				TokenProvider:      testutil.StaticTokenProvider("fakeToken"),
+				Endpoint:           "https://eu-foo.example.com/",
+				ClientCertProvider: certProvider,
+				InternalOptions:    io,
+			},
+			want: "https://eu-foo.example.com",
+		},
+		{
+			name: "invalid endpoint",
+			opts: &Options{
+				TokenProvider: testutil.StaticTokenProvider("fakeToken"),
+				Endpoint:      "http://my-service.example.com",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ResolvedEndpoint(tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ResolvedEndpoint() = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewClient_EndpointOverrides(t *testing.T) {
+	base := &recordingRT{}
+	client, err := NewClient(&Options{
+		BaseRoundTripper: base,
+		TokenProvider:    testutil.StaticTokenProvider("fakeToken"),
+		Endpoint:         "https://override.example.com",
+		EndpointOverrides: map[string]string{
+			"Foo.googleapis.com":     "https://eu-foo.example.com",
+			"bar.googleapis.com":     "eu-bar.example.com:8443",
+			"baz.googleapis.com:444": "https://eu-baz.example.com",
+		},
+		InternalOptions: &InternalOptions{
+			DefaultEndpoint: "https://foo.googleapis.com",
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: "https://FOO.googleapis.com/v1/foo?a=b", want: "https://eu-foo.example.com/v1/foo?a=b"},
+		{url: "https://bar.googleapis.com/v1/bar", want: "https://eu-bar.example.com:8443/v1/bar"},
+		{url: "https://baz.googleapis.com:444/v1/baz", want: "https://eu-baz.example.com/v1/baz"},
+		{url: "https://baz.googleapis.com/v1/baz", want: "https://baz.googleapis.com/v1/baz"},
+		{url: "https://other.googleapis.com/v1/other", want: "https://other.googleapis.com/v1/other"},
+	}
+	for _, tt := range tests {
+		resp, err := client.Get(tt.url)
+		if err != nil {
+			t.Fatalf("client.Get(%q) = %v", tt.url, err)
+		}
+		resp.Body.Close()
+		if got := base.req.URL.String(); got != tt.want {
+			t.Errorf("client.Get(%q): got %q, want %q", tt.url, got, tt.want)
+		}
+	}
+
+	for _, overrides := range []map[string]string{
+		{"foo.googleapis.com": "http://eu-foo.example.com"},
+		{"": "https://eu-foo.example.com"},
+		{"foo.googleapis.com": "https://"},
+	} {
+		if _, err := NewClient(&Options{
+			TokenProvider:     testutil.StaticTokenProvider("fakeToken"),
+			EndpointOverrides: overrides,
+		}); err == nil {
+			t.Errorf("NewClient() with EndpointOverrides %v = _, nil, want error", overrides)
+		}
+	}
+}
+
+func TestNewClient_BaseRoundTripper(t *testing.T) {
+	base := &recordingRT{}
+	client, err := NewClient(&Options{
+		BaseRoundTripper: base,
+		Endpoint:         "https://override.example.com",
+		Headers:          http.Header{"Foo": []string{"bar"}},
+		TokenProvider:    testutil.StaticTokenProvider("fakeToken"),
+		InternalOptions: &InternalOptions{
+			DefaultEndpoint: "https://foo.googleapis.com",
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	resp, err := client.Get("https://foo.googleapis.com/v1/foo")
+	if err != nil {
+		t.Fatalf("client.Get() = %v", err)
+	}
+	resp.Body.Close()
+	if base.req == nil {
+		t.Fatal("base RoundTripper was not used")
+	}
+	if got, want := base.req.URL.String(), "https://override.example.com/v1/foo"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := base.req.Header.Get("Authorization"), "Bearer fakeToken"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := base.req.Header.Get("Foo"), "bar"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestNewClient_CompressRequests(t *testing.T) {
+	large := strings.Repeat("a", 100)
+	tests := []struct {
+		name string
+		body func() io.Reader
+		// unknownLength sends body with an unknown length and, if
+		// replayable is set, a GetBody returning it.
+		unknownLength bool
+		replayable    bool
+		encoding      string
+		wantEncoding  string
+		wantHits      int
+	}{
+		{
+			name:         "large body",
+			body:         func() io.Reader { return strings.NewReader(large) },
+			wantEncoding: "gzip",
+			wantHits:     2,
+		},
+		{
+			name:          "large body, unknown length",
+			body:          func() io.Reader { return strings.NewReader(large + large) },
+			unknownLength: true,
+			replayable:    true,
+			wantEncoding:  "gzip",
+			wantHits:      2,
+		},
+		{
+			name:          "large body, unknown length, not replayable",
+			body:          func() io.Reader { return strings.NewReader(large) },
+			unknownLength: true,
+			wantHits:      1,
+		},
+		{
+			name:     "small body",
+			body:     func() io.Reader { return strings.NewReader("a") },
+			wantHits: 2,
+		},
+		{
+			name:          "small body, unknown length",
+			body:          func() io.Reader { return strings.NewReader("a") },
+			unknownLength: true,
+			replayable:    true,
+			wantHits:      2,
+		},
+		{
+			name:         "already encoded",
+			body:         func() io.Reader { return strings.NewReader(large) },
+			encoding:     "identity",
+			wantEncoding: "identity",
+			wantHits:     2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := io.ReadAll(tt.body())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var hits int
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits++
+				if got := r.Header.Get("Content-Encoding"); got != tt.wantEncoding {
+					t.Errorf("got encoding %q, want %q", got, tt.wantEncoding)
+				}
+				var body io.Reader = r.Body
+				if tt.wantEncoding == "gzip" {
+					zr, err := gzip.NewReader(r.Body)
+					if err != nil {
+						t.Fatal(err)
+					}
+					body = zr
+				}
+				got, err := io.ReadAll(body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != string(want) {
+					t.Errorf("got body %q, want %q", got, want)
+				}
+				// Force a retry of the first attempt to check the body can
+				// be replayed.
+				if hits == 1 {
+					w.WriteHeader(http.StatusUnauthorized)
+				}
+			}))
+			defer ts.Close()
+			client, err := NewClient(&Options{
+				TokenProvider:       testutil.StaticTokenProvider("fakeToken"),
+				RetryOnUnauthorized: true,
+				CompressRequests:    true,
+				CompressMinBytes:    len(large),
+			})
+			if err != nil {
+				t.Fatalf("NewClient() = %v", err)
+			}
+			req, err := http.NewRequest(http.MethodPut, ts.URL, tt.body())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.unknownLength {
+				req.ContentLength = 0
+				req.Body = io.NopCloser(tt.body())
+				req.GetBody = nil
+				if tt.replayable {
+					req.GetBody = func() (io.ReadCloser, error) {
+						return io.NopCloser(tt.body()), nil
+					}
+				}
+			}
+			if tt.encoding != "" {
+				req.Header.Set("Content-Encoding", tt.encoding)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("client.Do() = %v", err)
+			}
+			resp.Body.Close()
+			if hits != tt.wantHits {
+				t.Errorf("got %d requests, want %d", hits, tt.wantHits)
+			}
+		})
+	}
+}
+
+func TestNewClient_TokenObserver(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	tests := []struct {
+		name       string
+		tp         auth.TokenProvider
+		wantCached []bool
+		wantErr    bool
+	}{
+		{
+			name:       "fetch then cache",
+			tp:         &countingTP{expiresIn: time.Hour},
+			wantCached: []bool{false, true},
+		},
+		{
+			name:       "error",
+			tp:         &fixedTP{err: errors.New("no token")},
+			wantCached: []bool{false, false},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var events []TokenEvent
+			client, err := NewClient(&Options{
+				TokenProvider: tt.tp,
+				TokenObserver: func(e TokenEvent) {
+					events = append(events, e)
+				},
+			})
+			if err != nil {
+				t.Fatalf("NewClient() = %v", err)
+			}
+			for range tt.wantCached {
+				resp, err := client.Get(ts.URL)
+				if err == nil {
+					resp.Body.Close()
+				}
+			}
+			if len(events) != len(tt.wantCached) {
+				t.Fatalf("got %d events, want %d", len(events), len(tt.wantCached))
+			}
+			for i, e := range events {
+				if e.Cached != tt.wantCached[i] {
+					t.Errorf("event %d: got Cached %v, want %v", i, e.Cached, tt.wantCached[i])
+				}
+				if (e.Err != nil) != tt.wantErr {
+					t.Errorf("event %d: got Err %v, want error %v", i, e.Err, tt.wantErr)
+				}
+				if e.Duration <= 0 {
+					t.Errorf("event %d: got Duration %v, want > 0", i, e.Duration)
+				}
+			}
+		})
+	}
+}
+
+func TestNewClient_TokenObserverDetectedCredentials(t *testing.T) {
+	tokens := newTokenServer(t, 3600)
+	var events []TokenEvent
+	client, err := NewClient(&Options{
+		DetectOpts: &detect.Options{
+			CredentialsJSON: serviceAccountJSON(t, tokens.URL),
+			Scopes:          []string{"a"},
+		},
+		// Tokens are still cached by the detected credentials.
+		DisableTokenCache: true,
+		TokenObserver: func(e TokenEvent) {
+			events = append(events, e)
+		},
+		BaseRoundTripper: &recordingRT{},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get("https://foo.googleapis.com")
+		if err != nil {
+			t.Fatalf("client.Get() = %v", err)
+		}
+		resp.Body.Close()
+	}
+	var got []bool
+	for _, e := range events {
+		got = append(got, e.Cached)
+	}
+	if want := []bool{false, true}; !cmp.Equal(got, want) {
+		t.Errorf("got Cached %v, want %v", got, want)
+	}
+}
+
+func TestNewClient_SkipAuthForHosts(t *testing.T) {
+	rt := &recordingRT{}
+	client, err := NewClient(&Options{
+		TokenProvider:    testutil.StaticTokenProvider("fakeToken"),
+		BaseRoundTripper: rt,
+		SkipAuthForHosts: []string{"direct.googleapis.com", "*.internal"},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: "https://direct.googleapis.com/v1", want: ""},
+		{url: "https://DIRECT.googleapis.com:443/v1", want: ""},
+		{url: "https://foo.internal/v1", want: ""},
+		{url: "https://foo.bar.internal/v1", want: ""},
+		{url: "https://internal/v1", want: "Bearer fakeToken"},
+		{url: "https://foointernal/v1", want: "Bearer fakeToken"},
+		{url: "https://other.googleapis.com/v1", want: "Bearer fakeToken"},
+	}
+	for _, tt := range tests {
+		resp, err := client.Get(tt.url)
+		if err != nil {
+			t.Fatalf("Get(%q) = %v", tt.url, err)
+		}
+		resp.Body.Close()
+		if got := rt.req.Header.Get("Authorization"); got != tt.want {
+			t.Errorf("Get(%q): got Authorization %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestNewClient_SkipAuthForHostsAPIKey(t *testing.T) {
+	for _, placement := range []APIKeyPlacement{APIKeyPlacementQueryParam, APIKeyPlacementHeader} {
+		rt := &recordingRT{}
+		client, err := NewClient(&Options{
+			APIKey:           "secret",
+			APIKeyPlacement:  placement,
+			BaseRoundTripper: rt,
+			SkipAuthForHosts: []string{"internal.example.com"},
+		})
+		if err != nil {
+			t.Fatalf("NewClient() = %v", err)
+		}
+		tests := []struct {
+			url  string
+			want string
+		}{
+			{url: "https://internal.example.com/v1/x", want: ""},
+			{url: "https://foo.googleapis.com/v1/x", want: "secret"},
+		}
+		for _, tt := range tests {
+			resp, err := client.Get(tt.url)
+			if err != nil {
+				t.Fatalf("Get(%q) = %v", tt.url, err)
+			}
+			resp.Body.Close()
+			got := rt.req.URL.Query().Get("key")
+			if placement == APIKeyPlacementHeader {
+				got = rt.req.Header.Get("X-Goog-Api-Key")
+			}
+			if got != tt.want {
+				t.Errorf("placement %v, Get(%q): got key %q, want %q", placement, tt.url, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestNewClient_SkipAuthForPaths(t *testing.T) {
+	clients := []struct {
+		name   string
+		opts   *Options
+		header string
+		want   string
+	}{
+		{
+			name:   "token",
+			opts:   &Options{TokenProvider: testutil.StaticTokenProvider("fakeToken")},
+			header: "Authorization",
+			want:   "Bearer fakeToken",
+		},
+		{
+			name:   "api key",
+			opts:   &Options{APIKey: "secret", APIKeyPlacement: APIKeyPlacementHeader},
+			header: "X-Goog-Api-Key",
+			want:   "secret",
+		},
+	}
+	tests := []struct {
+		url     string
+		skipped bool
+	}{
+		{url: "https://foo.googleapis.com/$discovery/rest", skipped: true},
+		{url: "https://foo.googleapis.com/$discovery/rest?version=v1", skipped: true},
+		{url: "https://foo.googleapis.com/v1/public/openapi.json", skipped: true},
+		{url: "https://foo.googleapis.com/v1/public/", skipped: true},
+		{url: "https://foo.googleapis.com/v1/public"},
+		{url: "https://foo.googleapis.com/$discovery/rest/v1"},
+		{url: "https://foo.googleapis.com/V1/public/openapi.json"},
+		{url: "https://foo.googleapis.com/v1/private"},
+	}
+	for _, c := range clients {
+		t.Run(c.name, func(t *testing.T) {
+			rt := &recordingRT{}
+			c.opts.BaseRoundTripper = rt
+			c.opts.SkipAuthForPaths = []string{"/$discovery/rest", "/v1/public/*"}
+			client, err := NewClient(c.opts)
+			if err != nil {
+				t.Fatalf("NewClient() = %v", err)
+			}
+			for _, tt := range tests {
+				resp, err := client.Get(tt.url)
+				if err != nil {
+					t.Fatalf("Get(%q) = %v", tt.url, err)
+				}
+				resp.Body.Close()
+				want := c.want
+				if tt.skipped {
+					want = ""
+				}
+				if got := rt.req.Header.Get(c.header); got != want {
+					t.Errorf("Get(%q): got %s %q, want %q", tt.url, c.header, got, want)
+				}
+				if got, want := WasAuthenticated(resp), !tt.skipped; got != want {
+					t.Errorf("Get(%q): got WasAuthenticated %v, want %v", tt.url, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewClient_AutoIdempotencyKey(t *testing.T) {
+	var mu sync.Mutex
+	var keys []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		keys = append(keys, r.Header.Get("X-Idempotency-Key"))
+		// Fail every first attempt so that it is retried.
+		if len(keys)%2 == 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer ts.Close()
+	tests := []struct {
+		name     string
+		disabled bool
+		key      string
+	}{
+		{
+			name: "generated",
+		},
+		{
+			name: "set by caller",
+			key:  "caller-key",
+		},
+		{
+			name:     "disabled",
+			disabled: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys = nil
+			client, err := NewClient(&Options{
+				TokenProvider:       testutil.StaticTokenProvider("fakeToken"),
+				RetryOnUnauthorized: true,
+				AutoIdempotencyKey:  !tt.disabled,
+				// Without a key, a POST is only retried if unsafe retries
+				// are allowed.
+				AllowUnsafeRetries: tt.disabled,
+			})
+			if err != nil {
+				t.Fatalf("NewClient() = %v", err)
+			}
+			for i := 0; i < 2; i++ {
+				req, err := http.NewRequest(http.MethodPost, ts.URL, strings.NewReader("body"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tt.key != "" {
+					req.Header.Set("X-Idempotency-Key", tt.key)
+				}
+				resp, err := client.Do(req)
+				if err != nil {
+					t.Fatalf("client.Do() = %v", err)
+				}
+				resp.Body.Close()
+				if req.Header.Get("X-Idempotency-Key") != tt.key {
+					t.Error("the request of the caller was modified")
+				}
+			}
+			if len(keys) != 4 {
+				t.Fatalf("got %d attempts, want 4", len(keys))
+			}
+			for i := 0; i < 4; i += 2 {
+				if keys[i] != keys[i+1] {
+					t.Errorf("retry got key %q, want %q", keys[i+1], keys[i])
+				}
+			}
+			switch {
+			case tt.disabled:
+				if keys[0] != "" {
+					t.Errorf("got key %q, want none", keys[0])
+				}
+			case tt.key != "":
+				if keys[0] != tt.key || keys[2] != tt.key {
+					t.Errorf("got keys %q, want %q", keys, tt.key)
+				}
+			default:
+				if keys[0] == "" || keys[0] == keys[2] {
+					t.Errorf("got keys %q, want a distinct key per request", keys)
+				}
+			}
+		})
+	}
+}
+
+func TestOptions_ResolvedScopes(t *testing.T) {
+	tests := []struct {
+		name string
+		opts *Options
+		want []string
+	}{
+		{
+			name: "detect options",
+			opts: &Options{
+				DetectOpts:      &detect.Options{Scopes: []string{"a", "b"}},
+				InternalOptions: &InternalOptions{DefaultScopes: []string{"default"}},
+			},
+			want: []string{"a", "b"},
+		},
+		{
+			name: "default scopes",
+			opts: &Options{
+				InternalOptions: &InternalOptions{DefaultScopes: []string{"default"}},
+			},
+			want: []string{"default"},
+		},
+		{
+			name: "audience instead of default scopes",
+			opts: &Options{
+				DetectOpts:      &detect.Options{Audience: "aud"},
+				InternalOptions: &InternalOptions{DefaultScopes: []string{"default"}},
+			},
+			want: []string{},
+		},
+		{
+			name: "default audience",
+			opts: &Options{
+				InternalOptions: &InternalOptions{DefaultAudience: "aud"},
+			},
+			want: []string{},
+		},
+		{
+			name: "impersonation",
+			opts: &Options{
+				ImpersonateServiceAccount: "target@example.com",
+			},
+			want: []string{cloudPlatformScope},
+		},
+		{
+			name: "token provider",
+			opts: &Options{
+				TokenProvider:   testutil.StaticTokenProvider("fakeToken"),
+				InternalOptions: &InternalOptions{DefaultScopes: []string{"default"}},
+			},
+			want: []string{},
+		},
+		{
+			name: "api key",
+			opts: &Options{
+				APIKey:          "key",
+				InternalOptions: &InternalOptions{DefaultScopes: []string{"default"}},
+			},
+			want: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.opts.ResolvedScopes()
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("ResolvedScopes() mismatch (-want +got):\n%s", diff)
+			}
+			if len(got) > 0 {
+				got[0] = "modified"
+				if tt.opts.ResolvedScopes()[0] == "modified" {
+					t.Error("ResolvedScopes() returned internal state")
+				}
+			}
+		})
+	}
+}
+
+func TestNewClient_ReplayProtection(t *testing.T) {
+	failures := []struct {
+		name string
+		opts func(*Options)
+		fail func(http.ResponseWriter)
+	}{
+		{
+			name: "unauthorized",
+			opts: func(o *Options) { o.RetryOnUnauthorized = true },
+			fail: func(w http.ResponseWriter) { w.WriteHeader(http.StatusUnauthorized) },
+		},
+		{
+			name: "invalid token challenge",
+			opts: func(o *Options) { o.RetryOnInvalidTokenChallenge = true },
+			fail: func(w http.ResponseWriter) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				w.WriteHeader(http.StatusUnauthorized)
+			},
+		},
+		{
+			name: "retry after",
+			opts: func(o *Options) { o.HonorRetryAfter = true },
+			fail: func(w http.ResponseWriter) {
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusServiceUnavailable)
+			},
+		},
+	}
+	tests := []struct {
+		name        string
+		method      string
+		key         string
+		autoKey     bool
+		allowUnsafe bool
+		wantHits    int
+	}{
+		{
+			name:     "post without key",
+			method:   http.MethodPost,
+			wantHits: 1,
+		},
+		{
+			name:     "post with key",
+			method:   http.MethodPost,
+			key:      "caller-key",
+			wantHits: 2,
+		},
+		{
+			name:     "post with generated key",
+			method:   http.MethodPost,
+			autoKey:  true,
+			wantHits: 2,
+		},
+		{
+			name:        "post without key with unsafe retries",
+			method:      http.MethodPost,
+			allowUnsafe: true,
+			wantHits:    2,
+		},
+		{
+			name:     "put without key",
+			method:   http.MethodPut,
+			wantHits: 2,
+		},
+	}
+	for _, f := range failures {
+		for _, tt := range tests {
+			t.Run(f.name+"/"+tt.name, func(t *testing.T) {
+				var hits int
+				ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					hits++
+					if hits == 1 {
+						f.fail(w)
+					}
+				}))
+				defer ts.Close()
+				opts := &Options{
+					TokenProvider:      testutil.StaticTokenProvider("fakeToken"),
+					AutoIdempotencyKey: tt.autoKey,
+					AllowUnsafeRetries: tt.allowUnsafe,
+				}
+				f.opts(opts)
+				client, err := NewClient(opts)
+				if err != nil {
+					t.Fatalf("NewClient() = %v", err)
+				}
+				req, err := http.NewRequest(tt.method, ts.URL, strings.NewReader("body"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tt.key != "" {
+					req.Header.Set("X-Idempotency-Key", tt.key)
+				}
+				resp, err := client.Do(req)
+				if err != nil {
+					t.Fatalf("client.Do() = %v", err)
+				}
+				resp.Body.Close()
+				if hits != tt.wantHits {
+					t.Errorf("got %d requests, want %d", hits, tt.wantHits)
+				}
+			})
+		}
+	}
+}
+
+func TestNewClient_GenerateRequestID(t *testing.T) {
+	var mu sync.Mutex
+	var ids []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		ids = append(ids, r.Header.Get("X-Request-Id"))
+		switch {
+		case r.URL.Path == "/fail":
+			w.WriteHeader(http.StatusInternalServerError)
+		case len(ids)%2 == 1:
+			// Fail every first attempt so that it is retried.
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer ts.Close()
+	var logs []string
+	var metricIDs []string
+	client, err := NewClient(&Options{
+		TokenProvider:       testutil.StaticTokenProvider("fakeToken"),
+		RetryOnUnauthorized: true,
+		GenerateRequestID:   true,
+		Logf: func(format string, args ...interface{}) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		},
+		MetricsObserver: func(m RequestMetrics) {
+			mu.Lock()
+			defer mu.Unlock()
+			metricIDs = append(metricIDs, m.RequestID)
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	for _, key := range []string{"", "caller-id"} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != "" {
+			req.Header.Set("X-Request-Id", key)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("client.Do() = %v", err)
+		}
+		resp.Body.Close()
+		if req.Header.Get("X-Request-Id") != key {
+			t.Error("the request of the caller was modified")
+		}
+		if got := RequestID(resp); got == "" || (key != "" && got != key) {
+			t.Errorf("RequestID() = %q, want %q or a generated ID", got, key)
+		}
+	}
+	if len(ids) != 4 {
+		t.Fatalf("got %d attempts, want 4", len(ids))
+	}
+	if ids[0] == "" || ids[0] != ids[1] {
+		t.Errorf("got IDs %q, want the same generated ID for both attempts", ids[:2])
+	}
+	if ids[2] != "caller-id" || ids[3] != "caller-id" {
+		t.Errorf("got IDs %q, want the ID of the caller", ids[2:])
+	}
+	if diff := cmp.Diff(ids, metricIDs); diff != "" {
+		t.Errorf("metrics request IDs mismatch (-want +got):\n%s", diff)
+	}
+	if len(logs) != 2 || !strings.Contains(logs[0], ids[0]) || !strings.Contains(logs[1], "caller-id") {
+		t.Errorf("got logs %q, want them to contain the request IDs", logs)
+	}
+
+	resp, err := client.Get(ts.URL + "/fail")
+	if err != nil {
+		t.Fatalf("client.Get() = %v", err)
+	}
+	resp.Body.Close()
+	if got, want := RequestID(resp), ids[len(ids)-1]; got == "" || got != want {
+		t.Errorf("RequestID() = %q, want %q", got, want)
+	}
+	if got := resp.Header.Get("X-Request-Id"); got != "" {
+		t.Errorf("got response header X-Request-Id %q, want the headers of the server", got)
+	}
+	if got := RequestID(&http.Response{Request: httptest.NewRequest(http.MethodGet, ts.URL, nil)}); got != "" {
+		t.Errorf("RequestID() = %q for a request not sent by the client, want empty", got)
+	}
+}
+
+func TestNewClient_TokenTypeOverride(t *testing.T) {
+	tests := []struct {
+		name     string
+		tokType  string
+		override string
+		want     string
+	}{
+		{
+			name: "default",
+			want: "Bearer fakeToken",
+		},
+		{
+			name:    "token type",
+			tokType: "GoogleLogin",
+			want:    "GoogleLogin fakeToken",
+		},
+		{
+			name:     "override",
+			tokType:  "Bearer",
+			override: "DPoP",
+			want:     "DPoP fakeToken",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := &recordingRT{}
+			tok := &auth.Token{Value: "fakeToken", Type: tt.tokType}
+			client, err := NewClient(&Options{
+				BaseRoundTripper:  base,
+				TokenProvider:     &fixedTP{tok: tok},
+				TokenTypeOverride: tt.override,
+			})
+			if err != nil {
+				t.Fatalf("NewClient() = %v", err)
+			}
+			resp, err := client.Get("https://foo.googleapis.com/v1/foo")
+			if err != nil {
+				t.Fatalf("client.Get() = %v", err)
+			}
+			resp.Body.Close()
+			if got := base.req.Header.Get("Authorization"); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if tok.Type != tt.tokType {
+				t.Errorf("the token was modified, got type %q, want %q", tok.Type, tt.tokType)
+			}
+		})
+	}
+}
+
+func TestNewClient_AuthHeaderName(t *testing.T) {
+	tests := []struct {
+		name       string
+		headerName string
+		wantHeader string
+	}{
+		{
+			name:       "default",
+			wantHeader: "Authorization",
+		},
+		{
+			name:       "proxy authorization",
+			headerName: "Proxy-Authorization",
+			wantHeader: "Proxy-Authorization",
+		},
+		{
+			name:       "custom",
+			headerName: "x-custom-auth",
+			wantHeader: "X-Custom-Auth",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := &recordingRT{}
+			var logs []string
+			client, err := NewClient(&Options{
+				BaseRoundTripper: base,
+				TokenProvider:    testutil.StaticTokenProvider("fakeToken"),
+				AuthHeaderName:   tt.headerName,
+				Logf: func(format string, args ...interface{}) {
+					logs = append(logs, fmt.Sprintf(format, args...))
+				},
+			})
+			if err != nil {
+				t.Fatalf("NewClient() = %v", err)
+			}
+			resp, err := client.Get("https://foo.googleapis.com/v1/foo")
+			if err != nil {
+				t.Fatalf("client.Get() = %v", err)
+			}
+			resp.Body.Close()
+			if got, want := base.req.Header.Get(tt.wantHeader), "Bearer fakeToken"; got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+			if tt.wantHeader != "Authorization" {
+				if got := base.req.Header.Get("Authorization"); got != "" {
+					t.Errorf("got Authorization %q, want none", got)
+				}
+			}
+			if len(logs) != 1 || strings.Contains(logs[0], "fakeToken") {
+				t.Errorf("got logs %q, want a single log line without the token", logs)
+			}
+		})
+	}
+
+	if _, err := NewClient(&Options{
+		TokenProvider:  testutil.StaticTokenProvider("fakeToken"),
+		AuthHeaderName: "Bad Header",
+	}); err == nil {
+		t.Error("NewClient() = _, nil, want error for invalid AuthHeaderName")
+	}
+}
+
+func TestSetAuthHeaderNamed(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "https://example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetAuthHeaderNamed("", &auth.Token{Value: "fakeToken"}, req)
+	if got, want := req.Header.Get("Authorization"), "Bearer fakeToken"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	SetAuthHeaderNamed("Proxy-Authorization", &auth.Token{Value: "fakeToken", Type: "MAC"}, req)
+	if got, want := req.Header.Get("Proxy-Authorization"), "MAC fakeToken"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestNewClient_RequestTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	client, err := NewClient(&Options{
+		DisableAuthentication: true,
+		RequestTimeout:        20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+
+	if _, err := client.Get(ts.URL); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("client.Get() = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// A deadline set by the caller is not replaced.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("client.Do() = %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestNewClient_RequestTimeoutCancelsOnClose(t *testing.T) {
+	base := &recordingRT{}
+	client, err := NewClient(&Options{
+		BaseRoundTripper:      base,
+		DisableAuthentication: true,
+		RequestTimeout:        time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	resp, err := client.Get("https://foo.googleapis.com/v1/foo")
+	if err != nil {
+		t.Fatalf("client.Get() = %v", err)
+	}
+	ctx := base.req.Context()
+	if _, ok := ctx.Deadline(); !ok {
+		t.Fatal("request context has no deadline")
+	}
+	if err := ctx.Err(); err != nil {
+		t.Fatalf("request context done before the body was closed: %v", err)
+	}
+	resp.Body.Close()
+	if err := ctx.Err(); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v after the body was closed", err, context.Canceled)
+	}
+}
+
+func TestPrepareRequest(t *testing.T) {
+	opts := &Options{
+		TokenProvider:  testutil.StaticTokenProvider("fakeToken"),
+		QuotaProjectID: "my_quota",
+		Headers:        http.Header{"Foo": []string{"bar"}},
+		Endpoint:       "https://override.example.com",
+		Logf: func(string, ...interface{}) {
+			t.Error("Logf should not be called for prepared requests")
+		},
+		InternalOptions: &InternalOptions{
+			DefaultEndpoint: "https://foo.googleapis.com",
+		},
+	}
+	req, err := http.NewRequest(http.MethodPost, "https://foo.googleapis.com/v1/foo", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := PrepareRequest(context.Background(), opts, req)
+	if err != nil {
+		t.Fatalf("PrepareRequest() = %v", err)
+	}
+	if want := "https://override.example.com/v1/foo"; got.URL.String() != want {
+		t.Errorf("got URL %q, want %q", got.URL, want)
+	}
+	for k, want := range map[string]string{
+		"Authorization":       "Bearer fakeToken",
+		quotaProjectHeaderKey: "my_quota",
+		"Foo":                 "bar",
+	} {
+		if v := got.Header.Get(k); v != want {
+			t.Errorf("%s: got %q, want %q", k, v, want)
+		}
+	}
+	b, err := io.ReadAll(got.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("got body %q, want %q", b, "hello")
+	}
+	if err := got.Context().Err(); err != nil {
+		t.Errorf("prepared request context is done: %v", err)
+	}
+	if len(req.Header) != 0 || req.URL.Host != "foo.googleapis.com" {
+		t.Error("PrepareRequest modified the original request")
+	}
+
+	req, err = http.NewRequest(http.MethodGet, "https://foo.googleapis.com/v1/foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = PrepareRequest(context.Background(), &Options{
+		APIKey:          "thereisnospoon",
+		APIKeyPlacement: APIKeyPlacementHeader,
+	}, req)
+	if err != nil {
+		t.Fatalf("PrepareRequest() = %v", err)
+	}
+	if v := got.Header.Get(apiKeyHeaderKey); v != "thereisnospoon" {
+		t.Errorf("got API key %q, want %q", v, "thereisnospoon")
+	}
+
+	if _, err := PrepareRequest(context.Background(), nil, req); err == nil {
+		t.Error("PrepareRequest() = _, nil, want error for invalid options")
+	}
+	if _, err := PrepareRequest(context.Background(), &Options{TokenProvider: &fixedTP{err: errors.New("no token")}}, req); err == nil {
+		t.Error("PrepareRequest() = _, nil, want error for failed token fetch")
+	}
+}
+
+func TestWasAuthenticated(t *testing.T) {
+	tests := []struct {
+		name string
+		opts *Options
+		url  string
+		want bool
+	}{
+		{
+			name: "token",
+			opts: &Options{TokenProvider: testutil.StaticTokenProvider("fakeToken")},
+			url:  "https://foo.googleapis.com/v1/foo",
+			want: true,
+		},
+		{
+			name: "api key",
+			opts: &Options{APIKey: "thereisnospoon"},
+			url:  "https://foo.googleapis.com/v1/foo",
+			want: true,
+		},
+		{
+			name: "disable authentication",
+			opts: &Options{DisableAuthentication: true},
+			url:  "https://foo.googleapis.com/v1/foo",
+		},
+		{
+			name: "skipped host",
+			opts: &Options{
+				TokenProvider:    testutil.StaticTokenProvider("fakeToken"),
+				SkipAuthForHosts: []string{"foo.googleapis.com"},
+			},
+			url: "https://foo.googleapis.com/v1/foo",
+		},
+		{
+			name: "api key skipped host",
+			opts: &Options{
+				APIKey:           "thereisnospoon",
+				SkipAuthForHosts: []string{"foo.googleapis.com"},
+			},
+			url: "https://foo.googleapis.com/v1/foo",
+		},
+		{
+			name: "api key skipped path",
+			opts: &Options{
+				APIKey:           "thereisnospoon",
+				SkipAuthForPaths: []string{"/v1/*"},
+			},
+			url: "https://foo.googleapis.com/v1/foo",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.BaseRoundTripper = &recordingRT{}
+			client, err := NewClient(tt.opts)
+			if err != nil {
+				t.Fatalf("NewClient() = %v", err)
+			}
+			resp, err := client.Get(tt.url)
+			if err != nil {
+				t.Fatalf("client.Get() = %v", err)
+			}
+			resp.Body.Close()
+			if got := WasAuthenticated(resp); got != tt.want {
+				t.Errorf("WasAuthenticated() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if WasAuthenticated(nil) {
+		t.Error("WasAuthenticated(nil) = true, want false")
+	}
+}
+
+func TestSetAuthHeaderFromProvider(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		tp      auth.TokenProvider
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "defaults to bearer",
+			ctx:  context.Background(),
+			tp:   testutil.StaticTokenProvider("fakeToken"),
+			want: "Bearer fakeToken",
+		},
+		{
+			name: "token type",
+			ctx:  context.Background(),
+			tp:   &fixedTP{tok: &auth.Token{Value: "fakeToken", Type: "MAC"}},
+			want: "MAC fakeToken",
+		},
+		{
+			name:    "fetch error",
+			ctx:     context.Background(),
+			tp:      &fixedTP{err: errors.New("no token")},
+			wantErr: true,
+		},
+		{
+			name:    "context done",
+			ctx:     canceled,
+			tp:      blockingTP{},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "https://example.com", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = SetAuthHeaderFromProvider(tt.ctx, tt.tp, req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SetAuthHeaderFromProvider() = %v, want error %v", err, tt.wantErr)
+			}
+			if got := req.Header.Get("Authorization"); got != tt.want {
+				t.Errorf("got Authorization %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// recordingRT records the last request it received and responds with a 200.
+type recordingRT struct {
+	req *http.Request
+}
+
+func (rt *recordingRT) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.req = req
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+// sequenceTP returns a new token value each time it is called.
+type sequenceTP struct {
+	calls int
+}
+
+func (tp *sequenceTP) Token(context.Context) (*auth.Token, error) {
+	tp.calls++
+	return &auth.Token{
+		Value: fmt.Sprintf("token%d", tp.calls),
+	}, nil
+}
+
+// tokenServer is a token endpoint issuing the access tokens "tok1", "tok2",
+// and so on. The nth token expires after the nth of expiresIn seconds, or the
+// last of them if there are fewer.
+type tokenServer struct {
+	*httptest.Server
+	expiresIn []int
+
+	mu sync.Mutex
+	n  int
+}
+
+func newTokenServer(t *testing.T, expiresIn ...int) *tokenServer {
+	s := &tokenServer{expiresIn: expiresIn}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.n++
+		n := s.n
+		s.mu.Unlock()
+		exp := s.expiresIn[len(s.expiresIn)-1]
+		if n <= len(s.expiresIn) {
+			exp = s.expiresIn[n-1]
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token": "tok%d", "token_type": "Bearer", "expires_in": %d}`, n, exp)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// fetches returns the number of tokens s has issued.
+func (s *tokenServer) fetches() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.n
+}
+
+type countingTP struct {
+	expiresIn time.Duration
+	calls     int
+}
+
+func (tp *countingTP) Token(context.Context) (*auth.Token, error) {
+	tp.calls++
+	return &auth.Token{
+		Value:  "fakeToken",
+		Expiry: time.Now().Add(tp.expiresIn),
+	}, nil
+}
+
+func TestNewClient_FallbackTokenProvider(t *testing.T) {
+	primaryErr := errors.New("primary: metadata server unavailable")
+	tests := []struct {
+		name      string
+		opts      *Options
+		wantCalls int
+	}{
+		{
+			name: "primary fails",
+			opts: &Options{
+				TokenProvider: &fixedTP{err: primaryErr},
+			},
+			wantCalls: 1,
+		},
+		{
+			name: "primary succeeds",
+			opts: &Options{
+				TokenProvider: testutil.StaticTokenProvider("fakeToken"),
+			},
+		},
+		{
+			name: "detection fails",
+			opts: &Options{
+				DetectOpts: &detect.Options{
+					CredentialsJSON: []byte(`{"type":"42"}`),
+				},
+			},
+			wantCalls: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := &recordingRT{}
+			fallback := &countingTP{expiresIn: time.Hour}
+			tt.opts.BaseRoundTripper = base
+			tt.opts.FallbackTokenProvider = fallback
+			client, err := NewClient(tt.opts)
+			if err != nil {
+				t.Fatalf("NewClient() = %v", err)
+			}
+			for i := 0; i < 2; i++ {
+				resp, err := client.Get("https://foo.googleapis.com/v1/foo")
+				if err != nil {
+					t.Fatalf("client.Get() = %v", err)
+				}
+				resp.Body.Close()
+				if got, want := base.req.Header.Get("Authorization"), "Bearer fakeToken"; got != want {
+					t.Errorf("got %q, want %q", got, want)
+				}
+			}
+			if fallback.calls != tt.wantCalls {
+				t.Errorf("got %d fallback calls, want %d", fallback.calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestNewClient_FallbackTokenProviderFails(t *testing.T) {
+	primaryErr := errors.New("primary failed")
+	fallbackErr := &auth.Error{Body: []byte("fallback failed")}
+	client, err := NewClient(&Options{
+		BaseRoundTripper:      &recordingRT{},
+		TokenProvider:         &failingTP{err: primaryErr, failures: 1},
+		FallbackTokenProvider: &failingTP{err: fallbackErr, failures: 1},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	_, err = client.Get("https://foo.googleapis.com/v1/foo")
+	if !errors.Is(err, primaryErr) || !errors.Is(err, fallbackErr) {
+		t.Fatalf("client.Get() = %v, want it to wrap %v and %v", err, primaryErr, fallbackErr)
+	}
+	var aerr *auth.Error
+	if !errors.As(err, &aerr) || aerr != fallbackErr {
+		t.Errorf("errors.As() = %v, want %v", aerr, fallbackErr)
+	}
+}
+
+func TestNewClient_APIKeyProvider(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	var calls int
+	var providerErr error
+	base := &recordingRT{}
+	opts := &Options{
+		BaseRoundTripper: base,
+		APIKey:           "static",
+		APIKeyProvider: func(ctx context.Context) (string, error) {
+			if providerErr != nil {
+				return "", providerErr
+			}
+			calls++
+			return fmt.Sprintf("key%d", calls), nil
+		},
+	}
+	opts.now = clock
+	client, err := NewClient(opts)
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	get := func(want string) {
+		t.Helper()
+		resp, err := client.Get("https://foo.googleapis.com")
+		if err != nil {
+			t.Fatalf("client.Get() = %v", err)
+		}
+		resp.Body.Close()
+		if got := base.req.URL.Query().Get("key"); got != want {
+			t.Errorf("got key %q, want %q", got, want)
+		}
+	}
+
+	get("key1")
+	now = now.Add(apiKeyCacheDuration - time.Second)
+	get("key1")
+	now = now.Add(time.Second)
+	get("key2")
+
+	now = now.Add(apiKeyCacheDuration)
+	providerErr = errors.New("secret unavailable")
+	base.req = nil
+	if _, err := client.Get("https://foo.googleapis.com"); !errors.Is(err, providerErr) {
+		t.Errorf("client.Get() = %v, want error wrapping %v", err, providerErr)
+	}
+	if base.req != nil {
+		t.Error("request was sent after APIKeyProvider failed")
+	}
+	providerErr = nil
+	get("key3")
+}
+
+func TestNewClient_APIKeyPlacement(t *testing.T) {
+	apiKey := "there is/no&spoon"
+	tests := []struct {
+		name       string
+		placement  APIKeyPlacement
+		query      string
+		wantQuery  url.Values
+		wantHeader string
+	}{
+		{
+			name:      "query param",
+			wantQuery: url.Values{"key": []string{apiKey}},
+		},
+		{
+			name:      "query param, merged with existing query",
+			query:     "?foo=bar&baz=qux",
+			wantQuery: url.Values{"key": []string{apiKey}, "foo": []string{"bar"}, "baz": []string{"qux"}},
+		},
+		{
+			name:      "query param, replaces existing key",
+			query:     "?key=other&foo=bar",
+			wantQuery: url.Values{"key": []string{apiKey}, "foo": []string{"bar"}},
+		},
+		{
+			name:       "header",
+			placement:  APIKeyPlacementHeader,
+			query:      "?foo=bar",
+			wantQuery:  url.Values{"foo": []string{"bar"}},
+			wantHeader: apiKey,
+		},
+		{
+			name:       "header, existing key query param untouched",
+			placement:  APIKeyPlacementHeader,
+			query:      "?key=other",
+			wantQuery:  url.Values{"key": []string{"other"}},
+			wantHeader: apiKey,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if diff := cmp.Diff(tt.wantQuery, r.URL.Query()); diff != "" {
+					t.Errorf("query mismatch (-want +got):\n%s", diff)
+				}
+				if got := r.Header.Get(apiKeyHeaderKey); got != tt.wantHeader {
+					t.Errorf("got %q, want %q", got, tt.wantHeader)
+				}
+			}))
+			defer ts.Close()
+			client, err := NewClient(&Options{
+				APIKey:          apiKey,
+				APIKeyPlacement: tt.placement,
+			})
+			if err != nil {
+				t.Fatalf("NewClient() = %v", err)
+			}
+			req, err := http.NewRequest(http.MethodGet, ts.URL+tt.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("client.Do() = %v", err)
+			}
+			resp.Body.Close()
+			if got, want := req.URL.String(), ts.URL+tt.query; got != want {
+				t.Errorf("request URL was modified: got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// fixedTP returns tok and err on every call.
+type fixedTP struct {
+	tok *auth.Token
+	err error
+}
+
+func (tp *fixedTP) Token(context.Context) (*auth.Token, error) {
+	return tp.tok, tp.err
 }
@@ -0,0 +1,92 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package httptransporttest provides utilities for testing code that creates
+// clients with [cloud.google.com/go/auth/httptransport].
+package httptransporttest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"cloud.google.com/go/auth"
+	"cloud.google.com/go/auth/httptransport"
+)
+
+const (
+	// FakeToken is the value of the tokens clients created by [NewClient]
+	// send when no credentials are configured.
+	FakeToken = "fake-token"
+	// FakeProjectID is the project ID of the credentials clients created by
+	// [NewClient] use when no credentials are configured.
+	FakeProjectID = "fake-project"
+)
+
+// NewClient returns a client configured like one created by
+// [cloud.google.com/go/auth/httptransport.NewClient] with the provided
+// options, except that requests are passed to handler rather than sent over
+// the network. The headers, credentials, and endpoint routing of the options
+// are applied to requests before they reach handler, so tests can inspect
+// them.
+//
+// If opts configures neither a TokenProvider, an API key, nor
+// DisableAuthentication, a provider of [FakeToken] is used in place of
+// detected credentials, so no credentials need to be available. It also
+// stands in for the ID tokens of UseIDToken and the self-signed JWTs of
+// AudienceForHost. Service accounts are never impersonated. Options that
+// configure the default base transport, such as TLSConfig and Proxy, are
+// ignored. opts is not modified.
+func NewClient(opts *httptransport.Options, handler http.RoundTripper) (*http.Client, error) {
+	if handler == nil {
+		return nil, errors.New("httptransporttest: handler must not be nil")
+	}
+	o := opts.Clone()
+	if o == nil {
+		o = &httptransport.Options{}
+	}
+	if o.TokenProvider == nil && o.APIKey == "" && o.APIKeyProvider == nil && !o.DisableAuthentication {
+		o.TokenProvider = fakeTokenProvider{}
+		o.DetectOpts = nil
+		o.CredentialsEnvVar = ""
+		o.UseIDToken = false
+		o.AudienceForHost = nil
+	}
+	o.ImpersonateServiceAccount = ""
+	o.ImpersonateDelegates = nil
+	o.BaseRoundTripper = handler
+	o.TLSConfig = nil
+	o.MaxIdleConnsPerHost = 0
+	o.MaxConnsPerHost = 0
+	o.IdleConnTimeout = 0
+	o.Proxy = nil
+	o.ForceHTTP2 = false
+	o.AllowH2C = false
+	o.CertReloadInterval = 0
+	return httptransport.NewClient(o)
+}
+
+// fakeTokenProvider provides [FakeToken] for [FakeProjectID].
+type fakeTokenProvider struct{}
+
+func (fakeTokenProvider) Token(context.Context) (*auth.Token, error) {
+	return &auth.Token{
+		Value: FakeToken,
+		Type:  "Bearer",
+	}, nil
+}
+
+func (fakeTokenProvider) ProjectID() string {
+	return FakeProjectID
+}
@@ -0,0 +1,142 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httptransporttest
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/auth/detect"
+	"cloud.google.com/go/auth/httptransport"
+	"cloud.google.com/go/auth/internal/testutil"
+)
+
+func TestNewClient(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       *httptransport.Options
+		wantHeader string
+		want       string
+	}{
+		{
+			name:       "nil options",
+			wantHeader: "Authorization",
+			want:       "Bearer " + FakeToken,
+		},
+		{
+			name: "credentials detected otherwise",
+			opts: &httptransport.Options{
+				DetectOpts: &detect.Options{
+					CredentialsFile: "does-not-exist.json",
+				},
+				ImpersonateServiceAccount: "sa@example.com",
+				SendProjectIDHeader:       "X-Project",
+				TLSConfig:                 &tls.Config{},
+			},
+			wantHeader: "Authorization",
+			want:       "Bearer " + FakeToken,
+		},
+		{
+			name: "ID tokens",
+			opts: &httptransport.Options{
+				DetectOpts: &detect.Options{
+					Audience: "https://foo.run.app",
+				},
+				UseIDToken: true,
+			},
+			wantHeader: "Authorization",
+			want:       "Bearer " + FakeToken,
+		},
+		{
+			name: "audience for host",
+			opts: &httptransport.Options{
+				DetectOpts: &detect.Options{
+					UseSelfSignedJWT: true,
+				},
+				AudienceForHost: map[string]string{
+					"foo.googleapis.com": "https://foo.googleapis.com/",
+				},
+			},
+			wantHeader: "Authorization",
+			want:       "Bearer " + FakeToken,
+		},
+		{
+			name: "project ID header",
+			opts: &httptransport.Options{
+				SendProjectIDHeader: "X-Project",
+			},
+			wantHeader: "X-Project",
+			want:       FakeProjectID,
+		},
+		{
+			name: "token provider",
+			opts: &httptransport.Options{
+				TokenProvider: testutil.StaticTokenProvider("real-token"),
+			},
+			wantHeader: "Authorization",
+			want:       "Bearer real-token",
+		},
+		{
+			name: "api key",
+			opts: &httptransport.Options{
+				APIKey:          "key",
+				APIKeyPlacement: httptransport.APIKeyPlacementHeader,
+			},
+			wantHeader: "X-Goog-Api-Key",
+			want:       "key",
+		},
+		{
+			name: "disabled authentication",
+			opts: &httptransport.Options{
+				DisableAuthentication: true,
+			},
+			wantHeader: "Authorization",
+			want:       "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *http.Request
+			client, err := NewClient(tt.opts, testutil.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				got = req
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       io.NopCloser(strings.NewReader("")),
+					Request:    req,
+				}, nil
+			}))
+			if err != nil {
+				t.Fatalf("NewClient() = %v", err)
+			}
+			resp, err := client.Get("https://foo.googleapis.com/v1/foo")
+			if err != nil {
+				t.Fatalf("client.Get() = %v", err)
+			}
+			resp.Body.Close()
+			if v := got.Header.Get(tt.wantHeader); v != tt.want {
+				t.Errorf("got %s %q, want %q", tt.wantHeader, v, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewClient_NilHandler(t *testing.T) {
+	if _, err := NewClient(nil, nil); err == nil {
+		t.Error("NewClient() = nil, want error")
+	}
+}
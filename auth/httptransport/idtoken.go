@@ -0,0 +1,217 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httptransport
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"cloud.google.com/go/auth"
+	"cloud.google.com/go/auth/detect"
+	"cloud.google.com/go/auth/internal"
+	"cloud.google.com/go/auth/internal/jwt"
+	"cloud.google.com/go/compute/metadata"
+)
+
+const (
+	defaultIDTokenURL  = "https://oauth2.googleapis.com/token"
+	idTokenMetadataURI = "instance/service-accounts/default/identity"
+)
+
+// generateIDTokenRequest is the request body of the IAM Credentials
+// generateIdToken method.
+type generateIDTokenRequest struct {
+	Audience     string   `json:"audience"`
+	Delegates    []string `json:"delegates,omitempty"`
+	IncludeEmail bool     `json:"includeEmail"`
+}
+
+// generateIDTokenResponse is the response body of the IAM Credentials
+// generateIdToken method.
+type generateIDTokenResponse struct {
+	Token string `json:"token"`
+}
+
+// resolveIDTokenProvider returns a provider of ID tokens for the audience of
+// DetectOpts, minted with the detected credentials.
+func (o *Options) resolveIDTokenProvider() (*resolvedCredentials, error) {
+	audience := o.DetectOpts.Audience
+	// The detected credentials are only used to mint ID tokens, or to call
+	// the IAM Credentials API when impersonating a service account.
+	do := o.resolveDetectOptionsWithScopes([]string{cloudPlatformScope})
+	o2 := o.Clone()
+	o2.ImpersonateServiceAccount = ""
+	o2.ImpersonateDelegates = nil
+	creds, source, err := o2.detectTokenProvider(do)
+	if err != nil {
+		return nil, err
+	}
+	var tp auth.TokenProvider
+	switch {
+	case o.ImpersonateServiceAccount != "":
+		delegates := make([]string, len(o.ImpersonateDelegates))
+		for i, v := range o.ImpersonateDelegates {
+			delegates[i] = serviceAccountResource(v)
+		}
+		tp = o.iamIDTokenProvider(source, o.ImpersonateServiceAccount, delegates, audience)
+	default:
+		tp, err = o.credentialsIDTokenProvider(creds, do, source, audience)
+		if err != nil {
+			return nil, err
+		}
+	}
+	qp := o.quotaProjectID()
+	if qp == "" {
+		qp = creds.QuotaProjectID()
+	}
+	return &resolvedCredentials{
+		tp:             o.withFallback(o.withFetchRetries(tp)),
+		quotaProjectID: qp,
+		projectID:      creds.ProjectID(),
+	}, nil
+}
+
+// credentialsIDTokenProvider returns a provider of ID tokens for audience
+// minted as the service account of creds, detected with do, authorized by tokens from source
+// where the IAM Credentials API is used.
+func (o *Options) credentialsIDTokenProvider(creds *detect.Credentials, do *detect.Options, source auth.TokenProvider, audience string) (auth.TokenProvider, error) {
+	sa, err := credentialsServiceAccount(creds, do, "mint ID tokens")
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case sa.key != nil:
+		opts2LO := &auth.Options2LO{
+			Email:         sa.key.ClientEmail,
+			PrivateKey:    []byte(sa.key.PrivateKey),
+			PrivateKeyID:  sa.key.PrivateKeyID,
+			TokenURL:      sa.key.TokenURL,
+			PrivateClaims: map[string]interface{}{"target_audience": audience},
+			UseIDToken:    true,
+			Client:        o.client(),
+		}
+		if opts2LO.TokenURL == "" {
+			opts2LO.TokenURL = defaultIDTokenURL
+		}
+		return auth.New2LOTokenProvider(opts2LO)
+	case sa.compute:
+		return computeIDTokenProvider{audience: audience}, nil
+	default:
+		return o.iamIDTokenProvider(source, sa.email, nil, audience), nil
+	}
+}
+
+// iamIDTokenProvider returns a provider of ID tokens for audience of the
+// service account with the provided email, generated with the IAM Credentials
+// generateIdToken API and authorized by tokens from source.
+func (o *Options) iamIDTokenProvider(source auth.TokenProvider, email string, delegates []string, audience string) auth.TokenProvider {
+	client := o.client()
+	if client == nil {
+		client = internal.CloneDefaultClient()
+	}
+	return &iamIDTokenProvider{
+		source:    auth.NewCachedTokenProvider(source, nil),
+		url:       fmt.Sprintf("%s/v1/%s:generateIdToken", iamCredentialsEndpoint(o.universeDomain()), serviceAccountResource(email)),
+		audience:  audience,
+		delegates: delegates,
+		client:    client,
+	}
+}
+
+type iamIDTokenProvider struct {
+	source    auth.TokenProvider
+	url       string
+	audience  string
+	delegates []string
+	client    *http.Client
+}
+
+func (tp *iamIDTokenProvider) Token(ctx context.Context) (*auth.Token, error) {
+	b, err := json.Marshal(generateIDTokenRequest{
+		Audience:     tp.audience,
+		Delegates:    tp.delegates,
+		IncludeEmail: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("httptransport: unable to marshal request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tp.url, bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("httptransport: unable to create generateIdToken request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := SetAuthHeaderFromProvider(ctx, tp.source, req); err != nil {
+		return nil, err
+	}
+	resp, err := tp.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("httptransport: unable to generate ID token: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := internal.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("httptransport: unable to read body: %w", err)
+	}
+	if c := resp.StatusCode; c < http.StatusOK || c >= http.StatusMultipleChoices {
+		return nil, &auth.Error{
+			Response: resp,
+			Body:     body,
+		}
+	}
+	var res generateIDTokenResponse
+	if err := json.Unmarshal(body, &res); err != nil {
+		return nil, fmt.Errorf("httptransport: unable to parse generateIdToken response: %w", err)
+	}
+	return idToken(res.Token)
+}
+
+// computeIDTokenProvider fetches ID tokens from the metadata server.
+type computeIDTokenProvider struct {
+	audience string
+}
+
+func (tp computeIDTokenProvider) Token(ctx context.Context) (*auth.Token, error) {
+	v := url.Values{}
+	v.Set("audience", tp.audience)
+	v.Set("format", "full")
+	s, err := metadata.Get(idTokenMetadataURI + "?" + v.Encode())
+	if err != nil {
+		return nil, err
+	}
+	return idToken(s)
+}
+
+// idToken returns a token holding the ID token s, which expires when the
+// token does.
+func idToken(s string) (*auth.Token, error) {
+	if s == "" {
+		return nil, errors.New("httptransport: response doesn't have an ID token")
+	}
+	claims, err := jwt.DecodeJWS(s)
+	if err != nil {
+		return nil, fmt.Errorf("httptransport: unable to decode ID token: %w", err)
+	}
+	return &auth.Token{
+		Value:  s,
+		Type:   internal.TokenTypeBearer,
+		Expiry: time.Unix(claims.Exp, 0),
+	}, nil
+}
@@ -0,0 +1,228 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httptransport
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/auth/detect"
+	"cloud.google.com/go/auth/internal/jwt"
+)
+
+// fakeIDToken returns an unsigned JWT that expires after d.
+func fakeIDToken(t *testing.T, d time.Duration) string {
+	t.Helper()
+	b, err := json.Marshal(map[string]interface{}{
+		"aud": "https://foo.run.app",
+		"exp": time.Now().Add(d).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "e30." + base64.RawURLEncoding.EncodeToString(b) + ".sig"
+}
+
+// serviceAccountJSON returns the test service account key with its token URL
+// replaced by tokenURL.
+func serviceAccountJSON(t *testing.T, tokenURL string) []byte {
+	t.Helper()
+	b, err := os.ReadFile("../internal/testdata/sa.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	m["token_uri"] = tokenURL
+	b, err = json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestNewClient_UseIDToken_ServiceAccount(t *testing.T) {
+	idToken := fakeIDToken(t, time.Hour)
+	var fetches int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		claims, err := jwt.DecodeJWS(r.FormValue("assertion"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := claims.AdditionalClaims["target_audience"], "https://foo.run.app"; got != want {
+			t.Errorf("got target_audience %v, want %q", got, want)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id_token": %q}`, idToken)
+	}))
+	defer ts.Close()
+
+	rt := &recordingRT{}
+	client, err := NewClient(&Options{
+		DetectOpts: &detect.Options{
+			CredentialsJSON: serviceAccountJSON(t, ts.URL),
+			Audience:        "https://foo.run.app",
+		},
+		UseIDToken:       true,
+		BaseRoundTripper: rt,
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get("https://foo.run.app")
+		if err != nil {
+			t.Fatalf("client.Get() = %v", err)
+		}
+		resp.Body.Close()
+		if got, want := rt.req.Header.Get("Authorization"), "Bearer "+idToken; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("got %d token fetches, want 1", fetches)
+	}
+}
+
+func TestNewClient_UseIDToken_Impersonate(t *testing.T) {
+	idToken := fakeIDToken(t, time.Hour)
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token": "source", "token_type": "Bearer", "expires_in": 3600}`))
+	}))
+	defer sts.Close()
+	iam := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.URL.Path, "/v1/projects/-/serviceAccounts/target@example.com:generateIdToken"; got != want {
+			t.Errorf("got path %q, want %q", got, want)
+		}
+		if got, want := r.Header.Get("Authorization"), "Bearer source"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		var body generateIDTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := body.Audience, "https://foo.run.app"; got != want {
+			t.Errorf("got audience %q, want %q", got, want)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(generateIDTokenResponse{Token: idToken})
+	}))
+	defer iam.Close()
+	oldEndpoint := iamCredentialsEndpoint
+	iamCredentialsEndpoint = func(string) string { return iam.URL }
+	defer func() { iamCredentialsEndpoint = oldEndpoint }()
+
+	rt := &recordingRT{}
+	client, err := NewClient(&Options{
+		DetectOpts: &detect.Options{
+			CredentialsJSON: serviceAccountJSON(t, sts.URL),
+			Audience:        "https://foo.run.app",
+		},
+		UseIDToken:                true,
+		ImpersonateServiceAccount: "target@example.com",
+		BaseRoundTripper:          rt,
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	resp, err := client.Get("https://foo.run.app")
+	if err != nil {
+		t.Fatalf("client.Get() = %v", err)
+	}
+	resp.Body.Close()
+	if got, want := rt.req.Header.Get("Authorization"), "Bearer "+idToken; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestNewClient_UseIDToken_ExternalAccount(t *testing.T) {
+	idToken := fakeIDToken(t, time.Hour)
+	iam := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/sts":
+			w.Write([]byte(`{"access_token": "federated", "token_type": "Bearer", "expires_in": 3600}`))
+		case "/v1/projects/-/serviceAccounts/target@example.com:generateAccessToken":
+			fmt.Fprintf(w, `{"accessToken": "source", "expireTime": %q}`, time.Now().Add(time.Hour).Format(time.RFC3339))
+		case "/v1/projects/-/serviceAccounts/target@example.com:generateIdToken":
+			if got, want := r.Header.Get("Authorization"), "Bearer source"; got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+			json.NewEncoder(w).Encode(generateIDTokenResponse{Token: idToken})
+		default:
+			t.Errorf("unexpected request to %q", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer iam.Close()
+	oldEndpoint := iamCredentialsEndpoint
+	iamCredentialsEndpoint = func(string) string { return iam.URL }
+	defer func() { iamCredentialsEndpoint = oldEndpoint }()
+
+	rt := &recordingRT{}
+	client, err := NewClient(&Options{
+		DetectOpts: &detect.Options{
+			ExternalAccount: externalAccountOptions(iam.URL+"/sts", iam.URL+"/v1/projects/-/serviceAccounts/target@example.com:generateAccessToken"),
+			Audience:        "https://foo.run.app",
+		},
+		UseIDToken:       true,
+		BaseRoundTripper: rt,
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	resp, err := client.Get("https://foo.run.app")
+	if err != nil {
+		t.Fatalf("client.Get() = %v", err)
+	}
+	resp.Body.Close()
+	if got, want := rt.req.Header.Get("Authorization"), "Bearer "+idToken; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestNewClient_UseIDToken_ExternalAccountWithoutImpersonation(t *testing.T) {
+	if _, err := NewClient(&Options{
+		DetectOpts: &detect.Options{
+			ExternalAccount: externalAccountOptions("https://sts.example.com", ""),
+			Audience:        "https://foo.run.app",
+		},
+		UseIDToken: true,
+	}); err == nil {
+		t.Error("NewClient() = nil, want error")
+	}
+}
+
+func TestNewClient_UseIDToken_UserCredentials(t *testing.T) {
+	if _, err := NewClient(&Options{
+		DetectOpts: &detect.Options{
+			CredentialsFile: "../internal/testdata/user.json",
+			Audience:        "https://foo.run.app",
+		},
+		UseIDToken: true,
+	}); err == nil {
+		t.Error("NewClient() = nil, want error")
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httptransport
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RequestMetrics describes a request sent to the service, as reported to
+// [Options.MetricsObserver].
+type RequestMetrics struct {
+	// Method is the HTTP method of the request.
+	Method string
+	// URL is the URL of the request, with any API key redacted.
+	URL string
+	// RequestID is the X-Request-Id header of the request, if it has one.
+	RequestID string
+	// StatusCode is the status code of the response, or 0 if no response
+	// was received.
+	StatusCode int
+	// RequestBytes is the number of bytes of the request body that were
+	// sent, after any compression.
+	RequestBytes int64
+	// ResponseBytes is the number of bytes of the response body that were
+	// read by the caller.
+	ResponseBytes int64
+	// Duration is the time from sending the request until its response body
+	// was closed, or until it failed.
+	Duration time.Duration
+	// Err is the error that occurred while sending the request, if any.
+	Err error
+}
+
+func addMetricsTransport(trans http.RoundTripper, opts *Options) http.RoundTripper {
+	if opts.MetricsObserver == nil {
+		return trans
+	}
+	return &metricsTransport{
+		observer: opts.MetricsObserver,
+		base:     trans,
+	}
+}
+
+// metricsTransport counts the bytes of request and response bodies as they
+// are streamed and reports them once the response body is closed. It wraps
+// the base transport, so every attempt made by the transports above it is
+// reported separately.
+type metricsTransport struct {
+	observer func(RequestMetrics)
+	base     http.RoundTripper
+}
+
+func (t *metricsTransport) unwrap() http.RoundTripper { return t.base }
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	sent := new(atomic.Int64)
+	if req.Body != nil && req.Body != http.NoBody {
+		newReq := *req
+		newReq.Body = &countingReader{ReadCloser: req.Body, n: sent}
+		if getBody := req.GetBody; getBody != nil {
+			// The base transport may replay the body when a connection
+			// fails, only the bytes of the last attempt are counted.
+			newReq.GetBody = func() (io.ReadCloser, error) {
+				body, err := getBody()
+				if err != nil {
+					return nil, err
+				}
+				sent.Store(0)
+				return &countingReader{ReadCloser: body, n: sent}, nil
+			}
+		}
+		req = &newReq
+	}
+	m := RequestMetrics{
+		Method:    req.Method,
+		URL:       redactURL(req.URL),
+		RequestID: req.Header.Get(requestIDHeaderKey),
+	}
+	if m.Method == "" {
+		m.Method = http.MethodGet
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		m.RequestBytes = sent.Load()
+		m.Duration = time.Since(start)
+		m.Err = err
+		t.observer(m)
+		return resp, err
+	}
+	m.StatusCode = resp.StatusCode
+	received := new(atomic.Int64)
+	resp.Body = &metricsBody{
+		countingReader: countingReader{ReadCloser: resp.Body, n: received},
+		report: func() {
+			m.RequestBytes = sent.Load()
+			m.ResponseBytes = received.Load()
+			m.Duration = time.Since(start)
+			t.observer(m)
+		},
+	}
+	return resp, nil
+}
+
+// countingReader adds the number of bytes read from the wrapped reader to n.
+type countingReader struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+// metricsBody is a response body that calls report once when it is first
+// closed.
+type metricsBody struct {
+	countingReader
+	report func()
+	once   sync.Once
+}
+
+func (b *metricsBody) Close() error {
+	err := b.countingReader.Close()
+	b.once.Do(b.report)
+	return err
+}
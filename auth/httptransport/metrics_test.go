@@ -0,0 +1,167 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httptransport
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/auth/internal/testutil"
+)
+
+func TestNewClient_MetricsObserver(t *testing.T) {
+	var attempts int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// Stream the response in chunks.
+		for i := 0; i < 5; i++ {
+			io.WriteString(w, strings.Repeat("a", 100))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer ts.Close()
+	var mu sync.Mutex
+	var got []RequestMetrics
+	client, err := NewClient(&Options{
+		TokenProvider:       testutil.StaticTokenProvider("fakeToken"),
+		RetryOnUnauthorized: true,
+		AutoIdempotencyKey:  true,
+		MetricsObserver: func(m RequestMetrics) {
+			mu.Lock()
+			defer mu.Unlock()
+			got = append(got, m)
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	resp, err := client.Post(ts.URL+"/v1/foo?key=secret", "text/plain", strings.NewReader(strings.Repeat("b", 1000)))
+	if err != nil {
+		t.Fatalf("client.Post() = %v", err)
+	}
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if len(got) != 1 {
+		t.Errorf("got %d metrics before the body was closed, want 1", len(got))
+	}
+	mu.Unlock()
+	resp.Body.Close()
+	resp.Body.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 2 {
+		t.Fatalf("got %d metrics, want 2", len(got))
+	}
+	want := []RequestMetrics{
+		{StatusCode: http.StatusUnauthorized, RequestBytes: 1000, ResponseBytes: 0},
+		{StatusCode: http.StatusOK, RequestBytes: 1000, ResponseBytes: 500},
+	}
+	for i, m := range got {
+		if m.Method != http.MethodPost {
+			t.Errorf("metrics %d: got method %q, want %q", i, m.Method, http.MethodPost)
+		}
+		if m.URL != ts.URL+"/v1/foo?key=REDACTED" {
+			t.Errorf("metrics %d: got URL %q, want the API key redacted", i, m.URL)
+		}
+		if m.StatusCode != want[i].StatusCode || m.RequestBytes != want[i].RequestBytes || m.ResponseBytes != want[i].ResponseBytes {
+			t.Errorf("metrics %d: got status %d, %d bytes sent, %d bytes received, want status %d, %d bytes sent, %d bytes received",
+				i, m.StatusCode, m.RequestBytes, m.ResponseBytes, want[i].StatusCode, want[i].RequestBytes, want[i].ResponseBytes)
+		}
+		if m.Err != nil {
+			t.Errorf("metrics %d: got error %v, want nil", i, m.Err)
+		}
+	}
+}
+
+func TestMetricsTransport_GetBody(t *testing.T) {
+	rt := &recordingRT{}
+	var got RequestMetrics
+	trans := &metricsTransport{
+		observer: func(m RequestMetrics) { got = m },
+		base:     rt,
+	}
+	req, err := http.NewRequest(http.MethodPut, "https://foo.googleapis.com", strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := trans.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() = %v", err)
+	}
+	// Read the body partially, then replay it as the base transport does
+	// when a connection fails.
+	if _, err := rt.req.Body.Read(make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if rt.req.GetBody == nil {
+		t.Fatal("GetBody is not set")
+	}
+	body, err := rt.req.GetBody()
+	if err != nil {
+		t.Fatalf("GetBody() = %v", err)
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "body" {
+		t.Errorf("got body %q, want %q", b, "body")
+	}
+	resp.Body.Close()
+	if got.RequestBytes != 4 {
+		t.Errorf("got %d bytes sent, want 4", got.RequestBytes)
+	}
+}
+
+func TestMetricsTransport_Error(t *testing.T) {
+	wantErr := errors.New("connection refused")
+	var got RequestMetrics
+	var calls int
+	trans := &metricsTransport{
+		observer: func(m RequestMetrics) {
+			calls++
+			got = m
+		},
+		base: testutil.RoundTripperFunc(func(*http.Request) (*http.Response, error) {
+			return nil, wantErr
+		}),
+	}
+	req, err := http.NewRequest(http.MethodGet, "https://foo.googleapis.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := trans.RoundTrip(req); !errors.Is(err, wantErr) {
+		t.Fatalf("RoundTrip() = %v, want %v", err, wantErr)
+	}
+	if calls != 1 {
+		t.Fatalf("got %d calls, want 1", calls)
+	}
+	if !errors.Is(got.Err, wantErr) || got.StatusCode != 0 {
+		t.Errorf("got error %v and status %d, want %v and 0", got.Err, got.StatusCode, wantErr)
+	}
+}
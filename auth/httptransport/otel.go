@@ -0,0 +1,142 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httptransport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// tracerName is the instrumentation scope of the spans of this package.
+	tracerName = "cloud.google.com/go/auth/httptransport"
+
+	tokenSpanName = "httptransport.Token"
+
+	// requestIDAttributeKey records the X-Request-Id header of a request, as
+	// named by the semantic conventions for request headers.
+	requestIDAttributeKey = attribute.Key("http.request.header.x_request_id")
+)
+
+var (
+	// telemetryCheckTraceID and telemetryCheckSpanID identify the unsampled
+	// parent of the span RequireTelemetry checks TracerProvider with.
+	telemetryCheckTraceID = trace.TraceID{0: 1}
+	telemetryCheckSpanID  = trace.SpanID{0: 1}
+)
+
+// newTracer returns the tracer used for OpenTelemetry spans, or nil if
+// OpenTelemetry is not configured. If RequireTelemetry is set, an error is
+// returned if the tracer does not create spans.
+func newTracer(opts *Options) (trace.Tracer, error) {
+	if opts.DisableTelemetry || opts.TracerProvider == nil {
+		return nil, nil
+	}
+	tracer := opts.TracerProvider.Tracer(tracerName)
+	if !opts.RequireTelemetry {
+		return tracer, nil
+	}
+	if tracer == nil {
+		return nil, errors.New("httptransport: RequireTelemetry is set but TracerProvider returned no tracer")
+	}
+	// A no-op provider, such as the global provider before one is
+	// registered, returns the parent span, or a span with an invalid span
+	// context if there is none, in place of a new span. The parent is not
+	// sampled so that samplers that respect it do not record or export the
+	// span.
+	parent := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: telemetryCheckTraceID,
+		SpanID:  telemetryCheckSpanID,
+		Remote:  true,
+	})
+	_, span := tracer.Start(trace.ContextWithRemoteSpanContext(context.Background(), parent), "httptransport.TelemetryCheck")
+	defer span.End()
+	if sc := span.SpanContext(); !sc.IsValid() || sc.SpanID() == parent.SpanID() {
+		return nil, errors.New("httptransport: RequireTelemetry is set but TracerProvider does not create spans")
+	}
+	return tracer, nil
+}
+
+func addOTelTransport(trans http.RoundTripper, tracer trace.Tracer) http.RoundTripper {
+	if tracer == nil {
+		return trans
+	}
+	return &otelTransport{
+		tracer:     tracer,
+		propagator: otel.GetTextMapPropagator(),
+		base:       trans,
+	}
+}
+
+// otelTransport creates a client span for every request. The span ends once
+// the response body is closed, so it covers streamed responses.
+type otelTransport struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+	base       http.RoundTripper
+}
+
+func (t *otelTransport) unwrap() http.RoundTripper { return t.base }
+
+func (t *otelTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := t.tracer.Start(req.Context(), "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPMethod(req.Method),
+			semconv.HTTPURL(redactURL(req.URL)),
+		),
+	)
+	if ids := req.Header.Values(requestIDHeaderKey); len(ids) > 0 {
+		span.SetAttributes(requestIDAttributeKey.StringSlice(ids))
+	}
+	req2 := req.Clone(ctx)
+	t.propagator.Inject(ctx, propagation.HeaderCarrier(req2.Header))
+	resp, err := t.base.RoundTrip(req2)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		return resp, err
+	}
+	span.SetAttributes(semconv.HTTPStatusCode(resp.StatusCode))
+	if resp.StatusCode >= http.StatusBadRequest {
+		span.SetStatus(codes.Error, http.StatusText(resp.StatusCode))
+	}
+	resp.Body = &spanEndingBody{ReadCloser: resp.Body, span: span}
+	return resp, nil
+}
+
+// spanEndingBody ends a span once the body is closed.
+type spanEndingBody struct {
+	io.ReadCloser
+	span trace.Span
+	once sync.Once
+}
+
+func (b *spanEndingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.span.End() })
+	return err
+}
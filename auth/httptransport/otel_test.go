@@ -0,0 +1,179 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httptransport
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"cloud.google.com/go/auth/internal/testutil"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestNewClient_TracerProvider(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	client, err := NewClient(&Options{
+		BaseRoundTripper: &recordingRT{},
+		TokenProvider:    testutil.StaticTokenProvider("fakeToken"),
+		TracerProvider:   tp,
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	resp, err := client.Get("https://foo.googleapis.com/v1/foo?key=secret")
+	if err != nil {
+		t.Fatalf("client.Get() = %v", err)
+	}
+	if n := len(recorder.Ended()); n != 1 {
+		t.Fatalf("got %d ended spans before the body was closed, want 1", n)
+	}
+	resp.Body.Close()
+	resp.Body.Close()
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	tokenSpan, reqSpan := spans[0], spans[1]
+	if tokenSpan.Name() != tokenSpanName {
+		t.Errorf("got span name %q, want %q", tokenSpan.Name(), tokenSpanName)
+	}
+	if tokenSpan.Parent().SpanID() != reqSpan.SpanContext().SpanID() {
+		t.Error("token span is not a child of the request span")
+	}
+	if reqSpan.Name() != "HTTP GET" {
+		t.Errorf("got span name %q, want %q", reqSpan.Name(), "HTTP GET")
+	}
+	if reqSpan.SpanKind() != trace.SpanKindClient {
+		t.Errorf("got span kind %v, want %v", reqSpan.SpanKind(), trace.SpanKindClient)
+	}
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range reqSpan.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	if got := attrs[semconv.HTTPMethodKey].AsString(); got != http.MethodGet {
+		t.Errorf("got %s %q, want %q", semconv.HTTPMethodKey, got, http.MethodGet)
+	}
+	if got := attrs[semconv.HTTPStatusCodeKey].AsInt64(); got != http.StatusOK {
+		t.Errorf("got %s %d, want %d", semconv.HTTPStatusCodeKey, got, http.StatusOK)
+	}
+	if got, want := attrs[semconv.HTTPURLKey].AsString(), "https://foo.googleapis.com/v1/foo?key=REDACTED"; got != want {
+		t.Errorf("got %s %q, want %q", semconv.HTTPURLKey, got, want)
+	}
+}
+
+func TestNewClient_TracerProviderTokenError(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	client, err := NewClient(&Options{
+		BaseRoundTripper: &recordingRT{},
+		TokenProvider:    &fixedTP{err: errors.New("no token")},
+		TracerProvider:   tp,
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	if _, err := client.Get("https://foo.googleapis.com/v1/foo"); err == nil {
+		t.Fatal("client.Get() = _, nil, want error")
+	}
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	for _, s := range spans {
+		if s.Status().Code != codes.Error {
+			t.Errorf("span %q: got status %v, want %v", s.Name(), s.Status().Code, codes.Error)
+		}
+	}
+}
+
+func TestNewClient_TracerProviderDisableTelemetry(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	client, err := NewClient(&Options{
+		BaseRoundTripper: &recordingRT{},
+		TokenProvider:    testutil.StaticTokenProvider("fakeToken"),
+		TracerProvider:   tp,
+		DisableTelemetry: true,
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	resp, err := client.Get("https://foo.googleapis.com/v1/foo")
+	if err != nil {
+		t.Fatalf("client.Get() = %v", err)
+	}
+	resp.Body.Close()
+	if n := len(recorder.Ended()); n != 0 {
+		t.Errorf("got %d spans, want 0", n)
+	}
+}
+
+func TestNewClient_RequireTelemetry(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tests := []struct {
+		name    string
+		opts    *Options
+		wantErr bool
+	}{
+		{
+			name: "recording provider",
+			opts: &Options{
+				TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)),
+			},
+		},
+		{
+			name: "no-op provider",
+			opts: &Options{
+				TracerProvider: trace.NewNoopTracerProvider(),
+			},
+			wantErr: true,
+		},
+		{
+			name:    "default telemetry",
+			opts:    &Options{},
+			wantErr: true,
+		},
+		{
+			name: "telemetry disabled",
+			opts: &Options{
+				TracerProvider:   sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)),
+				DisableTelemetry: true,
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.BaseRoundTripper = &recordingRT{}
+			tt.opts.TokenProvider = testutil.StaticTokenProvider("fakeToken")
+			tt.opts.RequireTelemetry = true
+			_, err := NewClient(tt.opts)
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Fatalf("NewClient() = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+	if n := len(recorder.Started()); n != 0 {
+		t.Errorf("got %d spans started, want the check not to record any", n)
+	}
+}
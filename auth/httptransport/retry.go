@@ -0,0 +1,271 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httptransport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/auth"
+)
+
+const (
+	defaultMaxBackoff    = 30 * time.Second
+	defaultMaxRetryAfter = 30 * time.Second
+)
+
+var (
+	// for testing
+	defaultInitialBackoff = 200 * time.Millisecond
+)
+
+// Backoff decides how long the retries of a client created by [NewClient]
+// pause for. Implementations must be safe for concurrent use.
+type Backoff interface {
+	// Pause returns the time to wait before the retry with the provided
+	// number, starting at 1 for the first retry of an operation.
+	Pause(attempt int) time.Duration
+}
+
+// ExponentialBackoff is a [Backoff] whose pauses grow exponentially with the
+// number of the retry, with jitter so that clients started together do not
+// retry in lockstep. It is the default Backoff of [Options].
+type ExponentialBackoff struct {
+	// Initial is the upper bound of the first pause. If unset, the default
+	// value is 200 milliseconds.
+	Initial time.Duration
+	// Max is the upper bound of all pauses. If unset, the default value is 30
+	// seconds.
+	Max time.Duration
+	// Multiplier is the factor the upper bound grows by with every retry. If
+	// unset, the default value is 2.
+	Multiplier float64
+}
+
+// Pause returns a random duration in [d/2, d], where d is Initial multiplied
+// by Multiplier once for every retry after the first, capped at Max.
+func (b *ExponentialBackoff) Pause(attempt int) time.Duration {
+	initial, max, mult := b.Initial, b.Max, b.Multiplier
+	if initial <= 0 {
+		initial = defaultInitialBackoff
+	}
+	if max <= 0 {
+		max = defaultMaxBackoff
+	}
+	if mult < 1 {
+		mult = 2
+	}
+	d := float64(initial)
+	for i := 1; i < attempt && d < float64(max); i++ {
+		d *= mult
+	}
+	if d > float64(max) {
+		d = float64(max)
+	}
+	half := time.Duration(d) / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// backoff returns the Backoff of o, or the default one if it is unset.
+func (o *Options) backoff() Backoff {
+	if o.Backoff != nil {
+		return o.Backoff
+	}
+	return &ExponentialBackoff{}
+}
+
+// pause waits for d, returning the error of ctx early if it is done first.
+func pause(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// withFetchRetries wraps tp so that transient failures to fetch a token are
+// retried up to TokenFetchRetries times. tp is returned unmodified if retries
+// are not enabled.
+func (o *Options) withFetchRetries(tp auth.TokenProvider) auth.TokenProvider {
+	if o.TokenFetchRetries <= 0 {
+		return tp
+	}
+	return &retryingProvider{tp: tp, retries: o.TokenFetchRetries, backoff: o.backoff()}
+}
+
+// retryingProvider retries transient token fetch failures, pausing as
+// decided by backoff.
+type retryingProvider struct {
+	tp      auth.TokenProvider
+	retries int
+	backoff Backoff
+}
+
+func (p *retryingProvider) Token(ctx context.Context) (*auth.Token, error) {
+	for attempt := 1; ; attempt++ {
+		token, err := p.tp.Token(ctx)
+		if err == nil {
+			return token, nil
+		}
+		if !isTransientTokenError(err) {
+			return nil, err
+		}
+		if attempt > p.retries {
+			return nil, fmt.Errorf("httptransport: token fetch failed after %d attempts: %w", attempt, err)
+		}
+		if pause(ctx, p.backoff.Pause(attempt)) != nil {
+			return nil, fmt.Errorf("httptransport: token fetch aborted after %d attempts: %w", attempt, err)
+		}
+	}
+}
+
+// isTransientTokenError reports whether err, returned by a token provider, is
+// likely to succeed if the fetch is retried: a 5xx response from the token
+// endpoint, a timeout, or a reset connection.
+func isTransientTokenError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var aerr *auth.Error
+	if errors.As(err, &aerr) {
+		return aerr.Response != nil && aerr.Response.StatusCode >= http.StatusInternalServerError
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET)
+}
+
+func addRetryAfterTransport(trans http.RoundTripper, opts *Options) http.RoundTripper {
+	if !opts.HonorRetryAfter {
+		return trans
+	}
+	maxWait := opts.MaxRetryAfter
+	if maxWait == 0 {
+		maxWait = defaultMaxRetryAfter
+	}
+	return &retryAfterTransport{
+		maxWait:     maxWait,
+		allowUnsafe: opts.AllowUnsafeRetries,
+		backoff:     opts.backoff(),
+		base:        trans,
+	}
+}
+
+// retryAfterTransport replays requests that are safe to replay once after
+// the delay requested by the Retry-After header of a 429 or 503 response.
+type retryAfterTransport struct {
+	maxWait time.Duration
+	// allowUnsafe replays requests even if they are not safe to replay.
+	allowUnsafe bool
+	// backoff decides the pause before the retry if it is longer than the
+	// requested delay, up to maxWait.
+	backoff Backoff
+	base    http.RoundTripper
+}
+
+func (t *retryAfterTransport) unwrap() http.RoundTripper { return t.base }
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || (resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable) {
+		return resp, err
+	}
+	if !(t.allowUnsafe || safeToReplay(req)) || !canReplay(req) {
+		return resp, nil
+	}
+	wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"))
+	if !ok || wait > t.maxWait {
+		return resp, nil
+	}
+	req2 := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		req2.Body = body
+	}
+	if d := t.backoff.Pause(1); d > wait {
+		wait = d
+	}
+	if wait > t.maxWait {
+		wait = t.maxWait
+	}
+	// Drain the body so the underlying connection can be reused.
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if err := pause(req.Context(), wait); err != nil {
+		if req2.Body != nil {
+			req2.Body.Close()
+		}
+		return nil, fmt.Errorf("httptransport: waiting to retry request: %w", err)
+	}
+	return t.base.RoundTrip(req2)
+}
+
+// isIdempotent reports whether req uses a method that is idempotent as
+// defined by RFC 7231, section 4.2.2.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// safeToReplay reports whether req can be sent again without risking
+// duplicate side effects, because its method is idempotent or it carries an
+// idempotency key that lets the service deduplicate the attempts.
+func safeToReplay(req *http.Request) bool {
+	return isIdempotent(req) || req.Header.Get(idempotencyHeaderKey) != ""
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either a
+// number of seconds or an HTTP date, into the delay it requests.
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	date, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	if d := time.Until(date); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
@@ -0,0 +1,464 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httptransport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/auth"
+	"cloud.google.com/go/auth/internal/testutil"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRetryingProvider(t *testing.T) {
+	defer func(d time.Duration) { defaultInitialBackoff = d }(defaultInitialBackoff)
+	defaultInitialBackoff = time.Millisecond
+
+	tests := []struct {
+		name      string
+		err       error
+		failures  int
+		retries   int
+		wantCalls int
+		wantErr   string
+	}{
+		{
+			name:      "no retries configured",
+			err:       statusError(http.StatusServiceUnavailable),
+			failures:  1,
+			wantCalls: 1,
+			wantErr:   "cannot fetch token",
+		},
+		{
+			name:      "recovers from 5xx",
+			err:       statusError(http.StatusInternalServerError),
+			failures:  2,
+			retries:   3,
+			wantCalls: 3,
+		},
+		{
+			name:      "recovers from connection reset",
+			err:       fmt.Errorf("read: %w", syscall.ECONNRESET),
+			failures:  1,
+			retries:   1,
+			wantCalls: 2,
+		},
+		{
+			name:      "recovers from timeout",
+			err:       timeoutError{},
+			failures:  1,
+			retries:   1,
+			wantCalls: 2,
+		},
+		{
+			name:      "retries exhausted",
+			err:       statusError(http.StatusBadGateway),
+			failures:  5,
+			retries:   2,
+			wantCalls: 3,
+			wantErr:   "after 3 attempts",
+		},
+		{
+			name:      "bad request not retried",
+			err:       statusError(http.StatusBadRequest),
+			failures:  1,
+			retries:   3,
+			wantCalls: 1,
+			wantErr:   "cannot fetch token",
+		},
+		{
+			name:      "unauthorized not retried",
+			err:       statusError(http.StatusUnauthorized),
+			failures:  1,
+			retries:   3,
+			wantCalls: 1,
+			wantErr:   "cannot fetch token",
+		},
+		{
+			name:      "other errors not retried",
+			err:       errors.New("bad credentials file"),
+			failures:  1,
+			retries:   3,
+			wantCalls: 1,
+			wantErr:   "bad credentials file",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tp := &failingTP{err: tt.err, failures: tt.failures}
+			tok, err := (&Options{TokenFetchRetries: tt.retries}).withFetchRetries(tp).Token(context.Background())
+			if tp.calls != tt.wantCalls {
+				t.Errorf("got %d calls, want %d", tp.calls, tt.wantCalls)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Token() = %v, want error containing %q", err, tt.wantErr)
+				}
+				if !errors.Is(err, tt.err) {
+					t.Errorf("Token() = %v, want it to wrap %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Token() = %v", err)
+			}
+			if tok.Value != "fakeToken" {
+				t.Errorf("got %q, want %q", tok.Value, "fakeToken")
+			}
+		})
+	}
+}
+
+func TestRetryingProvider_ContextDone(t *testing.T) {
+	defer func(d time.Duration) { defaultInitialBackoff = d }(defaultInitialBackoff)
+	defaultInitialBackoff = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	tp := &failingTP{err: statusError(http.StatusServiceUnavailable), failures: 1}
+	_, err := (&Options{TokenFetchRetries: 3}).withFetchRetries(tp).Token(ctx)
+	if err == nil || !strings.Contains(err.Error(), "after 1 attempts") {
+		t.Fatalf("Token() = %v, want aborted error", err)
+	}
+	if tp.calls != 1 {
+		t.Errorf("got %d calls, want 1", tp.calls)
+	}
+}
+
+func TestNewClient_TokenFetchRetries(t *testing.T) {
+	defer func(d time.Duration) { defaultInitialBackoff = d }(defaultInitialBackoff)
+	defaultInitialBackoff = time.Millisecond
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.Header.Get("Authorization"), "Bearer fakeToken"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}))
+	defer ts.Close()
+	tp := &failingTP{err: statusError(http.StatusServiceUnavailable), failures: 2}
+	client, err := NewClient(&Options{
+		TokenProvider:     tp,
+		TokenFetchRetries: 2,
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	resp.Body.Close()
+	if tp.calls != 3 {
+		t.Errorf("got %d calls, want 3", tp.calls)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	b := &ExponentialBackoff{Initial: 100 * time.Millisecond, Max: time.Second}
+	for _, tt := range []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{attempt: 1, max: 100 * time.Millisecond},
+		{attempt: 2, max: 200 * time.Millisecond},
+		{attempt: 3, max: 400 * time.Millisecond},
+		{attempt: 10, max: time.Second},
+	} {
+		for i := 0; i < 100; i++ {
+			if d := b.Pause(tt.attempt); d < tt.max/2 || d > tt.max {
+				t.Fatalf("Pause(%d) = %v, want in [%v, %v]", tt.attempt, d, tt.max/2, tt.max)
+			}
+		}
+	}
+}
+
+// recordingBackoff records the attempts it is asked to pause for and pauses
+// for d.
+type recordingBackoff struct {
+	d        time.Duration
+	mu       sync.Mutex
+	attempts []int
+}
+
+func (b *recordingBackoff) Pause(attempt int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.attempts = append(b.attempts, attempt)
+	return b.d
+}
+
+func TestNewClient_Backoff(t *testing.T) {
+	var hits int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		switch hits {
+		case 1:
+			w.WriteHeader(http.StatusUnauthorized)
+		case 2:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+	b := &recordingBackoff{}
+	tp := &failingTP{err: statusError(http.StatusServiceUnavailable), failures: 2}
+	client, err := NewClient(&Options{
+		TokenProvider:       tp,
+		TokenFetchRetries:   2,
+		RetryOnUnauthorized: true,
+		HonorRetryAfter:     true,
+		DisableTokenCache:   true,
+		Backoff:             b,
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	resp.Body.Close()
+	if hits != 3 {
+		t.Errorf("got %d requests, want 3", hits)
+	}
+	// Two token fetch retries, the replay of the 401, and the retry after
+	// the 503.
+	if diff := cmp.Diff([]int{1, 2, 1, 1}, b.attempts); diff != "" {
+		t.Errorf("Pause() attempts mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestNewClient_BackoffContextDone(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+	client, err := NewClient(&Options{
+		TokenProvider:       testutil.StaticTokenProvider("fakeToken"),
+		RetryOnUnauthorized: true,
+		Backoff:             &recordingBackoff{d: time.Hour},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Do(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("client.Do() = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// failingTP returns err for the first failures calls and a token afterwards.
+type failingTP struct {
+	err      error
+	failures int
+	calls    int
+}
+
+func (tp *failingTP) Token(context.Context) (*auth.Token, error) {
+	tp.calls++
+	if tp.calls <= tp.failures {
+		return nil, tp.err
+	}
+	return &auth.Token{Value: "fakeToken"}, nil
+}
+
+func statusError(code int) *auth.Error {
+	return &auth.Error{Response: &http.Response{StatusCode: code}}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestNewClient_HonorRetryAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		retryAfter string
+		maxWait    time.Duration
+		wantCalls  int
+		wantStatus int
+	}{
+		{
+			name:       "seconds",
+			method:     http.MethodGet,
+			retryAfter: "0",
+			wantCalls:  2,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "http date",
+			method:     http.MethodGet,
+			retryAfter: time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat),
+			wantCalls:  2,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "replayable body",
+			method:     http.MethodPut,
+			body:       "hello",
+			retryAfter: "0",
+			wantCalls:  2,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "non-idempotent method",
+			method:     http.MethodPost,
+			retryAfter: "0",
+			wantCalls:  1,
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "exceeds max wait",
+			method:     http.MethodGet,
+			retryAfter: "120",
+			maxWait:    time.Second,
+			wantCalls:  1,
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "unparseable",
+			method:     http.MethodGet,
+			retryAfter: "soon",
+			wantCalls:  1,
+			wantStatus: http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				b, err := io.ReadAll(r.Body)
+				if err != nil {
+					t.Error(err)
+				}
+				if got := string(b); got != tt.body {
+					t.Errorf("got body %q, want %q", got, tt.body)
+				}
+				if calls == 1 {
+					w.Header().Set("Retry-After", tt.retryAfter)
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+			}))
+			defer ts.Close()
+			client, err := NewClient(&Options{
+				DisableAuthentication: true,
+				HonorRetryAfter:       true,
+				MaxRetryAfter:         tt.maxWait,
+			})
+			if err != nil {
+				t.Fatalf("NewClient() = %v", err)
+			}
+			req, err := http.NewRequest(tt.method, ts.URL, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("client.Do() = %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("got %d calls, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestNewClient_HonorRetryAfterBackoffCapped(t *testing.T) {
+	var calls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+	client, err := NewClient(&Options{
+		DisableAuthentication: true,
+		HonorRetryAfter:       true,
+		MaxRetryAfter:         10 * time.Millisecond,
+		Backoff:               &recordingBackoff{d: time.Hour},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	// Without the cap the backoff would outlast the context.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("client.Do() = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || calls != 2 {
+		t.Errorf("got status %d after %d calls, want %d after 2", resp.StatusCode, calls, http.StatusOK)
+	}
+}
+
+func TestNewClient_HonorRetryAfterContextDone(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "10")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer ts.Close()
+	client, err := NewClient(&Options{
+		DisableAuthentication: true,
+		HonorRetryAfter:       true,
+	})
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := client.Do(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("client.Do() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("request took %v, want it to abort when the context is done", d)
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httptransport
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/auth"
+	"cloud.google.com/go/auth/detect"
+	"cloud.google.com/go/auth/internal"
+	"cloud.google.com/go/auth/internal/internaldetect"
+	"cloud.google.com/go/compute/metadata"
+)
+
+// signBlobRequest is the request body of the IAM Credentials signBlob method.
+type signBlobRequest struct {
+	Delegates []string `json:"delegates,omitempty"`
+	Payload   []byte   `json:"payload"`
+}
+
+// signBlobResponse is the response body of the IAM Credentials signBlob
+// method.
+type signBlobResponse struct {
+	KeyID      string `json:"keyId"`
+	SignedBlob []byte `json:"signedBlob"`
+}
+
+// SignBytes signs payload with the service account of the credentials that a
+// client created by [NewClient] with the provided [Options] would use, as is
+// needed to create signed URLs. The payload is signed with RSA SHA-256 using
+// the private key of the credentials if they contain one, and with the IAM
+// Credentials signBlob API otherwise. The ID of the key used is returned along
+// with the signature.
+//
+// If ImpersonateServiceAccount is set, the payload is signed as that service
+// account. An error is returned if the credentials do not belong to a service
+// account, for example user credentials, or if authentication is disabled or
+// an API key is used.
+func SignBytes(ctx context.Context, opts *Options, payload []byte) (keyID string, signature []byte, err error) {
+	if err := opts.validate(); err != nil {
+		return "", nil, err
+	}
+	if opts.DisableAuthentication {
+		return "", nil, errors.New("httptransport: unable to sign bytes when DisableAuthentication is set")
+	}
+	if opts.usesAPIKey() {
+		return "", nil, errors.New("httptransport: unable to sign bytes when APIKey is set")
+	}
+	// Signing never needs the scopes of the client, only permission to call
+	// the IAM Credentials API.
+	do := opts.resolveDetectOptionsWithScopes([]string{cloudPlatformScope})
+	o := opts.Clone()
+	o.ImpersonateServiceAccount = ""
+	o.ImpersonateDelegates = nil
+	if opts.ImpersonateServiceAccount != "" {
+		tp := o.TokenProvider
+		if tp == nil {
+			_, tp, err = o.detectTokenProvider(do)
+			if err != nil {
+				return "", nil, err
+			}
+		}
+		delegates := make([]string, len(opts.ImpersonateDelegates))
+		for i, v := range opts.ImpersonateDelegates {
+			delegates[i] = serviceAccountResource(v)
+		}
+		return o.signBlob(ctx, tp, opts.ImpersonateServiceAccount, delegates, payload)
+	}
+	if o.TokenProvider != nil {
+		return "", nil, errors.New("httptransport: unable to determine the service account to sign bytes with from TokenProvider, set ImpersonateServiceAccount")
+	}
+	creds, tp, err := o.detectTokenProvider(do)
+	if err != nil {
+		return "", nil, err
+	}
+	sa, err := credentialsServiceAccount(creds, do, "sign bytes")
+	if err != nil {
+		return "", nil, err
+	}
+	switch {
+	case sa.key != nil:
+		sig, err := signWithKey([]byte(sa.key.PrivateKey), payload)
+		if err != nil {
+			return "", nil, err
+		}
+		return sa.key.PrivateKeyID, sig, nil
+	case sa.compute:
+		email, err := metadata.Email("default")
+		if err != nil {
+			return "", nil, fmt.Errorf("httptransport: unable to get the service account email from the metadata server: %w", err)
+		}
+		return o.signBlob(ctx, tp, email, nil, payload)
+	default:
+		return o.signBlob(ctx, tp, sa.email, nil, payload)
+	}
+}
+
+// serviceAccount is the service account that detected credentials act as.
+// Exactly one of its fields is set.
+type serviceAccount struct {
+	// key is the parsed file of service account key credentials.
+	key *internaldetect.ServiceAccountFile
+	// email is the service account impersonated by impersonated service
+	// account or external account credentials.
+	email string
+	// compute reports the default service account of the metadata server.
+	compute bool
+}
+
+// credentialsServiceAccount returns the service account that creds, detected
+// with do, act as. action names what the service account is needed for in the
+// errors returned for credentials that don't act as one, such as "sign bytes".
+func credentialsServiceAccount(creds *detect.Credentials, do *detect.Options, action string) (*serviceAccount, error) {
+	if creds.FromMetadataServer() {
+		return &serviceAccount{compute: true}, nil
+	}
+	b := creds.JSON()
+	if len(b) == 0 {
+		// Credentials of DetectOpts.ExternalAccount are built without JSON.
+		if do.ExternalAccount == nil {
+			return nil, fmt.Errorf("httptransport: unable to determine the service account to %s with", action)
+		}
+		if do.ExternalAccount.ServiceAccountImpersonationURL == "" {
+			return nil, fmt.Errorf("httptransport: external account credentials can only %s when they impersonate a service account", action)
+		}
+		return impersonatedServiceAccount(do.ExternalAccount.ServiceAccountImpersonationURL)
+	}
+	fileType, err := internaldetect.ParseFileType(b)
+	if err != nil {
+		return nil, err
+	}
+	var impersonationURL string
+	switch fileType {
+	case internaldetect.ServiceAccountKey:
+		f, err := internaldetect.ParseServiceAccount(b)
+		if err != nil {
+			return nil, err
+		}
+		return &serviceAccount{key: f}, nil
+	case internaldetect.ImpersonatedServiceAccountKey:
+		f, err := internaldetect.ParseImpersonatedServiceAccount(b)
+		if err != nil {
+			return nil, err
+		}
+		impersonationURL = f.ServiceAccountImpersonationURL
+	case internaldetect.ExternalAccountKey:
+		f, err := internaldetect.ParseExternalAccount(b)
+		if err != nil {
+			return nil, err
+		}
+		if f.ServiceAccountImpersonationURL == "" {
+			return nil, fmt.Errorf("httptransport: external account credentials can only %s when they impersonate a service account", action)
+		}
+		impersonationURL = f.ServiceAccountImpersonationURL
+	case internaldetect.UserCredentialsKey:
+		return nil, fmt.Errorf("httptransport: user credentials can not %s, use a service account or set ImpersonateServiceAccount", action)
+	default:
+		return nil, fmt.Errorf("httptransport: unable to %s with credentials of type %q", action, fileType)
+	}
+	return impersonatedServiceAccount(impersonationURL)
+}
+
+// impersonatedServiceAccount returns the service account targeted by the
+// generateAccessToken URL u of the IAM Credentials API.
+func impersonatedServiceAccount(u string) (*serviceAccount, error) {
+	email, err := impersonatedEmail(u)
+	if err != nil {
+		return nil, err
+	}
+	return &serviceAccount{email: email}, nil
+}
+
+// signWithKey signs payload with RSA SHA-256 using the PEM encoded key.
+func signWithKey(key, payload []byte) ([]byte, error) {
+	pk, err := internal.ParseKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("httptransport: unable to parse private key: %w", err)
+	}
+	sum := sha256.Sum256(payload)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, pk, crypto.SHA256, sum[:])
+	if err != nil {
+		return nil, fmt.Errorf("httptransport: unable to sign bytes: %w", err)
+	}
+	return sig, nil
+}
+
+// impersonatedEmail returns the email of the service account targeted by a
+// generateAccessToken URL of the IAM Credentials API.
+func impersonatedEmail(u string) (string, error) {
+	i := strings.LastIndex(u, "/")
+	email := strings.TrimSuffix(u[i+1:], ":generateAccessToken")
+	if email == "" || email == u[i+1:] {
+		return "", fmt.Errorf("httptransport: unable to determine the impersonated service account from %q", u)
+	}
+	return email, nil
+}
+
+// signBlob signs payload as the service account with the provided email using
+// the IAM Credentials signBlob API, authorized by tokens from tp.
+func (o *Options) signBlob(ctx context.Context, tp auth.TokenProvider, email string, delegates []string, payload []byte) (string, []byte, error) {
+	b, err := json.Marshal(signBlobRequest{
+		Delegates: delegates,
+		Payload:   payload,
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("httptransport: unable to marshal request: %w", err)
+	}
+	u := fmt.Sprintf("%s/v1/%s:signBlob", iamCredentialsEndpoint(o.universeDomain()), serviceAccountResource(email))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(b))
+	if err != nil {
+		return "", nil, fmt.Errorf("httptransport: unable to create signBlob request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := SetAuthHeaderFromProvider(ctx, tp, req); err != nil {
+		return "", nil, err
+	}
+	client := o.client()
+	if client == nil {
+		client = internal.CloneDefaultClient()
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", nil, fmt.Errorf("httptransport: unable to sign bytes: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := internal.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, fmt.Errorf("httptransport: unable to read body: %w", err)
+	}
+	if c := resp.StatusCode; c < http.StatusOK || c >= http.StatusMultipleChoices {
+		return "", nil, fmt.Errorf("httptransport: signBlob status code %d: %s", c, body)
+	}
+	var sbr signBlobResponse
+	if err := json.Unmarshal(body, &sbr); err != nil {
+		return "", nil, fmt.Errorf("httptransport: unable to parse signBlob response: %w", err)
+	}
+	return sbr.KeyID, sbr.SignedBlob, nil
+}
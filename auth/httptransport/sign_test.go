@@ -0,0 +1,254 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httptransport
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/auth/detect"
+	"cloud.google.com/go/auth/internal"
+	"cloud.google.com/go/auth/internal/internaldetect"
+	"cloud.google.com/go/auth/internal/testutil"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSignBytes_PrivateKey(t *testing.T) {
+	b, err := os.ReadFile("../internal/testdata/sa.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := internaldetect.ParseServiceAccount(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := internal.ParseKey([]byte(f.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte("payload")
+	keyID, sig, err := SignBytes(context.Background(), &Options{
+		DetectOpts: &detect.Options{
+			CredentialsJSON: b,
+		},
+	}, payload)
+	if err != nil {
+		t.Fatalf("SignBytes() = %v", err)
+	}
+	if keyID != f.PrivateKeyID {
+		t.Errorf("got key ID %q, want %q", keyID, f.PrivateKeyID)
+	}
+	sum := sha256.Sum256(payload)
+	if err := rsa.VerifyPKCS1v15(&pk.PublicKey, crypto.SHA256, sum[:], sig); err != nil {
+		t.Errorf("signature does not verify: %v", err)
+	}
+}
+
+func TestSignBytes_SignBlob(t *testing.T) {
+	iam := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.URL.Path, "/v1/projects/-/serviceAccounts/target@example.com:signBlob"; got != want {
+			t.Errorf("got path %q, want %q", got, want)
+		}
+		if got, want := r.Header.Get("Authorization"), "Bearer source"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		var body signBlobRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(body.Payload), "payload"; got != want {
+			t.Errorf("got payload %q, want %q", got, want)
+		}
+		if diff := cmp.Diff([]string{"projects/-/serviceAccounts/a@example.com"}, body.Delegates); diff != "" {
+			t.Errorf("delegates mismatch (-want +got):\n%s", diff)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(signBlobResponse{KeyID: "key", SignedBlob: []byte("signature")})
+	}))
+	defer iam.Close()
+	oldEndpoint := iamCredentialsEndpoint
+	iamCredentialsEndpoint = func(string) string { return iam.URL }
+	defer func() { iamCredentialsEndpoint = oldEndpoint }()
+
+	keyID, sig, err := SignBytes(context.Background(), &Options{
+		TokenProvider:             testutil.StaticTokenProvider("source"),
+		ImpersonateServiceAccount: "target@example.com",
+		ImpersonateDelegates:      []string{"a@example.com"},
+	}, []byte("payload"))
+	if err != nil {
+		t.Fatalf("SignBytes() = %v", err)
+	}
+	if keyID != "key" {
+		t.Errorf("got key ID %q, want %q", keyID, "key")
+	}
+	if got, want := string(sig), "signature"; got != want {
+		t.Errorf("got signature %q, want %q", got, want)
+	}
+}
+
+func TestSignBytes_ExternalAccount(t *testing.T) {
+	iam := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/sts":
+			w.Write([]byte(`{"access_token": "federated", "token_type": "Bearer", "expires_in": 3600}`))
+		case "/v1/projects/-/serviceAccounts/target@example.com:generateAccessToken":
+			fmt.Fprintf(w, `{"accessToken": "source", "expireTime": %q}`, time.Now().Add(time.Hour).Format(time.RFC3339))
+		case "/v1/projects/-/serviceAccounts/target@example.com:signBlob":
+			if got, want := r.Header.Get("Authorization"), "Bearer source"; got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+			json.NewEncoder(w).Encode(signBlobResponse{KeyID: "key", SignedBlob: []byte("signature")})
+		default:
+			t.Errorf("unexpected request to %q", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer iam.Close()
+	oldEndpoint := iamCredentialsEndpoint
+	iamCredentialsEndpoint = func(string) string { return iam.URL }
+	defer func() { iamCredentialsEndpoint = oldEndpoint }()
+
+	keyID, sig, err := SignBytes(context.Background(), &Options{
+		DetectOpts: &detect.Options{
+			ExternalAccount: externalAccountOptions(iam.URL+"/sts", iam.URL+"/v1/projects/-/serviceAccounts/target@example.com:generateAccessToken"),
+		},
+	}, []byte("payload"))
+	if err != nil {
+		t.Fatalf("SignBytes() = %v", err)
+	}
+	if keyID != "key" {
+		t.Errorf("got key ID %q, want %q", keyID, "key")
+	}
+	if got, want := string(sig), "signature"; got != want {
+		t.Errorf("got signature %q, want %q", got, want)
+	}
+}
+
+// externalAccountOptions returns options for workload identity federation
+// credentials exchanging a fixed subject token at tokenURL and, if it is set,
+// impersonating the service account of impersonationURL.
+func externalAccountOptions(tokenURL, impersonationURL string) *detect.ExternalAccountOptions {
+	return &detect.ExternalAccountOptions{
+		Audience:                       "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/provider",
+		SubjectTokenType:               "urn:ietf:params:oauth:token-type:jwt",
+		TokenURL:                       tokenURL,
+		ServiceAccountImpersonationURL: impersonationURL,
+		SubjectTokenSupplier: func(context.Context) (string, error) {
+			return "subject", nil
+		},
+	}
+}
+
+func TestSignBytes_SignBlobError(t *testing.T) {
+	iam := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "permission denied", http.StatusForbidden)
+	}))
+	defer iam.Close()
+	oldEndpoint := iamCredentialsEndpoint
+	iamCredentialsEndpoint = func(string) string { return iam.URL }
+	defer func() { iamCredentialsEndpoint = oldEndpoint }()
+
+	if _, _, err := SignBytes(context.Background(), &Options{
+		TokenProvider:             testutil.StaticTokenProvider("source"),
+		ImpersonateServiceAccount: "target@example.com",
+	}, []byte("payload")); err == nil {
+		t.Error("SignBytes() = nil, want error")
+	}
+}
+
+func TestSignBytes_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		opts *Options
+	}{
+		{
+			name: "user credentials",
+			opts: &Options{
+				DetectOpts: &detect.Options{
+					CredentialsFile: "../internal/testdata/user.json",
+				},
+			},
+		},
+		{
+			name: "external account without impersonation",
+			opts: &Options{
+				DetectOpts: &detect.Options{
+					ExternalAccount: externalAccountOptions("https://sts.example.com", ""),
+				},
+			},
+		},
+		{
+			name: "token provider",
+			opts: &Options{
+				TokenProvider: testutil.StaticTokenProvider("fakeToken"),
+			},
+		},
+		{
+			name: "api key",
+			opts: &Options{
+				APIKey: "key",
+			},
+		},
+		{
+			name: "disable authentication",
+			opts: &Options{
+				DisableAuthentication: true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := SignBytes(context.Background(), tt.opts, []byte("payload")); err == nil {
+				t.Error("SignBytes() = nil, want error")
+			}
+		})
+	}
+}
+
+func TestImpersonatedEmail(t *testing.T) {
+	tests := []struct {
+		url     string
+		want    string
+		wantErr bool
+	}{
+		{
+			url:  "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/sa@example.com:generateAccessToken",
+			want: "sa@example.com",
+		},
+		{
+			url:     "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/sa@example.com",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		got, err := impersonatedEmail(tt.url)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("impersonatedEmail(%q) = %v, want error %v", tt.url, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("impersonatedEmail(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
@@ -15,85 +15,194 @@
 package httptransport
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math"
 	"net"
 	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/auth"
-	"cloud.google.com/go/auth/detect"
 	"cloud.google.com/go/auth/internal"
+	"github.com/google/uuid"
 	"go.opencensus.io/plugin/ochttp"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/http/httpguts"
 	"golang.org/x/net/http2"
 )
 
 const (
+	defaultCompressMinBytes = 4 << 10
+
 	quotaProjectHeaderKey = "X-Goog-User-Project"
+	apiKeyHeaderKey       = "X-Goog-Api-Key"
+	apiKeyQueryParamKey   = "key"
+	defaultAuthHeaderName = "Authorization"
+	idempotencyHeaderKey  = "X-Idempotency-Key"
+	requestIDHeaderKey    = "X-Request-Id"
 )
 
 func newTransport(base http.RoundTripper, opts *Options) (http.RoundTripper, error) {
-	var headers = opts.Headers
-	ht := &headerTransport{
-		base:    base,
-		headers: headers,
-	}
-	var trans http.RoundTripper = ht
-	trans = addOCTransport(trans, opts)
+	// Copy the headers so we are not updating a map the user holds and may
+	// reuse.
+	headers := opts.Headers.Clone()
+	var tp auth.TokenProvider
 	switch {
 	case opts.DisableAuthentication:
 		// Do nothing.
-	case opts.APIKey != "":
-		qp := internal.GetQuotaProject(nil, opts.Headers.Get(quotaProjectHeaderKey))
-		if qp != "" {
-			if headers == nil {
-				headers = make(map[string][]string, 1)
-			}
-			headers.Set(quotaProjectHeaderKey, qp)
-		}
-		trans = &apiKeyTransport{
-			Transport: trans,
-			Key:       opts.APIKey,
-		}
+	case opts.usesAPIKey():
+		headers = setQuotaProject(headers, internal.GetQuotaProject(nil, opts.quotaProjectID()))
 	default:
-		creds, err := detect.DefaultCredentials(opts.resolveDetectOptions())
+		rc, err := opts.resolveTokenProvider()
 		if err != nil {
 			return nil, err
 		}
-		qp := creds.QuotaProjectID()
-		if qp != "" {
+		tp = rc.tp
+		headers = setQuotaProject(headers, rc.quotaProjectID)
+		if name := opts.SendProjectIDHeader; name != "" {
+			if rc.projectID == "" {
+				return nil, errors.New("httptransport: SendProjectIDHeader is set but the project ID of the credentials is unknown")
+			}
 			if headers == nil {
-				headers = make(map[string][]string, 1)
+				headers = make(http.Header, 1)
 			}
-			headers.Set(quotaProjectHeaderKey, qp)
+			headers.Set(name, rc.projectID)
 		}
+	}
 
-		var tp auth.TokenProvider = creds
-		if opts.TokenProvider != nil {
-			tp = opts.TokenProvider
+	var trans http.RoundTripper = &headerTransport{
+		base:       addMetricsTransport(base, opts),
+		headers:    headers,
+		headerFunc: opts.HeaderFunc,
+		authHeader: opts.AuthHeaderName,
+		maxBytes:   opts.MaxHeaderBytes,
+	}
+	tracer, err := newTracer(opts)
+	if err != nil {
+		return nil, err
+	}
+	trans = addOCTransport(trans, opts)
+	switch {
+	case opts.DisableAuthentication:
+		// Do nothing.
+	case opts.usesAPIKey():
+		at := &apiKeyTransport{
+			Transport: trans,
+			Key:       opts.APIKey,
+			Placement: opts.APIKeyPlacement,
+
+			skipAuth: opts.skipAuthRules(),
+		}
+		if opts.APIKeyProvider != nil {
+			at.KeyProvider = &cachedAPIKeyProvider{fn: opts.APIKeyProvider, now: opts.now}
+		}
+		trans = at
+	default:
+		at := newAuthTransport(trans, notifyRefreshes(observeFetches(tp, opts.TokenObserver), opts.OnTokenRefresh), opts.cacheTokenProvider)
+		at.retryOnUnauthorized = opts.RetryOnUnauthorized
+		at.retryOnInvalidToken = opts.RetryOnInvalidTokenChallenge
+		at.allowUnsafeRetries = opts.AllowUnsafeRetries
+		at.backoff = opts.backoff()
+		at.proofHeaderFunc = opts.ProofHeaderFunc
+		at.observer = opts.TokenObserver
+		at.onRefresh = opts.OnTokenRefresh
+		at.wrap = func(tp auth.TokenProvider) auth.TokenProvider {
+			return opts.withFallback(opts.withFetchRetries(tp))
 		}
-		trans = &authTransport{
-			base:     trans,
-			provider: auth.NewCachedTokenProvider(tp, nil),
+		at.skipAuth = opts.skipAuthRules()
+		at.headerName = opts.AuthHeaderName
+		at.tokenType = opts.TokenTypeOverride
+		at.tracer = tracer
+		at.minLifetime = opts.MinTokenLifetime
+		at.now = opts.now
+		if opts.TokenProvider == nil && !opts.UseIDToken {
+			at.audienceForHost = lowerKeys(opts.AudienceForHost)
+			at.newProvider = func(scopes []string, audience string) (auth.TokenProvider, error) {
+				do := opts.resolveDetectOptionsWithScopes(scopes)
+				if audience != "" {
+					do = opts.resolveDetectOptionsWithAudience(audience)
+				}
+				_, tp, err := opts.detectTokenProvider(do)
+				if err != nil {
+					return nil, err
+				}
+				return notifyRefreshes(observeFetches(opts.withFallback(tp), opts.TokenObserver), opts.OnTokenRefresh), nil
+			}
 		}
+		trans = at
 	}
+	trans = addOTelTransport(trans, tracer)
+	trans = addGzipTransport(trans, opts)
+	trans = addRetryAfterTransport(trans, opts)
+	trans = addIdempotencyKeyTransport(trans, opts)
+	trans = addLoggingTransport(trans, opts)
+	trans = addTimeoutTransport(trans, opts)
+	trans = addRequestIDTransport(trans, opts)
 	return trans, nil
 }
 
+// setQuotaProject sets the quota project header on headers if qp is not empty,
+// allocating headers if needed.
+func setQuotaProject(headers http.Header, qp string) http.Header {
+	if qp == "" {
+		return headers
+	}
+	if headers == nil {
+		headers = make(http.Header, 1)
+	}
+	headers.Set(quotaProjectHeaderKey, qp)
+	return headers
+}
+
 // defaultBaseTransport returns the base HTTP transport.
 // On App Engine, this is urlfetch.Transport.
 // Otherwise, use a default transport, taking most defaults from
 // http.DefaultTransport.
-// If TLSCertificate is available, set TLSClientConfig as well.
-func defaultBaseTransport(dialTLSContext func(context.Context, string, string) (net.Conn, error)) http.RoundTripper {
+// If opts.TLSConfig is set, a copy of it is used as TLSClientConfig. If
+// clientCertProvider is available, it is set on TLSClientConfig as well. The
+// connection pool limits and proxy set in opts replace the defaults.
+func defaultBaseTransport(opts *Options, clientCertProvider ClientCertProvider, dialTLSContext func(context.Context, string, string) (net.Conn, error)) http.RoundTripper {
 	trans := http.DefaultTransport.(*http.Transport).Clone()
 	trans.MaxIdleConnsPerHost = 100
+	if opts.MaxIdleConnsPerHost != 0 {
+		trans.MaxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+		// The total limit must not cap the limit per host.
+		if trans.MaxIdleConns != 0 && trans.MaxIdleConns < opts.MaxIdleConnsPerHost {
+			trans.MaxIdleConns = opts.MaxIdleConnsPerHost
+		}
+	}
+	if opts.MaxConnsPerHost != 0 {
+		trans.MaxConnsPerHost = opts.MaxConnsPerHost
+	}
+	if opts.IdleConnTimeout != 0 {
+		trans.IdleConnTimeout = opts.IdleConnTimeout
+	}
+	if opts.Proxy != nil {
+		trans.Proxy = opts.Proxy
+	}
 
-	// TODO(codyoss): readd in a future PR
-	// if clientCertSource != nil {
-	// 	trans.TLSClientConfig = &tls.Config{
-	// 		GetClientCertificate: clientCertSource,
-	// 	}
-	// }
+	if opts.TLSConfig != nil {
+		// Clone the config so we are not updating one the user holds and may
+		// reuse, http2.ConfigureTransports below modifies it.
+		trans.TLSClientConfig = opts.TLSConfig.Clone()
+	}
+	if clientCertProvider != nil {
+		if trans.TLSClientConfig == nil {
+			trans.TLSClientConfig = &tls.Config{}
+		}
+		trans.TLSClientConfig.GetClientCertificate = clientCertProvider
+	}
 	if dialTLSContext != nil {
 		// If DialTLSContext is set, TLSClientConfig wil be ignored
 		trans.DialTLSContext = dialTLSContext
@@ -107,8 +216,207 @@ func defaultBaseTransport(dialTLSContext func(context.Context, string, string) (
 	if err == nil {
 		http2Trans.ReadIdleTimeout = time.Second * 31
 	}
+	if !opts.ForceHTTP2 && !opts.AllowH2C {
+		return trans
+	}
+
+	pt := &protocolTransport{base: trans}
+	if opts.ForceHTTP2 {
+		pt.h2 = &http2.Transport{
+			TLSClientConfig: trans.TLSClientConfig,
+			ReadIdleTimeout: time.Second * 31,
+		}
+		if dialTLSContext != nil {
+			pt.h2.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dialTLSContext(ctx, network, addr)
+			}
+		}
+	}
+	if opts.AllowH2C {
+		pt.h2c = &http2.Transport{
+			AllowHTTP: true,
+			// Connections are not encrypted, despite the name.
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+			ReadIdleTimeout: time.Second * 31,
+		}
+	}
+	return pt
+}
+
+// protocolTransport sends https requests over h2 and http requests over h2c,
+// if set, and all other requests over base.
+type protocolTransport struct {
+	base *http.Transport
+	h2   *http2.Transport
+	h2c  *http2.Transport
+}
+
+func (t *protocolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch {
+	case t.h2 != nil && req.URL.Scheme == "https":
+		return t.h2.RoundTrip(req)
+	case t.h2c != nil && req.URL.Scheme == "http":
+		return t.h2c.RoundTrip(req)
+	default:
+		return t.base.RoundTrip(req)
+	}
+}
+
+// CloseIdleConnections closes the idle connections of all protocols.
+func (t *protocolTransport) CloseIdleConnections() {
+	t.base.CloseIdleConnections()
+	if t.h2 != nil {
+		t.h2.CloseIdleConnections()
+	}
+	if t.h2c != nil {
+		t.h2c.CloseIdleConnections()
+	}
+}
+
+// certReloadTransport replaces its base transport, created by newBase, once
+// it is older than interval so that requests open new connections, whose TLS
+// handshakes present the current client certificate. The connections of the
+// replaced transport are closed once idle.
+type certReloadTransport struct {
+	newBase  func() http.RoundTripper
+	interval time.Duration
+	// now replaces time.Now if set.
+	now func() time.Time
+
+	mu      sync.Mutex
+	base    http.RoundTripper
+	created time.Time
+	// prev is the previously replaced base, whose connections that were busy
+	// when it was replaced are closed with the next replacement.
+	prev http.RoundTripper
+}
+
+func newCertReloadTransport(newBase func() http.RoundTripper, interval time.Duration, now func() time.Time) *certReloadTransport {
+	t := &certReloadTransport{
+		newBase:  newBase,
+		interval: interval,
+		now:      now,
+		base:     newBase(),
+	}
+	t.created = t.time()
+	return t
+}
+
+func (t *certReloadTransport) time() time.Time {
+	if t.now != nil {
+		return t.now()
+	}
+	return time.Now()
+}
+
+func (t *certReloadTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.current().RoundTrip(req)
+}
+
+// current returns the base requests should be sent with, replacing it first
+// if it is too old.
+func (t *certReloadTransport) current() http.RoundTripper {
+	now := t.time()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now.Sub(t.created) < t.interval {
+		return t.base
+	}
+	closeIdleConnections(t.prev)
+	t.prev = t.base
+	closeIdleConnections(t.prev)
+	t.base = t.newBase()
+	t.created = now
+	return t.base
+}
+
+// CloseIdleConnections closes the idle connections of the current and the
+// previously replaced base.
+func (t *certReloadTransport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	closeIdleConnections(t.prev)
+	closeIdleConnections(t.base)
+}
+
+func closeIdleConnections(rt http.RoundTripper) {
+	if c, ok := rt.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// addEndpointTransport wraps trans so that requests sent to the host of
+// defaultEndpoint are routed to endpoint instead, and requests sent to the
+// hosts of overrides are routed to their endpoints. Overrides are keyed by
+// lowercase host and take precedence over endpoint. If no request needs to be
+// routed, trans is returned unmodified.
+func addEndpointTransport(trans http.RoundTripper, defaultEndpoint, endpoint string, overrides map[string]*url.URL) (http.RoundTripper, error) {
+	routes := make(map[string]*url.URL, len(overrides)+1)
+	if defaultEndpoint != "" && endpoint != "" && defaultEndpoint != endpoint {
+		from, err := parseEndpoint(defaultEndpoint)
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseEndpoint(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.EqualFold(from.Host, to.Host) || from.Scheme != to.Scheme {
+			routes[strings.ToLower(from.Host)] = to
+		}
+	}
+	for host, to := range overrides {
+		routes[host] = to
+	}
+	if len(routes) == 0 {
+		return trans, nil
+	}
+	return &endpointTransport{
+		routes: routes,
+		base:   trans,
+	}, nil
+}
 
-	return trans
+func parseEndpoint(endpoint string) (*url.URL, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("httptransport: invalid endpoint %q: %w", endpoint, err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("httptransport: invalid endpoint %q: missing host", endpoint)
+	}
+	return u, nil
+}
+
+// endpointTransport routes requests for some hosts to a different scheme and
+// host, preserving the path and query of the request.
+type endpointTransport struct {
+	// routes maps lowercase hosts to the endpoint requests for them are sent
+	// to.
+	routes map[string]*url.URL
+	base   http.RoundTripper
+}
+
+func (t *endpointTransport) unwrap() http.RoundTripper { return t.base }
+
+func (t *endpointTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	to, ok := t.routes[strings.ToLower(req.URL.Host)]
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+	newReq := *req
+	u := *req.URL
+	u.Scheme = to.Scheme
+	u.Host = to.Host
+	newReq.URL = &u
+	newReq.Host = ""
+	return t.base.RoundTrip(&newReq)
 }
 
 type apiKeyTransport struct {
@@ -117,21 +425,105 @@ type apiKeyTransport struct {
 	// Transport is the underlying HTTP transport.
 	// If nil, http.DefaultTransport is used.
 	Transport http.RoundTripper
+	// Placement is where on the request the key is sent.
+	Placement APIKeyPlacement
+	// KeyProvider, if set, provides the key in place of Key.
+	KeyProvider *cachedAPIKeyProvider
+	// skipAuth selects the requests that are sent without a key.
+	skipAuth skipAuthRules
 }
 
+func (t *apiKeyTransport) unwrap() http.RoundTripper { return t.Transport }
+
 func (t *apiKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	newReq := *req
-	args := newReq.URL.Query()
-	args.Set("key", t.Key)
-	newReq.URL.RawQuery = args.Encode()
+	if t.skipAuth.matches(req) {
+		return t.Transport.RoundTrip(req)
+	}
+	key := t.Key
+	if t.KeyProvider != nil {
+		var err error
+		key, err = t.KeyProvider.key(req.Context())
+		if err != nil {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, withRequestID(err, req)
+		}
+	}
+	newReq := *req.WithContext(markAuthenticated(req.Context()))
+	switch t.Placement {
+	case APIKeyPlacementHeader:
+		newReq.Header = req.Header.Clone()
+		if newReq.Header == nil {
+			newReq.Header = make(http.Header, 1)
+		}
+		newReq.Header.Set(apiKeyHeaderKey, key)
+	default:
+		// Copy the URL so we are not updating the one held by the caller. Any
+		// key already present on the request is replaced.
+		u := *req.URL
+		args := u.Query()
+		args.Set(apiKeyQueryParamKey, key)
+		u.RawQuery = args.Encode()
+		newReq.URL = &u
+	}
 	return t.Transport.RoundTrip(&newReq)
 }
 
+// apiKeyCacheDuration is how long keys returned by an APIKeyProvider are used
+// for before it is called again.
+const apiKeyCacheDuration = 5 * time.Minute
+
+// cachedAPIKeyProvider caches the keys returned by fn.
+type cachedAPIKeyProvider struct {
+	fn func(context.Context) (string, error)
+	// now replaces time.Now if set.
+	now func() time.Time
+
+	mu     sync.Mutex
+	cached string
+	expiry time.Time
+}
+
+// key returns the cached key, calling fn for a new one if none is cached or
+// the cached one has expired. The lock is held while fn is called so that
+// concurrent requests wait for a single call.
+func (p *cachedAPIKeyProvider) key(ctx context.Context) (string, error) {
+	now := time.Now
+	if p.now != nil {
+		now = p.now
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cached != "" && now().Before(p.expiry) {
+		return p.cached, nil
+	}
+	key, err := p.fn(ctx)
+	if err != nil {
+		return "", newAuthError(fmt.Errorf("httptransport: APIKeyProvider failed: %w", err), AuthErrorUnknown)
+	}
+	if key == "" {
+		return "", configError("httptransport: APIKeyProvider returned an empty key")
+	}
+	p.cached = key
+	p.expiry = now().Add(apiKeyCacheDuration)
+	return key, nil
+}
+
 type headerTransport struct {
 	headers http.Header
-	base    http.RoundTripper
+	// headerFunc computes headers that are set on top of headers, if set.
+	headerFunc func(*http.Request) (http.Header, error)
+	// authHeader is the header tokens are set in if it is not Authorization.
+	// Like Authorization, it may not be set from request metadata.
+	authHeader string
+	// maxBytes limits the size of the headers of requests, if not zero.
+	maxBytes int
+	base     http.RoundTripper
 }
 
+func (t *headerTransport) unwrap() http.RoundTripper { return t.base }
+
 func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	rt := t.base
 	newReq := *req
@@ -143,12 +535,89 @@ func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	for k, v := range t.headers {
 		newReq.Header[k] = v
 	}
+	if err := t.addMetadata(newReq.Header, metadataFromContext(req.Context())); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	if t.headerFunc != nil {
+		h, err := t.headerFunc(&newReq)
+		if err != nil {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, fmt.Errorf("httptransport: HeaderFunc failed: %w", err)
+		}
+		for k, v := range h {
+			newReq.Header[http.CanonicalHeaderKey(k)] = v
+		}
+	}
+	if err := checkHeaderSize(newReq.Header, t.maxBytes); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
 
 	return rt.RoundTrip(&newReq)
 }
 
+// checkHeaderSize returns an error naming the largest header of h if the
+// headers take more than max bytes on the wire. Zero means no limit.
+func checkHeaderSize(h http.Header, max int) error {
+	if max == 0 {
+		return nil
+	}
+	var total, largest int
+	var largestKey string
+	for k, vv := range h {
+		n := 0
+		for _, v := range vv {
+			// "Name: value\r\n"
+			n += len(k) + len(v) + 4
+		}
+		total += n
+		if n > largest || (n == largest && k < largestKey) {
+			largest, largestKey = n, k
+		}
+	}
+	if total > max {
+		return fmt.Errorf("httptransport: request headers take %d bytes, more than MaxHeaderBytes (%d), the largest is %q with %d bytes", total, max, largestKey, largest)
+	}
+	return nil
+}
+
+// addMetadata adds the entries of md to h, in the order of their keys, or
+// returns an error without modifying h if any of them may not be sent.
+func (t *headerTransport) addMetadata(h http.Header, md map[string]string) error {
+	if len(md) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(md))
+	for k, v := range md {
+		if !httpguts.ValidHeaderFieldName(k) {
+			return fmt.Errorf("httptransport: metadata key %q is not a valid header name", k)
+		}
+		if !httpguts.ValidHeaderFieldValue(v) {
+			return fmt.Errorf("httptransport: metadata value for %q is not a valid header value", k)
+		}
+		switch ck := http.CanonicalHeaderKey(k); {
+		case ck == "Authorization", ck == "Proxy-Authorization", ck == "Host",
+			t.authHeader != "" && ck == http.CanonicalHeaderKey(t.authHeader):
+			return fmt.Errorf("httptransport: metadata key %q is reserved", k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h.Add(k, md[k])
+	}
+	return nil
+}
+
 func addOCTransport(trans http.RoundTripper, opts *Options) http.RoundTripper {
-	if opts.DisableTelemetry {
+	if opts.DisableTelemetry || opts.TracerProvider != nil {
 		return trans
 	}
 	return &ochttp.Transport{
@@ -157,16 +626,502 @@ func addOCTransport(trans http.RoundTripper, opts *Options) http.RoundTripper {
 	}
 }
 
-type authTransport struct {
-	provider auth.TokenProvider
+func addLoggingTransport(trans http.RoundTripper, opts *Options) http.RoundTripper {
+	if opts.Logf == nil {
+		return trans
+	}
+	return &loggingTransport{
+		logf:           opts.Logf,
+		authHeaderName: opts.AuthHeaderName,
+		base:           trans,
+	}
+}
+
+func addTimeoutTransport(trans http.RoundTripper, opts *Options) http.RoundTripper {
+	if opts.RequestTimeout == 0 {
+		return trans
+	}
+	return &timeoutTransport{
+		timeout: opts.RequestTimeout,
+		base:    trans,
+	}
+}
+
+func addGzipTransport(trans http.RoundTripper, opts *Options) http.RoundTripper {
+	if !opts.CompressRequests {
+		return trans
+	}
+	minBytes := opts.CompressMinBytes
+	if minBytes == 0 {
+		minBytes = defaultCompressMinBytes
+	}
+	return &gzipTransport{
+		minBytes: minBytes,
+		base:     trans,
+	}
+}
+
+// timeoutTransport bounds requests whose context has no deadline by timeout.
+// The deadline covers the whole exchange, including reading the response body.
+type timeoutTransport struct {
+	timeout time.Duration
+	base    http.RoundTripper
+}
+
+func (t *timeoutTransport) unwrap() http.RoundTripper { return t.base }
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if _, ok := req.Context().Deadline(); ok {
+		return t.base.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return resp, err
+	}
+	resp.Body = &cancelOnCloseBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnCloseBody cancels the context of a request once its response body
+// is closed.
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnCloseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// gzipTransport compresses request bodies of at least minBytes. It wraps the
+// auth transport so that retries made there replay the compressed body, which
+// is compressed anew from the body returned by GetBody. Bodies are compressed
+// as they are sent rather than buffered. Bodies of unknown length that can
+// not be replayed are sent as is, as only their first bytes could be read to
+// decide whether to compress them.
+type gzipTransport struct {
+	minBytes int
 	base     http.RoundTripper
 }
 
+func (t *gzipTransport) unwrap() http.RoundTripper { return t.base }
+
+func (t *gzipTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.Body == http.NoBody || req.Header.Get("Content-Encoding") != "" {
+		return t.base.RoundTrip(req)
+	}
+	// For client requests a ContentLength of 0 with a body means the length
+	// is unknown.
+	knownLength := req.ContentLength > 0
+	if knownLength && req.ContentLength < int64(t.minBytes) {
+		return t.base.RoundTrip(req)
+	}
+	if !knownLength && req.GetBody == nil {
+		return t.base.RoundTrip(req)
+	}
+	body := req.Body
+	if !knownLength {
+		// Peek at the start of the body to find out whether it is large
+		// enough to be compressed.
+		head := make([]byte, t.minBytes)
+		n, err := io.ReadFull(req.Body, head)
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			req.Body.Close()
+			newReq := *req
+			newReq.Body = io.NopCloser(bytes.NewReader(head[:n]))
+			newReq.ContentLength = int64(n)
+			return t.base.RoundTrip(&newReq)
+		case err != nil:
+			req.Body.Close()
+			return nil, err
+		}
+		body = readCloser{Reader: io.MultiReader(bytes.NewReader(head), req.Body), Closer: req.Body}
+	}
+	newReq := *req
+	newReq.Header = req.Header.Clone()
+	newReq.Header.Set("Content-Encoding", "gzip")
+	newReq.Header.Del("Content-Length")
+	newReq.ContentLength = -1
+	newReq.Body = gzipBody(body)
+	if req.GetBody != nil {
+		newReq.GetBody = func() (io.ReadCloser, error) {
+			b, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			return gzipBody(b), nil
+		}
+	}
+	return t.base.RoundTrip(&newReq)
+}
+
+// gzipBody returns a reader of the gzip compressed contents of body, which
+// are compressed as they are read. body is closed once it is consumed or the
+// returned reader is closed.
+func gzipBody(body io.ReadCloser) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		defer body.Close()
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, body)
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// readCloser reads from Reader and closes Closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func addIdempotencyKeyTransport(trans http.RoundTripper, opts *Options) http.RoundTripper {
+	if !opts.AutoIdempotencyKey {
+		return trans
+	}
+	return &idempotencyKeyTransport{base: trans}
+}
+
+// idempotencyKeyTransport sets a new idempotency key on every request that
+// does not have one. It wraps the transports that retry requests so that all
+// attempts carry the same key.
+type idempotencyKeyTransport struct {
+	base http.RoundTripper
+}
+
+func (t *idempotencyKeyTransport) unwrap() http.RoundTripper { return t.base }
+
+func (t *idempotencyKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get(idempotencyHeaderKey) != "" {
+		return t.base.RoundTrip(req)
+	}
+	newReq := *req
+	newReq.Header = req.Header.Clone()
+	if newReq.Header == nil {
+		newReq.Header = make(http.Header, 1)
+	}
+	newReq.Header.Set(idempotencyHeaderKey, uuid.NewString())
+	return t.base.RoundTrip(&newReq)
+}
+
+func addRequestIDTransport(trans http.RoundTripper, opts *Options) http.RoundTripper {
+	if !opts.GenerateRequestID {
+		return trans
+	}
+	return &requestIDTransport{base: trans}
+}
+
+// requestIDTransport sets a new request ID on every request that does not
+// have one. It wraps all other transports so that retries, logs, and
+// telemetry of a request share its ID. The ID is also set on non-2xx
+// responses that do not already carry one.
+type requestIDTransport struct {
+	base http.RoundTripper
+}
+
+func (t *requestIDTransport) unwrap() http.RoundTripper { return t.base }
+
+func (t *requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	id := req.Header.Get(requestIDHeaderKey)
+	if id == "" {
+		id = uuid.NewString()
+		newReq := *req
+		newReq.Header = req.Header.Clone()
+		if newReq.Header == nil {
+			newReq.Header = make(http.Header, 1)
+		}
+		newReq.Header.Set(requestIDHeaderKey, id)
+		req = &newReq
+	}
+	return t.base.RoundTrip(req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id)))
+}
+
+const redacted = "REDACTED"
+
+// loggingTransport logs one line per request, after any retries made by the
+// transports it wraps.
+type loggingTransport struct {
+	logf func(format string, args ...interface{})
+	// authHeaderName is a custom header tokens are sent in, if set.
+	authHeaderName string
+	base           http.RoundTripper
+}
+
+func (t *loggingTransport) unwrap() http.RoundTripper { return t.base }
+
+func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	latency := time.Since(start)
+	// Prefer the request as it was finally sent, which carries the headers
+	// set by the other transports.
+	sent := req
+	if resp != nil && resp.Request != nil {
+		sent = resp.Request
+	}
+	if err != nil {
+		t.logf("httptransport: %s %s error=%q latency=%v headers=%v", sent.Method, redactURL(sent.URL), err, latency, redactHeaders(sent.Header, t.authHeaderName))
+		return resp, err
+	}
+	t.logf("httptransport: %s %s status=%d latency=%v headers=%v", sent.Method, redactURL(sent.URL), resp.StatusCode, latency, redactHeaders(sent.Header, t.authHeaderName))
+	return resp, err
+}
+
+// redactHeaders returns a copy of h where the values of credential bearing
+// headers, including any extra headers, are redacted.
+func redactHeaders(h http.Header, extra ...string) http.Header {
+	h = h.Clone()
+	for _, k := range append([]string{defaultAuthHeaderName, "Proxy-Authorization", apiKeyHeaderKey}, extra...) {
+		if k == "" {
+			continue
+		}
+		k = http.CanonicalHeaderKey(k)
+		if _, ok := h[k]; ok {
+			h.Set(k, redacted)
+		}
+	}
+	return h
+}
+
+// redactURL returns u with the value of any API key query parameter
+// redacted.
+func redactURL(u *url.URL) string {
+	q := u.Query()
+	if _, ok := q[apiKeyQueryParamKey]; !ok {
+		return u.String()
+	}
+	q.Set(apiKeyQueryParamKey, redacted)
+	u2 := *u
+	u2.RawQuery = q.Encode()
+	return u2.String()
+}
+
+// wrapper is implemented by the transports of this package that are added
+// above the authTransport by newTransport.
+type wrapper interface {
+	unwrap() http.RoundTripper
+}
+
+// findAuthTransport returns the authTransport in the chain of transports
+// starting at rt, or nil if there is none.
+func findAuthTransport(rt http.RoundTripper) *authTransport {
+	for {
+		switch t := rt.(type) {
+		case *authTransport:
+			return t
+		case wrapper:
+			rt = t.unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+// baseTransport returns the transport at the end of the chain of transports
+// starting at rt, and whether the chain includes a transport of this package.
+func baseTransport(rt http.RoundTripper) (http.RoundTripper, bool) {
+	var own bool
+	for {
+		switch t := rt.(type) {
+		case wrapper:
+			own = true
+			rt = t.unwrap()
+		case *ochttp.Transport:
+			rt = t.Base
+		default:
+			return rt, own
+		}
+	}
+}
+
+type authTransport struct {
+	base http.RoundTripper
+	// retryOnUnauthorized replays a request once with a freshly fetched token
+	// if the server responds with a 401.
+	retryOnUnauthorized bool
+	// retryOnInvalidToken replays a request once with a freshly fetched token
+	// if the response carries a Bearer challenge with an invalid_token error.
+	retryOnInvalidToken bool
+	// allowUnsafeRetries replays requests even if they are not safe to
+	// replay, see safeToReplay.
+	allowUnsafeRetries bool
+	// backoff decides the pause before a request is replayed, if set.
+	backoff Backoff
+	// proofHeaderFunc computes a proof-of-possession header that is set
+	// along with the token, if set.
+	proofHeaderFunc func(req *http.Request, token *auth.Token) (string, string, error)
+	// observer is notified of every token acquisition, if set.
+	observer func(TokenEvent)
+	// onRefresh is called with every new token, if set.
+	onRefresh func(*auth.Token)
+	// wrap applies FallbackTokenProvider and TokenFetchRetries to providers
+	// set with SetTokenProvider, if set.
+	wrap func(auth.TokenProvider) auth.TokenProvider
+	// tracer creates a span around every token acquisition, if set.
+	tracer trace.Tracer
+	// skipAuth selects the requests that are sent without a token.
+	skipAuth skipAuthRules
+	// headerName is the name of the header tokens are set in, Authorization
+	// if empty.
+	headerName string
+	// tokenType replaces the type of tokens in the header if set.
+	tokenType string
+	// minLifetime is the time a token must remain valid for when it is
+	// attached to a request.
+	minLifetime time.Duration
+	// now replaces time.Now in expiry checks of cached tokens if set.
+	now func() time.Time
+	// cache wraps every provider in the cache tokens are fetched from.
+	cache func(auth.TokenProvider) auth.TokenProvider
+
+	mu sync.Mutex
+	// newProvider creates an uncached provider for tokens with the provided
+	// scopes, or for self-signed JWTs with the provided audience if it is not
+	// empty. It is nil if per-request scopes are not supported.
+	newProvider func(scopes []string, audience string) (auth.TokenProvider, error)
+	// audienceForHost are the audiences of self-signed JWTs keyed by
+	// lowercase host.
+	audienceForHost map[string]string
+	// providers are keyed by the scopes set on the request context, or the
+	// audience selected by the request host, with the default provider
+	// stored under the empty key.
+	providers map[string]*providerEntry
+}
+
+// providerEntry holds an uncached provider and the cache wrapping it, which is
+// the provider itself when caching is disabled.
+type providerEntry struct {
+	tp     auth.TokenProvider
+	cached auth.TokenProvider
+}
+
+func (t *authTransport) unwrap() http.RoundTripper { return t.base }
+
+func newAuthTransport(base http.RoundTripper, tp auth.TokenProvider, cache func(auth.TokenProvider) auth.TokenProvider) *authTransport {
+	return &authTransport{
+		base:  base,
+		cache: cache,
+		providers: map[string]*providerEntry{
+			"": {tp: tp, cached: cache(tp)},
+		},
+	}
+}
+
+// currentProvider returns the cached provider tokens for req should be fetched
+// from, selected by the scopes stored in its context or by its host, along
+// with the key it is stored under.
+func (t *authTransport) currentProvider(req *http.Request) (string, auth.TokenProvider, error) {
+	scopes := scopesFromContext(req.Context())
+	key := scopesKey(scopes)
+	t.mu.Lock()
+	var audience string
+	if key == "" {
+		if audience = t.audienceForHost[strings.ToLower(req.URL.Host)]; audience != "" {
+			key = audienceKey(audience)
+		}
+	}
+	e, ok := t.providers[key]
+	newProvider := t.newProvider
+	t.mu.Unlock()
+	if ok {
+		return key, e.cached, nil
+	}
+	if newProvider == nil {
+		return "", nil, configError("httptransport: per-request scopes are not supported with an explicit TokenProvider or UseIDToken")
+	}
+	tp, err := newProvider(scopes, audience)
+	if err != nil {
+		return "", nil, newAuthError(err, AuthErrorCredentialsNotFound)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.newProvider == nil {
+		// The provider was replaced while the lock was not held, so tp
+		// must not be used by later requests.
+		return key, t.cache(tp), nil
+	}
+	// Another request may have created a provider for these scopes while
+	// the lock was not held, prefer it so only a single cache is used.
+	if e, ok := t.providers[key]; ok {
+		return key, e.cached, nil
+	}
+	e = &providerEntry{tp: tp, cached: t.cache(tp)}
+	t.providers[key] = e
+	return key, e.cached, nil
+}
+
+// invalidate discards the token cached by stale, if it is still the current
+// provider stored under key, and returns the provider that should be used in
+// its place, or nil if there is none because the provider was replaced. Only
+// the first of several concurrent callers holding the same stale provider
+// causes a new token to be fetched. Tokens from the returned provider must be
+// fetched with a context marked by [internal.WithStaleToken], so that caches
+// within the uncached provider, such as those of detected credentials, are
+// refreshed as well.
+func (t *authTransport) invalidate(key string, stale auth.TokenProvider) auth.TokenProvider {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.providers[key]
+	if !ok {
+		return nil
+	}
+	if e.cached == stale {
+		e = &providerEntry{tp: e.tp, cached: t.cache(e.tp)}
+		t.providers[key] = e
+	}
+	return e.cached
+}
+
+// setProvider replaces the providers of t with tp. Per-request scopes are not
+// supported afterwards, as with an explicit TokenProvider. Requests already
+// holding a provider finish with it.
+func (t *authTransport) setProvider(tp auth.TokenProvider) {
+	if t.wrap != nil {
+		tp = t.wrap(tp)
+	}
+	tp = notifyRefreshes(observeFetches(tp, t.observer), t.onRefresh)
+	e := &providerEntry{tp: tp, cached: t.cache(tp)}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.providers = map[string]*providerEntry{"": e}
+	t.newProvider = nil
+	t.audienceForHost = nil
+}
+
+// audienceKey returns the key of the provider for self-signed JWTs with the
+// provided audience, which never equals the key of a set of scopes.
+func audienceKey(audience string) string {
+	return "\x00" + audience
+}
+
+// lowerKeys returns a copy of m with lowercase keys, or nil if m is empty.
+func lowerKeys(m map[string]string) map[string]string {
+	if len(m) == 0 {
+		return nil
+	}
+	m2 := make(map[string]string, len(m))
+	for k, v := range m {
+		m2[strings.ToLower(k)] = v
+	}
+	return m2
+}
+
 // RoundTrip authorizes and authenticates the request with an
 // access token from Transport's Source. Per the RoundTripper contract we must
 // not modify the initial request, so we clone it, and we must close the body
 // on any errors that happens during our token logic.
 func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.skipAuth.matches(req) {
+		return t.base.RoundTrip(req)
+	}
 	reqBodyClosed := false
 	if req.Body != nil {
 		defer func() {
@@ -175,12 +1130,459 @@ func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 			}
 		}()
 	}
-	token, err := t.provider.Token(req.Context())
+	key, provider, err := t.currentProvider(req)
 	if err != nil {
+		return nil, withRequestID(err, req)
+	}
+	token, provider, err := t.tokenWithMinLifetime(req.Context(), key, provider)
+	if err != nil {
+		return nil, withRequestID(newAuthError(err, AuthErrorUnknown), req)
+	}
+	req2 := req.Clone(markAuthenticated(req.Context()))
+	if err := t.setAuthHeader(token, req2); err != nil {
 		return nil, err
 	}
-	req2 := req.Clone(req.Context())
-	SetAuthHeader(token, req2)
 	reqBodyClosed = true
+	resp, err := t.base.RoundTrip(req2)
+	if err != nil || !t.shouldReplay(resp) || !(t.allowUnsafeRetries || safeToReplay(req)) || !canReplay(req) {
+		return resp, err
+	}
+	return t.replayWithFreshToken(req, resp, key, provider, token)
+}
+
+// shouldReplay reports whether resp indicates the token sent was rejected,
+// per the retry options of t.
+func (t *authTransport) shouldReplay(resp *http.Response) bool {
+	if t.retryOnUnauthorized && resp.StatusCode == http.StatusUnauthorized {
+		return true
+	}
+	return t.retryOnInvalidToken && hasInvalidTokenChallenge(resp.Header)
+}
+
+// hasInvalidTokenChallenge reports whether h holds a WWW-Authenticate
+// challenge for the Bearer scheme with an error of invalid_token, as defined
+// by RFC 6750.
+func hasInvalidTokenChallenge(h http.Header) bool {
+	for _, v := range h.Values("WWW-Authenticate") {
+		for _, c := range parseChallenges(v) {
+			if strings.EqualFold(c.scheme, "Bearer") && c.params["error"] == "invalid_token" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// challenge is an authentication challenge of a WWW-Authenticate header.
+type challenge struct {
+	scheme string
+	// params are keyed by lowercase name.
+	params map[string]string
+}
+
+// parseChallenges parses the comma separated challenges of a WWW-Authenticate
+// header value, as defined by RFC 9110. Parsing stops at the first malformed
+// element, returning the challenges before it.
+func parseChallenges(s string) []challenge {
+	var cs []challenge
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return cs
+		}
+		var tok string
+		tok, s = consumeToken(s)
+		if tok == "" {
+			return cs
+		}
+		s = strings.TrimLeft(s, " \t")
+		if !strings.HasPrefix(s, "=") {
+			cs = append(cs, challenge{scheme: tok, params: make(map[string]string)})
+			continue
+		}
+		if len(cs) == 0 {
+			return cs
+		}
+		s = strings.TrimLeft(s[1:], " \t")
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var ok bool
+			value, s, ok = consumeQuoted(s)
+			if !ok {
+				return cs
+			}
+		} else {
+			value, s = consumeToken(s)
+		}
+		cs[len(cs)-1].params[strings.ToLower(tok)] = value
+	}
+}
+
+// consumeToken returns the token at the start of s and the rest of s.
+func consumeToken(s string) (string, string) {
+	i := strings.IndexFunc(s, func(r rune) bool { return !httpguts.IsTokenRune(r) })
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i:]
+}
+
+// consumeQuoted returns the unescaped value of the quoted string at the start
+// of s and the rest of s, or false if the string is not terminated.
+func consumeQuoted(s string) (string, string, bool) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			return b.String(), s[i+1:], true
+		case '\\':
+			i++
+			if i == len(s) {
+				return "", "", false
+			}
+			b.WriteByte(s[i])
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", "", false
+}
+
+// replayWithFreshToken invalidates the rejected token cached by stale and sends
+// req once more with a newly fetched token. If a new token or request body can
+// not be obtained the original response is returned.
+func (t *authTransport) replayWithFreshToken(req *http.Request, resp *http.Response, key string, stale auth.TokenProvider, rejected *auth.Token) (*http.Response, error) {
+	provider := t.invalidate(key, stale)
+	if provider == nil {
+		return resp, nil
+	}
+	token, err := t.token(internal.WithStaleToken(req.Context(), rejected.Value), provider)
+	if err != nil || t.remaining(token) < t.minLifetime {
+		return resp, nil
+	}
+	req2 := req.Clone(markAuthenticated(req.Context()))
+	if req.Body != nil && req.Body != http.NoBody {
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		req2.Body = body
+	}
+	// Drain the body so the underlying connection can be reused.
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if t.backoff != nil {
+		if err := pause(req.Context(), t.backoff.Pause(1)); err != nil {
+			if req2.Body != nil {
+				req2.Body.Close()
+			}
+			return nil, fmt.Errorf("httptransport: waiting to retry request: %w", err)
+		}
+	}
+	// The headers are set after the pause so that proofs are fresh.
+	if err := t.setAuthHeader(token, req2); err != nil {
+		if req2.Body != nil {
+			req2.Body.Close()
+		}
+		return nil, err
+	}
 	return t.base.RoundTrip(req2)
 }
+
+// tokenWithMinLifetime returns a token from provider that remains valid for at
+// least minLifetime, invalidating the token cached by provider if it expires
+// too soon. The provider the token was fetched from is returned as well.
+func (t *authTransport) tokenWithMinLifetime(ctx context.Context, key string, provider auth.TokenProvider) (*auth.Token, auth.TokenProvider, error) {
+	token, err := t.token(ctx, provider)
+	if err != nil {
+		return nil, nil, err
+	}
+	if t.remaining(token) >= t.minLifetime {
+		return token, provider, nil
+	}
+	if fresh := t.invalidate(key, provider); fresh != nil {
+		provider = fresh
+		token, err = t.token(internal.WithStaleToken(ctx, token.Value), provider)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if d := t.remaining(token); d < t.minLifetime {
+		return nil, nil, configError("httptransport: token expires in %v, which is less than MinTokenLifetime of %v, even after a refresh", d.Round(time.Second), t.minLifetime)
+	}
+	return token, provider, nil
+}
+
+// remaining returns the time until token expires, or the maximum duration if
+// it does not expire.
+func (t *authTransport) remaining(token *auth.Token) time.Duration {
+	if token.Expiry.IsZero() {
+		return math.MaxInt64
+	}
+	now := time.Now
+	if t.now != nil {
+		now = t.now
+	}
+	return token.Expiry.Sub(now())
+}
+
+// setAuthHeader sets the header tokens are sent in on req, with the token type
+// replaced by tokenType if set.
+func (t *authTransport) setAuthHeader(token *auth.Token, req *http.Request) error {
+	if t.tokenType != "" {
+		// The token may be cached and shared with other requests.
+		tok := *token
+		tok.Type = t.tokenType
+		token = &tok
+	}
+	SetAuthHeaderNamed(t.headerName, token, req)
+	if t.proofHeaderFunc == nil {
+		return nil
+	}
+	name, value, err := t.proofHeaderFunc(req, token)
+	if err != nil {
+		return fmt.Errorf("httptransport: ProofHeaderFunc failed: %w", err)
+	}
+	if name == "" {
+		return nil
+	}
+	if !httpguts.ValidHeaderFieldName(name) || !httpguts.ValidHeaderFieldValue(value) {
+		return fmt.Errorf("httptransport: ProofHeaderFunc returned an invalid header %q", name)
+	}
+	switch ck := http.CanonicalHeaderKey(name); {
+	case ck == defaultAuthHeaderName, t.headerName != "" && ck == http.CanonicalHeaderKey(t.headerName):
+		return fmt.Errorf("httptransport: ProofHeaderFunc may not set the %q header", name)
+	}
+	req.Header.Set(name, value)
+	return nil
+}
+
+// token returns a token from provider, within a span if a tracer is set.
+func (t *authTransport) token(ctx context.Context, provider auth.TokenProvider) (*auth.Token, error) {
+	if t.now != nil {
+		ctx = internal.WithClock(ctx, t.now)
+	}
+	if t.tracer == nil {
+		return t.observedToken(ctx, provider)
+	}
+	ctx, span := t.tracer.Start(ctx, tokenSpanName)
+	defer span.End()
+	token, err := t.observedToken(ctx, provider)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return token, err
+}
+
+// observedToken returns a token from provider, notifying the observer if one
+// is set.
+func (t *authTransport) observedToken(ctx context.Context, provider auth.TokenProvider) (*auth.Token, error) {
+	if t.observer == nil {
+		return fetchToken(ctx, provider)
+	}
+	fetched := new(atomic.Bool)
+	start := time.Now()
+	token, err := fetchToken(context.WithValue(ctx, fetchedKey{}, fetched), provider)
+	t.observer(TokenEvent{
+		Cached:   err == nil && !fetched.Load(),
+		Duration: time.Since(start),
+		Err:      err,
+	})
+	return token, err
+}
+
+type fetchedKey struct{}
+
+// observeFetches wraps tp so that calls to it, which only happen when the cache
+// wrapping it needs a new token, can be detected. A call that returns the
+// same token as the call before it, which happens when a cache within tp such
+// as the cache of detected credentials serves it, is not reported as a fetch.
+// tp is returned unmodified if observer is nil.
+func observeFetches(tp auth.TokenProvider, observer func(TokenEvent)) auth.TokenProvider {
+	if observer == nil {
+		return tp
+	}
+	return &fetchObservingProvider{tp: tp}
+}
+
+type fetchObservingProvider struct {
+	tp   auth.TokenProvider
+	last lastToken
+}
+
+func (p *fetchObservingProvider) Token(ctx context.Context) (*auth.Token, error) {
+	token, err := p.tp.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if fetched, ok := ctx.Value(fetchedKey{}).(*atomic.Bool); ok && token != nil && p.last.changed(token) {
+		fetched.Store(true)
+	}
+	return token, nil
+}
+
+// notifyRefreshes wraps tp so that fn is called with a copy of every token it
+// returns that differs in value or expiry from the token it returned last, as
+// tp may return a token cached by detected credentials. tp is returned
+// unmodified if fn is nil.
+func notifyRefreshes(tp auth.TokenProvider, fn func(*auth.Token)) auth.TokenProvider {
+	if fn == nil {
+		return tp
+	}
+	return &refreshNotifyingProvider{tp: tp, fn: fn}
+}
+
+type refreshNotifyingProvider struct {
+	tp   auth.TokenProvider
+	fn   func(*auth.Token)
+	last lastToken
+}
+
+func (p *refreshNotifyingProvider) Token(ctx context.Context) (*auth.Token, error) {
+	token, err := p.tp.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if token != nil && p.last.changed(token) {
+		tok := *token
+		go p.fn(&tok)
+	}
+	return token, nil
+}
+
+// lastToken holds the last token returned by a provider.
+type lastToken struct {
+	mu    sync.Mutex
+	token *auth.Token
+}
+
+// changed records token as the last token and reports whether it differs in
+// value or expiry from the token before it.
+func (l *lastToken) changed(token *auth.Token) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	last := l.token
+	l.token = token
+	return last == nil || last.Value != token.Value || !last.Expiry.Equal(token.Expiry)
+}
+
+// fallbackProvider fetches tokens from fallback when primary fails.
+type fallbackProvider struct {
+	primary  auth.TokenProvider
+	fallback auth.TokenProvider
+}
+
+func (p *fallbackProvider) Token(ctx context.Context) (*auth.Token, error) {
+	token, err := p.primary.Token(ctx)
+	if err == nil {
+		return token, nil
+	}
+	token, fallbackErr := p.fallback.Token(ctx)
+	if fallbackErr == nil {
+		return token, nil
+	}
+	return nil, &fallbackError{primary: err, fallback: fallbackErr}
+}
+
+// fallbackError holds the errors of both providers of a fallbackProvider.
+type fallbackError struct {
+	primary  error
+	fallback error
+}
+
+func (e *fallbackError) Error() string {
+	return fmt.Sprintf("httptransport: token provider failed: %v; fallback token provider failed: %v", e.primary, e.fallback)
+}
+
+// Is reports whether the error of either provider matches target. It is used
+// in place of an Unwrap method returning both errors, which errors.Is only
+// supports as of Go 1.20.
+func (e *fallbackError) Is(target error) bool {
+	return errors.Is(e.primary, target) || errors.Is(e.fallback, target)
+}
+
+// As finds the first error of the providers that matches target, preferring
+// the error of the primary provider.
+func (e *fallbackError) As(target interface{}) bool {
+	return errors.As(e.primary, target) || errors.As(e.fallback, target)
+}
+
+// fetchToken returns a token from provider, fetched with ctx so that a done
+// context aborts the fetch. If the fetch fails once ctx is done, the returned
+// error wraps the error of ctx, even if the provider does not.
+func fetchToken(ctx context.Context, provider auth.TokenProvider) (*auth.Token, error) {
+	token, err := provider.Token(ctx)
+	if err != nil && ctx.Err() != nil && !errors.Is(err, ctx.Err()) {
+		return nil, fmt.Errorf("httptransport: token fetch aborted: %w: %v", ctx.Err(), err)
+	}
+	return token, err
+}
+
+// skipAuthRules are the host and path patterns of SkipAuthForHosts and
+// SkipAuthForPaths.
+type skipAuthRules struct {
+	hosts []string
+	paths []string
+}
+
+func (o *Options) skipAuthRules() skipAuthRules {
+	return skipAuthRules{
+		hosts: o.SkipAuthForHosts,
+		paths: o.SkipAuthForPaths,
+	}
+}
+
+// matches reports whether req is to be sent without credentials.
+func (r skipAuthRules) matches(req *http.Request) bool {
+	return matchesHost(req.URL.Hostname(), r.hosts) || matchesPath(req.URL.Path, r.paths)
+}
+
+// matchesHost reports whether host matches any of patterns. A pattern matches a
+// host exactly or, if it starts with "*.", any subdomain of the rest of the
+// pattern.
+func matchesHost(host string, patterns []string) bool {
+	host = strings.ToLower(host)
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if suffix := strings.TrimPrefix(p, "*"); suffix != p {
+			if strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+				return true
+			}
+		} else if host == p {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesPath reports whether path matches any of patterns. A pattern matches
+// a path exactly or, if it ends with "*", any path starting with the rest of
+// the pattern.
+func matchesPath(path string, patterns []string) bool {
+	for _, p := range patterns {
+		if prefix := strings.TrimSuffix(p, "*"); prefix != p {
+			if strings.HasPrefix(path, prefix) {
+				return true
+			}
+		} else if path == p {
+			return true
+		}
+	}
+	return false
+}
+
+type authenticatedKey struct{}
+
+type requestIDKey struct{}
+
+// markAuthenticated returns a copy of ctx that records that credentials were
+// attached to the request it is used for, see [WasAuthenticated].
+func markAuthenticated(ctx context.Context) context.Context {
+	return context.WithValue(ctx, authenticatedKey{}, true)
+}
+
+// canReplay reports whether the body of req can be sent again.
+func canReplay(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
@@ -15,6 +15,7 @@
 package internal
 
 import (
+	"context"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/json"
@@ -31,6 +32,9 @@ const (
 	// TokenTypeBearer is the auth header prefix for bearer tokens.
 	TokenTypeBearer = "Bearer"
 
+	// DefaultUniverseDomain is the universe domain of Google's public cloud.
+	DefaultUniverseDomain = "googleapis.com"
+
 	quotaProjectEnvVar = "GOOGLE_CLOUD_QUOTA_PROJECT"
 	projectEnvVar      = "GOOGLE_CLOUD_PROJECT"
 	maxBodySize        = 1 << 20
@@ -114,8 +118,55 @@ func GetProjectID(b []byte, override string) string {
 	return v.Project
 }
 
+// GetUniverseDomain retrieves the universe domain from the creds json file,
+// defaulting to [DefaultUniverseDomain] if it is not set.
+func GetUniverseDomain(b []byte) string {
+	if b == nil {
+		return DefaultUniverseDomain
+	}
+	var v struct {
+		UniverseDomain string `json:"universe_domain"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil || v.UniverseDomain == "" {
+		return DefaultUniverseDomain
+	}
+	return v.UniverseDomain
+}
+
 // ReadAll consumes the whole reader and safely reads the content of its body
 // with some overflow protection.
 func ReadAll(r io.Reader) ([]byte, error) {
 	return io.ReadAll(io.LimitReader(r, maxBodySize))
 }
+
+type clockKey struct{}
+
+// WithClock returns a copy of ctx that carries now, which token caches use in
+// place of [time.Now] when deciding whether a token has expired. It is only
+// meant to be used by tests.
+func WithClock(ctx context.Context, now func() time.Time) context.Context {
+	return context.WithValue(ctx, clockKey{}, now)
+}
+
+// Clock returns the clock stored in ctx by [WithClock], or nil if there is
+// none.
+func Clock(ctx context.Context) func() time.Time {
+	now, _ := ctx.Value(clockKey{}).(func() time.Time)
+	return now
+}
+
+type staleTokenKey struct{}
+
+// WithStaleToken returns a copy of ctx that carries the value of a token that
+// was rejected or expires too soon, which token caches holding it refresh
+// rather than return.
+func WithStaleToken(ctx context.Context, value string) context.Context {
+	return context.WithValue(ctx, staleTokenKey{}, value)
+}
+
+// StaleToken returns the token value stored in ctx by [WithStaleToken], or an
+// empty string if there is none.
+func StaleToken(ctx context.Context) string {
+	v, _ := ctx.Value(staleTokenKey{}).(string)
+	return v
+}
@@ -15,6 +15,7 @@
 package testutil
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"testing"
@@ -33,6 +34,24 @@ func IntegrationTestCheck(t *testing.T) {
 	}
 }
 
+// RoundTripperFunc is a [net/http.RoundTripper] that calls the function
+// itself.
+type RoundTripperFunc func(*http.Request) (*http.Response, error)
+
+// RoundTrip calls f(req).
+func (f RoundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// StaticTokenProvider is a [cloud.google.com/go/auth.TokenProvider] that
+// provides tokens with its value.
+type StaticTokenProvider string
+
+// Token returns a token with the value of tp.
+func (tp StaticTokenProvider) Token(context.Context) (*auth.Token, error) {
+	return &auth.Token{Value: string(tp)}, nil
+}
+
 // TODO(codyoss): remove all code below when httptransport package is added.
 
 // AddAuthorizationMiddleware adds a middleware to the provided client's
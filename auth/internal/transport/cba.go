@@ -0,0 +1,172 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"crypto/tls"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/auth/internal"
+)
+
+const (
+	mTLSModeAlways = "always"
+	mTLSModeNever  = "never"
+	mTLSModeAuto   = "auto"
+
+	googleAPIUseCertSource = "GOOGLE_API_USE_CLIENT_CERTIFICATE"
+	googleAPIUseMTLS       = "GOOGLE_API_USE_MTLS_ENDPOINT"
+)
+
+// ClientCertProvider is a function that returns a TLS client certificate to be
+// used when opening TLS connections. It follows the same semantics as
+// [crypto/tls.Config.GetClientCertificate].
+type ClientCertProvider = func(*tls.CertificateRequestInfo) (*tls.Certificate, error)
+
+// Options is a struct that is duplicated information from the individual
+// transport packages in order to avoid cyclic deps. It correlates 1:1 with
+// fields on httptransport.Options.
+type Options struct {
+	Endpoint            string
+	DefaultEndpoint     string
+	DefaultMTLSEndpoint string
+	ClientCertProvider  ClientCertProvider
+	// UniverseDomain replaces the googleapis.com domain of the default
+	// endpoints, if set.
+	UniverseDomain string
+}
+
+// HTTPTransportConfig is the resolved configuration used to build an HTTP
+// transport.
+type HTTPTransportConfig struct {
+	// ClientCertProvider is the provider of the client certificate to present
+	// during TLS handshakes, nil if no certificate should be presented.
+	ClientCertProvider ClientCertProvider
+	// Endpoint is the endpoint requests should be sent to.
+	Endpoint string
+}
+
+// GetHTTPTransportConfig resolves the client certificate and endpoint that
+// should be used for an HTTP transport based on the provided options and the
+// environment.
+func GetHTTPTransportConfig(opts *Options) (*HTTPTransportConfig, error) {
+	clientCertProvider, err := getClientCertificateProvider(opts)
+	if err != nil {
+		return nil, err
+	}
+	endpoint, err := getEndpoint(opts, clientCertProvider)
+	if err != nil {
+		return nil, err
+	}
+	return &HTTPTransportConfig{
+		ClientCertProvider: clientCertProvider,
+		Endpoint:           endpoint,
+	}, nil
+}
+
+// getClientCertificateProvider returns a client certificate provider if one
+// was configured by the user, or if the default provider was requested with
+// the GOOGLE_API_USE_CLIENT_CERTIFICATE environment variable. A nil provider
+// is returned if no certificate should be used.
+func getClientCertificateProvider(opts *Options) (ClientCertProvider, error) {
+	if opts.ClientCertProvider != nil {
+		return opts.ClientCertProvider, nil
+	}
+	if !isClientCertificateEnabled() {
+		return nil, nil
+	}
+	return defaultCertProvider()
+}
+
+func isClientCertificateEnabled() bool {
+	// error as false is a good default
+	b, _ := strconv.ParseBool(os.Getenv(googleAPIUseCertSource))
+	return b
+}
+
+// getEndpoint returns the endpoint for the service, taking into account the
+// user-provided endpoint override and the mTLS mode.
+//
+// If the endpoint override is an address (host:port) rather than full base
+// URL (ex. https://...), then the user-provided address will be merged into
+// the default endpoint. For example, an Endpoint of "myhost:8000" and a
+// DefaultEndpoint of "https://foo.com/bar/baz" will return
+// "https://myhost:8000/bar/baz".
+func getEndpoint(opts *Options, clientCertProvider ClientCertProvider) (string, error) {
+	if opts.Endpoint == "" {
+		mtlsMode := getMTLSMode()
+		if mtlsMode == mTLSModeAlways || (clientCertProvider != nil && mtlsMode == mTLSModeAuto) {
+			return withUniverseDomain(opts.DefaultMTLSEndpoint, opts.UniverseDomain)
+		}
+		return withUniverseDomain(opts.DefaultEndpoint, opts.UniverseDomain)
+	}
+	if strings.Contains(opts.Endpoint, "://") {
+		// User passed in a full URL path, use it verbatim.
+		return opts.Endpoint, nil
+	}
+	if opts.DefaultEndpoint == "" {
+		// If DefaultEndpoint is not configured, use the user provided endpoint
+		// verbatim.
+		return opts.Endpoint, nil
+	}
+	// Assume user-provided endpoint is host[:port], merge it with the default
+	// endpoint.
+	return mergeEndpoints(opts.DefaultEndpoint, opts.Endpoint)
+}
+
+// withUniverseDomain replaces the googleapis.com domain of endpoint's host with
+// universeDomain. The endpoint is returned unmodified if universeDomain is empty
+// or the host is not in the googleapis.com domain.
+func withUniverseDomain(endpoint, universeDomain string) (string, error) {
+	if endpoint == "" || universeDomain == "" || universeDomain == internal.DefaultUniverseDomain {
+		return endpoint, nil
+	}
+	u, err := url.Parse(fixScheme(endpoint))
+	if err != nil {
+		return "", err
+	}
+	host := u.Hostname()
+	if !strings.HasSuffix(host, "."+internal.DefaultUniverseDomain) {
+		return endpoint, nil
+	}
+	newHost := strings.TrimSuffix(host, internal.DefaultUniverseDomain) + universeDomain
+	return strings.Replace(endpoint, host, newHost, 1), nil
+}
+
+func getMTLSMode() string {
+	mode := os.Getenv(googleAPIUseMTLS)
+	if mode == "" {
+		return mTLSModeAuto
+	}
+	return strings.ToLower(mode)
+}
+
+func mergeEndpoints(baseURL, newHost string) (string, error) {
+	u, err := url.Parse(fixScheme(baseURL))
+	if err != nil {
+		return "", err
+	}
+	return strings.Replace(baseURL, u.Host, newHost, 1), nil
+}
+
+func fixScheme(baseURL string) string {
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "https://" + baseURL
+	}
+	return baseURL
+}
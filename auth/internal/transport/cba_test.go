@@ -0,0 +1,255 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	testRegularEndpoint = "https://foo.googleapis.com"
+	testMTLSEndpoint    = "https://foo.mtls.googleapis.com"
+)
+
+func fakeClientCertProvider(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return &tls.Certificate{}, nil
+}
+
+func TestGetHTTPTransportConfig_Endpoint(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     *Options
+		mtlsMode string
+		want     string
+		wantCert bool
+	}{
+		{
+			name: "no cert, no override",
+			opts: &Options{
+				DefaultEndpoint:     testRegularEndpoint,
+				DefaultMTLSEndpoint: testMTLSEndpoint,
+			},
+			want: testRegularEndpoint,
+		},
+		{
+			name: "cert, no override",
+			opts: &Options{
+				DefaultEndpoint:     testRegularEndpoint,
+				DefaultMTLSEndpoint: testMTLSEndpoint,
+				ClientCertProvider:  fakeClientCertProvider,
+			},
+			want:     testMTLSEndpoint,
+			wantCert: true,
+		},
+		{
+			name: "no cert, override",
+			opts: &Options{
+				Endpoint:            "https://override.example.com",
+				DefaultEndpoint:     testRegularEndpoint,
+				DefaultMTLSEndpoint: testMTLSEndpoint,
+			},
+			want: "https://override.example.com",
+		},
+		{
+			name: "cert, override",
+			opts: &Options{
+				Endpoint:            "https://override.example.com",
+				DefaultEndpoint:     testRegularEndpoint,
+				DefaultMTLSEndpoint: testMTLSEndpoint,
+				ClientCertProvider:  fakeClientCertProvider,
+			},
+			want:     "https://override.example.com",
+			wantCert: true,
+		},
+		{
+			name: "cert, host override merged with default",
+			opts: &Options{
+				Endpoint:            "override.example.com:8000",
+				DefaultEndpoint:     testRegularEndpoint + "/bar/baz",
+				DefaultMTLSEndpoint: testMTLSEndpoint,
+				ClientCertProvider:  fakeClientCertProvider,
+			},
+			want:     "https://override.example.com:8000/bar/baz",
+			wantCert: true,
+		},
+		{
+			name: "host override, no default",
+			opts: &Options{
+				Endpoint: "override.example.com:8000",
+			},
+			want: "override.example.com:8000",
+		},
+		{
+			name: "universe domain",
+			opts: &Options{
+				DefaultEndpoint:     testRegularEndpoint,
+				DefaultMTLSEndpoint: testMTLSEndpoint,
+				UniverseDomain:      "example.com",
+			},
+			want: "https://foo.example.com",
+		},
+		{
+			name: "universe domain, default universe",
+			opts: &Options{
+				DefaultEndpoint:     testRegularEndpoint,
+				DefaultMTLSEndpoint: testMTLSEndpoint,
+				UniverseDomain:      "googleapis.com",
+			},
+			want: testRegularEndpoint,
+		},
+		{
+			name: "universe domain, cert",
+			opts: &Options{
+				DefaultEndpoint:     testRegularEndpoint,
+				DefaultMTLSEndpoint: testMTLSEndpoint,
+				ClientCertProvider:  fakeClientCertProvider,
+				UniverseDomain:      "example.com",
+			},
+			want:     "https://foo.mtls.example.com",
+			wantCert: true,
+		},
+		{
+			name: "universe domain, port and path",
+			opts: &Options{
+				DefaultEndpoint: "https://foo.googleapis.com:443/v1/",
+				UniverseDomain:  "example.com",
+			},
+			want: "https://foo.example.com:443/v1/",
+		},
+		{
+			name: "universe domain, not a googleapis.com endpoint",
+			opts: &Options{
+				DefaultEndpoint: "https://foo.example.org",
+				UniverseDomain:  "example.com",
+			},
+			want: "https://foo.example.org",
+		},
+		{
+			name: "universe domain, override",
+			opts: &Options{
+				Endpoint:        "https://override.googleapis.com",
+				DefaultEndpoint: testRegularEndpoint,
+				UniverseDomain:  "example.com",
+			},
+			want: "https://override.googleapis.com",
+		},
+		{
+			name: "no cert, mtls always",
+			opts: &Options{
+				DefaultEndpoint:     testRegularEndpoint,
+				DefaultMTLSEndpoint: testMTLSEndpoint,
+			},
+			mtlsMode: mTLSModeAlways,
+			want:     testMTLSEndpoint,
+		},
+		{
+			name: "cert, mtls never",
+			opts: &Options{
+				DefaultEndpoint:     testRegularEndpoint,
+				DefaultMTLSEndpoint: testMTLSEndpoint,
+				ClientCertProvider:  fakeClientCertProvider,
+			},
+			mtlsMode: mTLSModeNever,
+			want:     testRegularEndpoint,
+			wantCert: true,
+		},
+		{
+			name: "cert, override, mtls always",
+			opts: &Options{
+				Endpoint:            "https://override.example.com",
+				DefaultEndpoint:     testRegularEndpoint,
+				DefaultMTLSEndpoint: testMTLSEndpoint,
+				ClientCertProvider:  fakeClientCertProvider,
+			},
+			mtlsMode: mTLSModeAlways,
+			want:     "https://override.example.com",
+			wantCert: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(googleAPIUseMTLS, tt.mtlsMode)
+			config, err := GetHTTPTransportConfig(tt.opts)
+			if err != nil {
+				t.Fatalf("GetHTTPTransportConfig() = %v", err)
+			}
+			if config.Endpoint != tt.want {
+				t.Errorf("got %q, want %q", config.Endpoint, tt.want)
+			}
+			if got := config.ClientCertProvider != nil; got != tt.wantCert {
+				t.Errorf("got cert provider %v, want %v", got, tt.wantCert)
+			}
+		})
+	}
+}
+
+func TestGetHTTPTransportConfig_DefaultCertProvider(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv(googleAPIUseCertSource, "true")
+	opts := &Options{
+		DefaultEndpoint:     testRegularEndpoint,
+		DefaultMTLSEndpoint: testMTLSEndpoint,
+	}
+
+	// No SecureConnect metadata on this machine, so no cert is available.
+	config, err := GetHTTPTransportConfig(opts)
+	if err != nil {
+		t.Fatalf("GetHTTPTransportConfig() = %v", err)
+	}
+	if config.ClientCertProvider != nil {
+		t.Errorf("got a cert provider, want nil")
+	}
+	if config.Endpoint != testRegularEndpoint {
+		t.Errorf("got %q, want %q", config.Endpoint, testRegularEndpoint)
+	}
+
+	md := filepath.Join(home, metadataPath, metadataFile)
+	if err := os.MkdirAll(filepath.Dir(md), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(md, []byte(`{"cert_provider_command":["cat","cert.pem"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err = GetHTTPTransportConfig(opts)
+	if err != nil {
+		t.Fatalf("GetHTTPTransportConfig() = %v", err)
+	}
+	if config.ClientCertProvider == nil {
+		t.Errorf("got nil cert provider, want one")
+	}
+	if config.Endpoint != testMTLSEndpoint {
+		t.Errorf("got %q, want %q", config.Endpoint, testMTLSEndpoint)
+	}
+}
+
+func TestGetHTTPTransportConfig_InvalidSecureConnectMetadata(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv(googleAPIUseCertSource, "true")
+	md := filepath.Join(home, metadataPath, metadataFile)
+	if err := os.MkdirAll(filepath.Dir(md), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(md, []byte(`{"cert_provider_command":[]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetHTTPTransportConfig(&Options{}); err == nil {
+		t.Fatal("GetHTTPTransportConfig() = nil, want error")
+	}
+}
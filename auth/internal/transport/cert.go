@@ -0,0 +1,122 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	metadataPath = ".secureConnect"
+	metadataFile = "context_aware_metadata.json"
+)
+
+// defaultCertProvider returns the default client certificate provider, which
+// is backed by the SecureConnect helper command if one is configured on this
+// machine. A nil provider is returned if no default source is available.
+func defaultCertProvider() (ClientCertProvider, error) {
+	return newSecureConnectProvider("")
+}
+
+type secureConnectMetadata struct {
+	Cmd []string `json:"cert_provider_command"`
+}
+
+// secureConnectSource executes the command configured in the SecureConnect
+// metadata file to obtain a client certificate.
+type secureConnectSource struct {
+	metadata secureConnectMetadata
+
+	// mu guards cachedCert, which avoids invoking the helper command on every
+	// handshake.
+	mu         sync.Mutex
+	cachedCert *tls.Certificate
+}
+
+// newSecureConnectProvider returns a provider backed by the SecureConnect
+// metadata file at configFilePath, or the well-known location in the user's
+// home directory if configFilePath is empty. A nil provider is returned if the
+// metadata file does not exist.
+func newSecureConnectProvider(configFilePath string) (ClientCertProvider, error) {
+	if configFilePath == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			// Error locating the default config means SecureConnect is not
+			// supported.
+			return nil, nil
+		}
+		configFilePath = filepath.Join(home, metadataPath, metadataFile)
+	}
+	b, err := os.ReadFile(configFilePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// Config file missing means SecureConnect is not supported.
+			return nil, nil
+		}
+		return nil, err
+	}
+	var md secureConnectMetadata
+	if err := json.Unmarshal(b, &md); err != nil {
+		return nil, fmt.Errorf("transport: could not parse JSON in %q: %w", configFilePath, err)
+	}
+	if len(md.Cmd) == 0 {
+		return nil, fmt.Errorf("transport: invalid config in %q: empty cert_provider_command", configFilePath)
+	}
+	return (&secureConnectSource{metadata: md}).getClientCertificate, nil
+}
+
+func (s *secureConnectSource) getClientCertificate(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cachedCert != nil && !isCertificateExpired(s.cachedCert) {
+		return s.cachedCert, nil
+	}
+	// Expand OS environment variables in the cert provider command such as
+	// "$HOME".
+	cmd := make([]string, len(s.metadata.Cmd))
+	for i, v := range s.metadata.Cmd {
+		cmd[i] = os.ExpandEnv(v)
+	}
+	data, err := exec.Command(cmd[0], cmd[1:]...).Output()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	s.cachedCert = &cert
+	return &cert, nil
+}
+
+func isCertificateExpired(cert *tls.Certificate) bool {
+	if len(cert.Certificate) == 0 {
+		return true
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return true
+	}
+	return time.Now().After(parsed.NotAfter)
+}
@@ -29,18 +29,20 @@ func CloneDetectOptions(oldDo *detect.Options) *detect.Options {
 	}
 	newDo := &detect.Options{
 		// Simple types
-		Audience:          oldDo.Audience,
-		Subject:           oldDo.Subject,
-		EarlyTokenRefresh: oldDo.EarlyTokenRefresh,
-		TokenURL:          oldDo.TokenURL,
-		STSAudience:       oldDo.STSAudience,
-		CredentialsFile:   oldDo.CredentialsFile,
-		UseSelfSignedJWT:  oldDo.UseSelfSignedJWT,
+		Audience:              oldDo.Audience,
+		Subject:               oldDo.Subject,
+		EarlyTokenRefresh:     oldDo.EarlyTokenRefresh,
+		TokenURL:              oldDo.TokenURL,
+		STSAudience:           oldDo.STSAudience,
+		CredentialsFile:       oldDo.CredentialsFile,
+		UseSelfSignedJWT:      oldDo.UseSelfSignedJWT,
+		MetadataServerTimeout: oldDo.MetadataServerTimeout,
 
 		// These fields are are pointer types that we just want to use exactly
 		// as the user set, copy the ref
 		Client:             oldDo.Client,
 		AuthHandlerOptions: oldDo.AuthHandlerOptions,
+		ExternalAccount:    oldDo.ExternalAccount,
 	}
 
 	// Smartly size this memory and copy below.
@@ -52,6 +54,10 @@ func CloneDetectOptions(oldDo *detect.Options) *detect.Options {
 		newDo.Scopes = make([]string, len(oldDo.Scopes))
 		copy(newDo.Scopes, oldDo.Scopes)
 	}
+	if oldDo.DetectOrder != nil {
+		newDo.DetectOrder = make([]detect.CredentialSource, len(oldDo.DetectOrder))
+		copy(newDo.DetectOrder, oldDo.DetectOrder)
+	}
 
 	return newDo
 }
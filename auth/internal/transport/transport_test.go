@@ -18,6 +18,7 @@ import (
 	"net/http"
 	"reflect"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/auth"
 	"cloud.google.com/go/auth/detect"
@@ -29,7 +30,7 @@ import (
 // future. To make the test pass simply bump the int, but please also clone the
 // relevant fields.
 func TestCloneDetectOptions_FieldTest(t *testing.T) {
-	const WantNumberOfFields = 11
+	const WantNumberOfFields = 14
 	o := detect.Options{}
 	got := reflect.TypeOf(o).NumField()
 	if got != WantNumberOfFields {
@@ -39,16 +40,18 @@ func TestCloneDetectOptions_FieldTest(t *testing.T) {
 
 func TestCloneDetectOptions(t *testing.T) {
 	oldDo := &detect.Options{
-		Audience:          "aud",
-		Subject:           "sub",
-		EarlyTokenRefresh: 42,
-		TokenURL:          "TokenURL",
-		STSAudience:       "STSAudience",
-		CredentialsFile:   "CredentialsFile",
-		UseSelfSignedJWT:  true,
-		CredentialsJSON:   []byte{1, 2, 3, 4, 5},
-		Scopes:            []string{"a", "b"},
-		Client:            &http.Client{},
+		Audience:              "aud",
+		Subject:               "sub",
+		EarlyTokenRefresh:     42,
+		TokenURL:              "TokenURL",
+		STSAudience:           "STSAudience",
+		CredentialsFile:       "CredentialsFile",
+		UseSelfSignedJWT:      true,
+		MetadataServerTimeout: time.Second,
+		CredentialsJSON:       []byte{1, 2, 3, 4, 5},
+		Scopes:                []string{"a", "b"},
+		DetectOrder:           []detect.CredentialSource{detect.CredentialSourceMetadataServer},
+		Client:                &http.Client{},
 		AuthHandlerOptions: &auth.AuthorizationHandlerOptions{
 			Handler: func(authCodeURL string) (code string, state string, err error) {
 				return "", "", nil
@@ -60,6 +63,9 @@ func TestCloneDetectOptions(t *testing.T) {
 				Verifier:        "Verifier",
 			},
 		},
+		ExternalAccount: &detect.ExternalAccountOptions{
+			Audience: "aud",
+		},
 	}
 	newDo := CloneDetectOptions(oldDo)
 
@@ -85,6 +91,9 @@ func TestCloneDetectOptions(t *testing.T) {
 	if got, want := newDo.UseSelfSignedJWT, oldDo.UseSelfSignedJWT; got != want {
 		t.Fatalf("got %v, want %v", got, want)
 	}
+	if got, want := newDo.MetadataServerTimeout, oldDo.MetadataServerTimeout; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
 
 	// Slices
 	if got, want := len(newDo.CredentialsJSON), len(oldDo.CredentialsJSON); got != want {
@@ -99,6 +108,12 @@ func TestCloneDetectOptions(t *testing.T) {
 	if got, want := newDo.Scopes, oldDo.Scopes; reflect.ValueOf(got).Pointer() == reflect.ValueOf(want).Pointer() {
 		t.Fatalf("Scopes should not reference the same slice")
 	}
+	if got, want := len(newDo.DetectOrder), len(oldDo.DetectOrder); got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := newDo.DetectOrder, oldDo.DetectOrder; reflect.ValueOf(got).Pointer() == reflect.ValueOf(want).Pointer() {
+		t.Fatalf("DetectOrder should not reference the same slice")
+	}
 
 	// Pointer types that should be the same memory
 	if got, want := newDo.Client, oldDo.Client; reflect.ValueOf(got).Pointer() != reflect.ValueOf(want).Pointer() {
@@ -107,4 +122,7 @@ func TestCloneDetectOptions(t *testing.T) {
 	if got, want := newDo.AuthHandlerOptions, oldDo.AuthHandlerOptions; reflect.ValueOf(got).Pointer() != reflect.ValueOf(want).Pointer() {
 		t.Fatalf("Scopes should not reference the same slice")
 	}
+	if got, want := newDo.ExternalAccount, oldDo.ExternalAccount; got != want {
+		t.Fatalf("ExternalAccount should reference the same memory")
+	}
 }